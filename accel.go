@@ -0,0 +1,190 @@
+package qemu
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+var accels = []string{"kvm", "hax", "whpx", "hvf", "tcg"}
+
+func validateAccel(accel string) error {
+	if accel == "" {
+		return nil
+	}
+	for _, a := range accels {
+		if a == accel {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown accelerator %q, must be one of %s", accel, strings.Join(accels, ", "))
+}
+
+// accelArgs returns the acceleration arguments for the machine. Guests of a
+// foreign architecture can only run under TCG.
+func (d *Driver) accelArgs() []string {
+	if !d.isNativeArch() || d.Accel != "" {
+		return []string{"-machine", "accel=" + d.requestedAccel()}
+	}
+	return strings.Fields(getQemuAccel(d))
+}
+
+// requestedAccel names the accelerator passed to QEMU.
+func (d *Driver) requestedAccel() string {
+	if !d.isNativeArch() {
+		return "tcg"
+	}
+	if d.Accel != "" {
+		return d.Accel
+	}
+	accel := strings.TrimPrefix(getQemuAccel(d), "-enable-")
+	return strings.TrimPrefix(accel, "-accel ")
+}
+
+// tcgReason says why the machine asks for TCG.
+func (d *Driver) tcgReason() string {
+	if !d.isNativeArch() {
+		return fmt.Sprintf("%s guests cannot be accelerated on this host", d.Arch)
+	}
+	return "it was chosen as the accelerator"
+}
+
+// allowTCG fails with --qemu-require-accel and otherwise warns that the
+// machine is about to be emulated, loud enough to stand out of the
+// docker-machine output.
+func (d *Driver) allowTCG(reason string) error {
+	if d.RequireAccel {
+		return fmt.Errorf("%s would run under TCG emulation because %s, and --qemu-require-accel is set", d.MachineName, reason)
+	}
+	log.Warnf("********************************************************************")
+	log.Warnf("%s runs under TCG, QEMU's CPU emulator, because %s.", d.MachineName, reason)
+	log.Warnf("Expect it to be 10 to 50 times slower than with hardware acceleration:")
+	log.Warnf("booting takes minutes and container builds crawl.")
+	log.Warnf("Pass --qemu-require-accel to fail instead.")
+	log.Warnf("********************************************************************")
+	return nil
+}
+
+// supportedAccels returns the accelerators of this host OS that the QEMU
+// binary was built with.
+func supportedAccels(d *Driver) []string {
+	candidates := hostAccels()
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return candidates
+	}
+	out, err := exec.Command(qemuCmd, "-accel", "help").Output()
+	if err != nil {
+		//QEMU before 4.2 cannot list them, try all of them
+		return candidates
+	}
+	built := strings.Fields(string(out))
+	var supported []string
+	for _, c := range candidates {
+		for _, b := range built {
+			if b == c {
+				supported = append(supported, c)
+			}
+		}
+	}
+	return supported
+}
+
+// benchmarkAccels boots the machine's kernel without a disk under every
+// supported accelerator, measuring the time until SSH answers, and makes
+// the fastest one the machine's accelerator.
+func (d *Driver) benchmarkAccels() error {
+	if d.provisioner() != provisioners["boot2docker"] {
+		log.Infof("Skipping the accelerator benchmark, it needs a boot2docker image")
+		return nil
+	}
+	if err := extractKernel(d); err != nil {
+		return err
+	}
+
+	best, bestTime := "", 3*time.Minute
+	for _, accel := range supportedAccels(d) {
+		elapsed, err := d.bootTime(accel, bestTime)
+		if err != nil {
+			log.Infof("Accelerator %s: %v", accel, err)
+			continue
+		}
+		log.Infof("Accelerator %s: SSH up after %s", accel, elapsed)
+		best, bestTime = accel, elapsed
+	}
+	if best == "" {
+		return fmt.Errorf("No accelerator could boot %s", d.MachineName)
+	}
+	log.Infof("Using the fastest accelerator %s", best)
+	d.Accel = best
+	return nil
+}
+
+// bootTime boots the kernel under accel and returns how long it took until
+// the SSH server sent its banner, giving up after limit.
+func (d *Driver) bootTime(accel string, limit time.Duration) (time.Duration, error) {
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return 0, err
+	}
+	port, err := getTCPPort(d)
+	if err != nil {
+		return 0, err
+	}
+	args := []string{
+		"-machine", "accel=" + accel,
+		"-m", strconv.Itoa(d.Mem),
+		"-smp", strconv.Itoa(d.Cpus),
+		"-kernel", qemuPath(d.ResolveStorePath("vmlinuz64")),
+		"-initrd", qemuPath(d.ResolveStorePath("initrd.img")),
+		"-append", d.kernelCmdline(),
+		"-netdev", fmt.Sprintf("user,id=mynet0,hostfwd=tcp:127.0.0.1:%d-:22", port),
+		"-device", "virtio-net,netdev=mynet0",
+		"-nographic", "-serial", "null", "-monitor", "none",
+	}
+	args = append(args, d.archArgs()...)
+	cmd := exec.Command(qemuCmd, args...)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	for time.Since(start) < limit {
+		select {
+		case err := <-exited:
+			exited <- err
+			return 0, fmt.Errorf("QEMU exited: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if sshBanner(port) {
+			return time.Since(start), nil
+		}
+	}
+	return 0, fmt.Errorf("not up within %s", limit)
+}
+
+// sshBanner reports whether an SSH server answers on the forwarded port.
+// The user network accepts connections before the guest is up, so only the
+// banner proves the guest booted.
+func sshBanner(port int) bool {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(line, "SSH-")
+}
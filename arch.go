@@ -0,0 +1,147 @@
+package qemu
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const defaultArch = "x86_64"
+
+// archSpec describes how to boot a guest of one architecture.
+type archSpec struct {
+	// binary is the qemu-system executable without any OS suffix.
+	binary string
+	// machine is the -M value, empty for QEMU's default.
+	machine string
+	// bios is the -bios value, empty for QEMU's default.
+	bios string
+	// console is the kernel's name of the serial port wired to the log.
+	console string
+	// kernel and initrd are the boot file locations on the ISO.
+	kernel string
+	initrd string
+	// kernelMagic is found at kernelMagicOffset in a valid kernel image,
+	// the setup header of a bzImage or the RISC-V Image header.
+	kernelMagic       string
+	kernelMagicOffset int
+	// goarch is the host GOARCH that can run this guest accelerated.
+	goarch string
+	// fastBoot are the -machine options dropping legacy devices when
+	// --qemu-fast-boot is set.
+	fastBoot string
+	// panicDevice is the -device reporting guest panics to QEMU, empty
+	// when the machine has none.
+	panicDevice string
+	// smbios tells whether the machine has SMBIOS tables to carry the
+	// machine identity.
+	smbios bool
+	// cpuModel is QEMU's default CPU model, which gets the paravirtual
+	// features under KVM. Empty when there are none to add.
+	cpuModel string
+	// cpu is the -cpu value the guest needs because QEMU's default model
+	// cannot run it, empty when the default can.
+	cpu string
+}
+
+var archs = map[string]archSpec{
+	"x86_64": {
+		binary:            "qemu-system-x86_64",
+		console:           "ttyS0",
+		kernel:            "BOOT/VMLINUZ64.;1",
+		initrd:            "BOOT/INITRD.IMG;1",
+		kernelMagic:       "HdrS",
+		kernelMagicOffset: 0x202,
+		goarch:            "amd64",
+		fastBoot:          "usb=off,vmport=off",
+		panicDevice:       "pvpanic",
+		smbios:            true,
+		cpuModel:          "qemu64",
+	},
+	"aarch64": {
+		binary:            "qemu-system-aarch64",
+		machine:           "virt,gic-version=max",
+		console:           "ttyAMA0",
+		kernel:            "BOOT/IMAGE.;1",
+		initrd:            "BOOT/INITRD.IMG;1",
+		kernelMagic:       "ARM\x64",
+		kernelMagicOffset: 0x38,
+		goarch:            "arm64",
+		fastBoot:          "usb=off",
+		panicDevice:       "pvpanic-pci",
+		//The default of virt is a 32-bit Cortex-A15, max is the host's CPU
+		//under KVM and HVF
+		cpu: "max",
+	},
+	"riscv64": {
+		binary:            "qemu-system-riscv64",
+		machine:           "virt",
+		bios:              "default",
+		console:           "ttyS0",
+		kernel:            "BOOT/IMAGE.;1",
+		initrd:            "BOOT/INITRD.IMG;1",
+		kernelMagic:       "RSC\x05",
+		kernelMagicOffset: 0x38,
+		goarch:            "riscv64",
+		fastBoot:          "usb=off",
+	},
+}
+
+func archNames() string {
+	var names []string
+	for name := range archs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func validateArch(arch string) error {
+	if _, ok := archs[arch]; !ok {
+		return fmt.Errorf("Unsupported architecture %q, must be one of %s", arch, archNames())
+	}
+	return nil
+}
+
+// arch returns the spec of the machine's guest architecture. Machines
+// created before the architecture was configurable are x86_64.
+func (d *Driver) arch() archSpec {
+	if spec, ok := archs[d.Arch]; ok {
+		return spec
+	}
+	return archs[defaultArch]
+}
+
+// isNativeArch reports whether the guest can use the host's hardware
+// acceleration.
+func (d *Driver) isNativeArch() bool {
+	return d.arch().goarch == runtime.GOARCH
+}
+
+// archArgs returns the machine, firmware and CPU arguments of the guest
+// architecture.
+func (d *Driver) archArgs() []string {
+	var args []string
+	spec := d.arch()
+	if spec.machine != "" {
+		args = append(args, "-M", spec.machine)
+	}
+	if spec.bios != "" {
+		args = append(args, "-bios", spec.bios)
+	}
+	if spec.cpu != "" {
+		args = append(args, "-cpu", spec.cpu)
+	}
+	return args
+}
+
+// fastBootArgs returns the options shaving time off every boot when
+// --qemu-fast-boot is set: no boot menu, no legacy devices, and exiting on
+// guest reboot instead of going through the firmware again.
+func (d *Driver) fastBootArgs() []string {
+	if !d.FastBoot {
+		return nil
+	}
+	return []string{"-no-reboot", "-boot", "menu=off", "-machine", d.arch().fastBoot}
+}
@@ -0,0 +1,41 @@
+package qemu
+
+import (
+	"fmt"
+)
+
+func validateAudio(audio string) error {
+	if audio == "" || audio == "none" {
+		return nil
+	}
+	if !stringIn(hostAudioDrivers(), audio) {
+		return fmt.Errorf("Audio backend %q is not available on this host, must be one of none, %v", audio, hostAudioDrivers())
+	}
+	return nil
+}
+
+// isQ35 tells whether an option switched the guest to the q35 machine.
+func (d *Driver) isQ35() bool {
+	return d.Firmware == "uefi-secureboot" || d.Confidential != ""
+}
+
+// audioArgs returns an HD audio controller with a codec playing and
+// recording through the host audio backend.
+func (d *Driver) audioArgs() ([]string, error) {
+	if d.Audio == "" || d.Audio == "none" {
+		return nil, nil
+	}
+	audiodev, err := newQemuOpts(d.Audio).Set("id", "snd0").Build()
+	if err != nil {
+		return nil, err
+	}
+	controller := "intel-hda"
+	if d.isQ35() {
+		controller = "ich9-intel-hda"
+	}
+	return []string{
+		"-audiodev", audiodev,
+		"-device", controller,
+		"-device", "hda-duplex,audiodev=snd0",
+	}, nil
+}
@@ -0,0 +1,127 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// hypervisorBackend is the program running the machine. The driver builds
+// QEMU's command line, a backend finds its executable and turns that
+// command line into the process to start, translating the options its
+// hypervisor spells differently or does not have.
+type hypervisorBackend interface {
+	// binary locates the hypervisor executable.
+	binary(d *Driver) (string, error)
+	// command returns the process running the machine with the QEMU
+	// arguments args.
+	command(d *Driver, binary string, args []string) (*exec.Cmd, error)
+}
+
+var backends = map[string]hypervisorBackend{
+	"qemu":             qemuBackend{},
+	"qemu-kvm":         qemuKVMBackend{},
+	"cloud-hypervisor": cloudHypervisorBackend{},
+	"firecracker":      firecrackerBackend{},
+}
+
+// backendNames lists the backends for flag usage and errors.
+func backendNames() string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func validateBackend(name string) error {
+	if _, ok := backends[name]; name != "auto" && name != "" && !ok {
+		return fmt.Errorf("Unknown backend %q, must be auto or one of %s", name, backendNames())
+	}
+	return nil
+}
+
+// backend returns the machine's hypervisor backend. Machines created before
+// backends were pluggable run qemu-system.
+func (d *Driver) backend() hypervisorBackend {
+	if b, ok := backends[d.Backend]; ok {
+		return b
+	}
+	return backends["qemu"]
+}
+
+// chooseBackend resolves --qemu-backend auto to the first backend whose
+// executable is installed. The qemu-system binary wins when both are.
+func (d *Driver) chooseBackend() error {
+	if d.Backend != "auto" && d.Backend != "" {
+		_, err := d.backend().binary(d)
+		return err
+	}
+	var firstErr error
+	for _, name := range []string{"qemu", "qemu-kvm"} {
+		_, err := backends[name].binary(d)
+		if err == nil {
+			log.Debugf("Using the %s backend for %s", name, d.MachineName)
+			d.Backend = name
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// getQemuCommand returns the hypervisor executable of the machine.
+func getQemuCommand(d *Driver) (string, error) {
+	if d.QemuBinary != "" {
+		return d.QemuBinary, nil
+	}
+	return d.backend().binary(d)
+}
+
+// qemuBackend runs the qemu-system binary of the guest architecture.
+type qemuBackend struct{}
+
+func (qemuBackend) binary(d *Driver) (string, error) {
+	return qemuSystemBinary(d)
+}
+
+func (qemuBackend) command(d *Driver, binary string, args []string) (*exec.Cmd, error) {
+	return exec.Command(binary, args...), nil
+}
+
+// qemuKVMBackend runs the qemu-kvm binary of RHEL and its rebuilds. It only
+// emulates the host architecture, only with KVM, and is not on the PATH.
+type qemuKVMBackend struct{}
+
+var qemuKVMPaths = []string{"/usr/libexec/qemu-kvm", "/usr/bin/qemu-kvm"}
+
+func (qemuKVMBackend) binary(d *Driver) (string, error) {
+	if !d.isNativeArch() {
+		return "", fmt.Errorf("qemu-kvm cannot run %s guests", d.Arch)
+	}
+	candidates := qemuKVMPaths
+	if d.QemuLocation != "" {
+		candidates = []string{filepath.Join(d.QemuLocation, "qemu-kvm")}
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("qemu-kvm not found in %s", strings.Join(candidates, ", "))
+}
+
+func (qemuKVMBackend) command(d *Driver, binary string, args []string) (*exec.Cmd, error) {
+	if accel := d.requestedAccel(); accel != "kvm" {
+		return nil, fmt.Errorf("qemu-kvm only runs guests with KVM, not %s", accel)
+	}
+	return exec.Command(binary, args...), nil
+}
@@ -0,0 +1,146 @@
+package qemu
+
+import (
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The balloon policy keeps the guest at its working set plus some headroom,
+// returning the rest to the host. Small adjustments are skipped so the
+// balloon does not thrash.
+const (
+	balloonPath        = "/machine/peripheral/balloon0"
+	balloonMinHeadroom = 256
+	balloonMinStep     = 64
+	balloonStatsPeriod = 2
+	balloonInterval    = 10 * time.Second
+)
+
+// balloonArgs returns the balloon device when --qemu-balloon is set.
+func (d *Driver) balloonArgs() []string {
+	if !d.Balloon {
+		return nil
+	}
+	return []string{"-device", "virtio-balloon,id=balloon0"}
+}
+
+// startBalloonController starts "docker-machine-driver-qemu balloon" for
+// the machine in the background when --qemu-balloon is set.
+func (d *Driver) startBalloonController() error {
+	if !d.Balloon {
+		return nil
+	}
+	d.stopHelper("balloon")
+	return d.spawnHelper("balloon", "balloon")
+}
+
+// RunBalloon runs the balloon controller of the machine stored in
+// machineDir until its QEMU exits or the machine is removed. It is run by
+// the plugin binary's balloon mode.
+func RunBalloon(machineDir string) error {
+	//A new machine's config may not be saved yet when the helper starts
+	for {
+		if _, err := os.Stat(machineDir); os.IsNotExist(err) {
+			return nil
+		}
+		d, err := loadDriver(machineDir)
+		if err == nil {
+			d.RunBalloonController(balloonInterval, nil)
+			return nil
+		}
+		log.Debugf("Could not read the machine in %s: %v", machineDir, err)
+		time.Sleep(balloonInterval)
+	}
+}
+
+// RunBalloonController polls the guest memory statistics every interval and
+// resizes the balloon until stop is closed or QEMU exited.
+func (d *Driver) RunBalloonController(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.AdjustBalloon(); err != nil {
+			if d.qemuExited() {
+				log.Debugf("QEMU of %s exited, stopping the balloon controller", d.MachineName)
+				return
+			}
+			log.Debugf("Balloon adjustment for %s failed: %v", d.MachineName, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AdjustBalloon runs one step of the balloon policy.
+func (d *Driver) AdjustBalloon() error {
+	if !d.Balloon {
+		return nil
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	err = qmp.execute("qom-set", map[string]interface{}{
+		"path":     balloonPath,
+		"property": "guest-stats-polling-interval",
+		"value":    balloonStatsPeriod,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var stats struct {
+		Stats map[string]int64 `json:"stats"`
+	}
+	err = qmp.execute("qom-get", map[string]interface{}{
+		"path":     balloonPath,
+		"property": "guest-stats",
+	}, &stats)
+	if err != nil {
+		return err
+	}
+	total, available := stats.Stats["stat-total-memory"], stats.Stats["stat-available-memory"]
+	if total <= 0 || available < 0 {
+		//The guest driver has not reported yet
+		return nil
+	}
+
+	var balloon struct {
+		Actual int64 `json:"actual"`
+	}
+	if err := qmp.execute("query-balloon", nil, &balloon); err != nil {
+		return err
+	}
+
+	target := balloonTarget(d, int((total-available)>>20))
+	current := int(balloon.Actual >> 20)
+	if diff := target - current; diff > -balloonMinStep && diff < balloonMinStep {
+		return nil
+	}
+	log.Debugf("Resizing balloon of %s from %dMB to %dMB", d.MachineName, current, target)
+	return qmp.execute("balloon", map[string]interface{}{"value": int64(target) << 20}, nil)
+}
+
+// balloonTarget returns the guest memory size in MB for usedMB of memory in
+// use: a quarter on top as headroom, kept between BalloonMin and Mem.
+func balloonTarget(d *Driver, usedMB int) int {
+	headroom := usedMB / 4
+	if headroom < balloonMinHeadroom {
+		headroom = balloonMinHeadroom
+	}
+	target := usedMB + headroom
+	if target < d.BalloonMin {
+		target = d.BalloonMin
+	}
+	if target > d.Mem {
+		target = d.Mem
+	}
+	return target
+}
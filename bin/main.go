@@ -1,10 +1,206 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	"github.com/intel-iot-devkit/docker-machine-driver-qemu"
 )
 
 func main() {
+	//Supervisor of a lazily started machine, see --qemu-lazy-start
+	if len(os.Args) == 3 && os.Args[1] == "supervise" {
+		if err := qemu.Supervise(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Pauses the machine while the host sleeps, see --qemu-sleep-guard
+	if len(os.Args) == 3 && os.Args[1] == "sleep-guard" {
+		if err := qemu.GuardSleep(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Resizes the memory balloon to the guest's needs, see --qemu-balloon
+	if len(os.Args) == 3 && os.Args[1] == "balloon" {
+		if err := qemu.RunBalloon(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Plaintext engine port, see --qemu-expose-plain-engine
+	if len(os.Args) == 3 && os.Args[1] == "plain-engine" {
+		if err := qemu.ServePlainEngine(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Troubleshooting bundle for bug reports, written to stdout
+	if len(os.Args) == 3 && os.Args[1] == "bundle" {
+		if err := qemu.WriteSupportBundle(os.Args[2], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Lightweight hypervisor and its port forwards, see --qemu-backend
+	if len(os.Args) == 3 && os.Args[1] == "microvm" {
+		if err := qemu.RunMicroVM(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Restores a corrupted config.json from its backup
+	if len(os.Args) == 3 && os.Args[1] == "recover-config" {
+		if err := qemu.RecoverConfig(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Summary of all QEMU machines of the store, see GetState
+	if len(os.Args) == 3 && os.Args[1] == "status" {
+		table, err := qemu.StatusTable(os.Args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(table)
+		return
+	}
+	//Freezes the guest CPUs, e.g. for a consistent disk backup
+	if len(os.Args) == 3 && (os.Args[1] == "pause" || os.Args[1] == "unpause") {
+		if err := qemu.PauseMachine(os.Args[2], os.Args[1] == "unpause"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Host and guest CPU features of a running machine
+	if len(os.Args) == 3 && os.Args[1] == "cpu-features" {
+		report, err := qemu.CPUFeatureReport(os.Args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(report)
+		return
+	}
+	//Live kernel console of a machine, printed until interrupted
+	if len(os.Args) == 3 && os.Args[1] == "console" {
+		err := qemu.FollowMachineConsole(os.Args[2], nil, func(line string) {
+			fmt.Println(line)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Rewrites the disk of a stopped machine, e.g. convert-disk <dir> qcow2 compress encrypt
+	if len(os.Args) >= 4 && os.Args[1] == "convert-disk" {
+		c := qemu.DiskConversion{Format: os.Args[3]}
+		for _, option := range os.Args[4:] {
+			switch option {
+			case "compress":
+				c.Compress = true
+			case "encrypt":
+				c.Encrypt = true
+			default:
+				fmt.Fprintf(os.Stderr, "Unknown conversion option %q, must be compress or encrypt\n", option)
+				os.Exit(1)
+			}
+		}
+		if err := qemu.ConvertMachineDisk(os.Args[2], c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Changes the resources of a machine, e.g. reconfigure <dir> cpus=4 memory=4096 ports=8080,53/udp
+	if len(os.Args) >= 4 && os.Args[1] == "reconfigure" {
+		var c qemu.ResourceConfig
+		for _, setting := range os.Args[3:] {
+			parts := strings.SplitN(setting, "=", 2)
+			var err error
+			switch {
+			case len(parts) == 2 && parts[0] == "cpus":
+				c.Cpus, err = strconv.Atoi(parts[1])
+			case len(parts) == 2 && parts[0] == "memory":
+				c.Mem, err = strconv.Atoi(parts[1])
+			case len(parts) == 2 && parts[0] == "ports":
+				//An empty list closes all open ports
+				c.OpenPorts = []string{}
+				if parts[1] != "" {
+					c.OpenPorts = strings.Split(parts[1], ",")
+				}
+			default:
+				err = fmt.Errorf("Unknown setting %q, must be cpus=, memory= or ports=", setting)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		restart, err := qemu.ReconfigureMachine(os.Args[2], c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(restart) > 0 {
+			fmt.Printf("Restart the machine to apply: %s\n", strings.Join(restart, ", "))
+		}
+		return
+	}
+	//Adds vCPUs or memory in MB to a running machine, e.g. hotplug <dir> cpus 2
+	if len(os.Args) == 5 && os.Args[1] == "hotplug" {
+		amount, err := strconv.Atoi(os.Args[4])
+		if err == nil {
+			switch os.Args[3] {
+			case "cpus":
+				err = qemu.HotplugMachine(os.Args[2], amount, 0)
+			case "memory":
+				err = qemu.HotplugMachine(os.Args[2], 0, amount)
+			default:
+				err = fmt.Errorf("Unknown resource %q, must be cpus or memory", os.Args[3])
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Sets machine labels, an empty value removes one, e.g. label <dir> owner=ci ttl=
+	if len(os.Args) >= 4 && os.Args[1] == "label" {
+		if err := qemu.SetMachineLabels(os.Args[2], os.Args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//Accelerators, architectures and backends usable on this host, as JSON
+	if (len(os.Args) == 2 || len(os.Args) == 3) && os.Args[1] == "capabilities" {
+		location := ""
+		if len(os.Args) == 3 {
+			location = os.Args[2]
+		}
+		report, err := qemu.HostCapabilities(location)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(report))
+		return
+	}
 	plugin.RegisterDriver(new(qemu.Driver))
 }
@@ -0,0 +1,58 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// qemuVersion returns the first line of binary --version.
+func qemuVersion(binary string) (string, error) {
+	out, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("Could not run %s: %v", binary, err)
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+}
+
+// pinQemuBinary records the --qemu-binary path and its version.
+func (d *Driver) pinQemuBinary(binary string) error {
+	if binary == "" {
+		return nil
+	}
+	path, err := filepath.Abs(binary)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("QEMU binary %s: %v", binary, err)
+	}
+	version, err := qemuVersion(path)
+	if err != nil {
+		return err
+	}
+	d.QemuBinary, d.QemuBinaryVersion = path, version
+	return nil
+}
+
+// checkQemuBinary revalidates a pinned binary before it is started again.
+func (d *Driver) checkQemuBinary() error {
+	if d.QemuBinary == "" {
+		return nil
+	}
+	if _, err := os.Stat(d.QemuBinary); err != nil {
+		return fmt.Errorf("The QEMU binary %s pinned for %s is gone: %v", d.QemuBinary, d.MachineName, err)
+	}
+	version, err := qemuVersion(d.QemuBinary)
+	if err != nil {
+		return err
+	}
+	if version != d.QemuBinaryVersion {
+		log.Warnf("%s changed from %q to %q since %s was created", d.QemuBinary, d.QemuBinaryVersion, version, d.MachineName)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package qemu
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// diskResumeFree is the free space in bytes needed on the host before a
+// guest paused by a full disk is resumed.
+const diskResumeFree = 256 << 20
+
+var diskErrorPolicies = map[string][]string{
+	"werror": {"enospc", "stop", "report", "ignore"},
+	"rerror": {"stop", "report", "ignore"},
+}
+
+func validateDiskErrorPolicy(kind, policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, p := range diskErrorPolicies[kind] {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid disk %s policy %q, must be one of %v", kind, policy, diskErrorPolicies[kind])
+}
+
+// checkDiskPaused looks for a guest stopped on a disk error. When space is
+// available again the guest is resumed, otherwise it reports Paused. A guest
+// on a block device has no host filesystem to fill and stays Paused until
+// it is unpaused. A guest paused by Pause or the sleep guard reports Paused
+// as well.
+func (d *Driver) checkDiskPaused() (state.State, bool) {
+	if d.QMPPort == 0 && d.MonitorPort == 0 {
+		return state.None, false
+	}
+	status, err := d.vmStatus()
+	if err != nil {
+		return state.None, false
+	}
+	if status == "paused" {
+		return state.Paused, true
+	}
+	if status != "io-error" {
+		return state.None, false
+	}
+	if isBlockDevice(d.Disk) {
+		log.Warnf("%s is paused on a disk error of %s, unpause it once the device is fixed", d.MachineName, d.Disk)
+		return state.Paused, true
+	}
+	if !d.hasDiskSpace() {
+		log.Warnf("%s is paused on a disk error, the host disk holding %s may be full", d.MachineName, d.Disk)
+		return state.Paused, true
+	}
+	if err := d.controlCommand("cont"); err != nil {
+		return state.Error, true
+	}
+	return state.None, false
+}
+
+func (d *Driver) hasDiskSpace() bool {
+	free, err := freeDiskSpace(filepath.Dir(d.Disk))
+	if err != nil {
+		log.Debugf("Could not get free space for %s: %v", d.Disk, err)
+		return false
+	}
+	return free >= diskResumeFree
+}
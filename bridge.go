@@ -0,0 +1,124 @@
+package qemu
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// With --qemu-network bridge the machine gets a second NIC on an existing
+// host bridge holding the LAN interface, through qemu-bridge-helper, and a
+// LAN address from the network's DHCP server. The engine URL uses that
+// address, so other hosts reach the engine without port forwards. SSH keeps
+// using the forward, and the address is read from the guest over it, as
+// the driver sees no lease of a DHCP server it does not run.
+
+var networkModes = []string{"user", "bridge"}
+
+// bridgedIPTimeout is how long the guest has to get a LAN address.
+const bridgedIPTimeout = 2 * time.Minute
+
+func validateNetwork(d *Driver) error {
+	if d.Network != "" && !stringIn(networkModes, d.Network) {
+		return fmt.Errorf("Invalid network %q, must be one of %v", d.Network, networkModes)
+	}
+	if !d.isBridged() {
+		if d.BridgeInterface != "" {
+			return fmt.Errorf("--qemu-bridge-interface needs --qemu-network bridge")
+		}
+		return nil
+	}
+	switch {
+	case d.BridgeInterface == "":
+		return fmt.Errorf("--qemu-network bridge needs --qemu-bridge-interface, the host bridge such as br0")
+	case d.HostOnly:
+		return fmt.Errorf("--qemu-network bridge cannot be combined with --qemu-host-only")
+	case d.LazyStart:
+		return fmt.Errorf("--qemu-network bridge cannot be combined with --qemu-lazy-start")
+	}
+	return nil
+}
+
+func (d *Driver) isBridged() bool {
+	return d.Network == "bridge"
+}
+
+// randomMAC returns a MAC address in QEMU's 52:54:00 range for the bridged
+// NIC. It is chosen at create and kept, so the LAN's DHCP server keeps the
+// machine's address, and it is random, as machines of the same name on
+// other hosts share the LAN.
+func randomMAC() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", b[0], b[1], b[2]), nil
+}
+
+// bridgedArgs returns the second NIC, attached to the host bridge.
+func (d *Driver) bridgedArgs() ([]string, error) {
+	if !d.isBridged() {
+		return nil, nil
+	}
+	netdev, err := newQemuOpts("bridge").
+		Set("id", "bridged0").
+		Set("br", d.BridgeInterface).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	nic, err := qemucmd.Device{Driver: d.nicModel(1), Props: []qemucmd.Option{
+		{Key: "netdev", Value: "bridged0"},
+		{Key: "mac", Value: d.BridgedMAC},
+	}}.Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-netdev", netdev, "-device", nic}, nil
+}
+
+// waitBridgedIP waits for the guest interface with the bridged MAC address
+// to get an IPv4 address.
+func (d *Driver) waitBridgedIP() error {
+	if !d.isBridged() {
+		return nil
+	}
+	cmd := fmt.Sprintf(`for i in /sys/class/net/*; do if [ "$(cat $i/address)" = "%s" ]; then ip -4 -o addr show dev "${i##*/}"; fi; done`,
+		d.BridgedMAC)
+	deadline := time.Now().Add(bridgedIPTimeout)
+	for time.Now().Before(deadline) {
+		out, err := drivers.RunSSHCommandFromDriver(d, cmd)
+		if err != nil {
+			log.Debugf("Could not read the addresses of %s: %v", d.MachineName, err)
+		} else if ip := parseInetAddr(out); ip != "" {
+			log.Debugf("%s has the bridged address %s", d.MachineName, ip)
+			d.BridgedIP = ip
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s got no address on %s within %s, does the guest run DHCP on its second interface and the LAN have a DHCP server?",
+		d.MachineName, d.BridgeInterface, bridgedIPTimeout)
+}
+
+// parseInetAddr returns the first address of "ip -4 -o addr" output, whose
+// lines read "<index>: <interface> inet <ip>/<prefix> ...".
+func parseInetAddr(out string) string {
+	fields := strings.Fields(out)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "inet" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(fields[i+1])
+		if err == nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
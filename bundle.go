@@ -0,0 +1,137 @@
+package qemu
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// bundleFiles are the machine directory files worth attaching to a bug
+// report. Keys and disks are never included.
+var bundleFiles = []string{
+	"qemu.log", "kern.log", "qemu.cmdline", "features.json", "state.json",
+	"supervisor.log", "sleepguard.log", "balloon.log",
+}
+
+// redactedKey matches config keys whose values are secrets.
+var redactedKey = regexp.MustCompile(`(?i)secret|password|token|passphrase`)
+
+// SupportBundle writes a tar.gz for bug reports to w, holding the machine
+// config with secrets redacted, QEMU's and the guest kernel's logs, the
+// last QEMU command line, the helper logs and a report of the host's
+// capabilities.
+func (d *Driver) SupportBundle(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: d.MachineName + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	config, err := d.redactedConfig()
+	if err != nil {
+		return err
+	}
+	if err := add("config.json", config); err != nil {
+		return err
+	}
+	for _, name := range bundleFiles {
+		data, err := ioutil.ReadFile(d.ResolveStorePath(name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := add(name, data); err != nil {
+			return err
+		}
+	}
+	if err := add("host.txt", []byte(d.hostReport())); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// WriteSupportBundle writes the support bundle of the machine stored in
+// machineDir. It is run by the plugin binary's bundle mode.
+func WriteSupportBundle(machineDir string, w io.Writer) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	return d.SupportBundle(w)
+}
+
+// redactedConfig returns config.json with the values of secret looking
+// keys replaced.
+func (d *Driver) redactedConfig() ([]byte, error) {
+	data, err := ioutil.ReadFile(d.ResolveStorePath("config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var config interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redact(config), "", "  ")
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && s != "" && redactedKey.MatchString(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+// hostReport describes the host as far as the driver cares.
+func (d *Driver) hostReport() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "os: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	if qemuCmd, err := getQemuCommand(d); err != nil {
+		fmt.Fprintf(&b, "qemu: %v\n", err)
+	} else if version, err := qemuVersion(qemuCmd); err != nil {
+		fmt.Fprintf(&b, "qemu: %s: %v\n", qemuCmd, err)
+	} else {
+		fmt.Fprintf(&b, "qemu: %s: %s\n", qemuCmd, version)
+	}
+	fmt.Fprintf(&b, "accelerators: %s\n", strings.Join(supportedAccels(d), " "))
+	if err := d.checkAccel(); err != nil {
+		fmt.Fprintf(&b, "accelerator check: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "accelerator check: ok (%s)\n", d.requestedAccel())
+	}
+	if s, since := d.LastKnownState(); s != "" {
+		fmt.Fprintf(&b, "last state: %s since %s\n", s, since.Format(time.RFC3339))
+	}
+	for _, line := range d.Diagnostics() {
+		fmt.Fprintf(&b, "diagnostic: %s\n", line)
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+)
+
+// Large downloads are kept in a cache directory that can live outside of
+// the machine store, so backups of the store stay small. Without
+// --qemu-cache-dir it follows XDG_CACHE_HOME when set, and is the store's
+// own cache directory otherwise.
+
+const latestBoot2DockerURL = "https://github.com/boot2docker/boot2docker/releases/latest/download/boot2docker.iso"
+
+func defaultCacheDir() string {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "docker-machine-qemu")
+	}
+	return ""
+}
+
+// cacheDir returns the directory holding the boot2docker ISO and the
+// catalog images.
+func (d *Driver) cacheDir() string {
+	if d.CacheDir != "" {
+		return d.CacheDir
+	}
+	return filepath.Join(d.StorePath, "cache")
+}
+
+// updateISOCache makes sure the boot2docker ISO is in the cache. Like
+// docker-machine, only the default ISO is cached. A cached ISO is checked
+// for a newer release at most every --qemu-iso-max-age, with a conditional
+// request instead of the GitHub API docker-machine uses.
+func (d *Driver) updateISOCache() error {
+	if d.Boot2DockerURL != "" {
+		return nil
+	}
+	dir := d.cacheDir()
+	iso := filepath.Join(dir, "boot2docker.iso")
+	if fileExists(iso) {
+		if d.SkipISOUpdate {
+			log.Debugf("Using the cached %s without checking for updates", iso)
+			return nil
+		}
+		meta := readISOMeta(iso)
+		if time.Since(meta.Checked) < d.ISOMaxAge {
+			return nil
+		}
+		changed, err := isoChanged(iso, meta)
+		if err != nil {
+			log.Warnf("Could not check for a newer boot2docker.iso, using the cached one: %v", err)
+			return nil
+		}
+		if !changed {
+			meta.Checked = time.Now()
+			return writeISOMeta(iso, meta)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	log.Infof("Downloading boot2docker.iso to %s...", dir)
+	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
+	if err := b2dutils.DownloadISO(dir, "boot2docker.iso", latestBoot2DockerURL); err != nil {
+		return err
+	}
+	meta, err := isoValidators(nil)
+	if err != nil {
+		log.Debugf("Could not record the validators of boot2docker.iso: %v", err)
+		return nil
+	}
+	return writeISOMeta(iso, meta)
+}
+
+// isoMeta records what the server said about the cached ISO.
+type isoMeta struct {
+	ETag         string
+	LastModified string
+	Checked      time.Time
+}
+
+func readISOMeta(iso string) isoMeta {
+	var meta isoMeta
+	if data, err := ioutil.ReadFile(iso + ".json"); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+func writeISOMeta(iso string, meta isoMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(iso+".json", data, 0644)
+}
+
+// isoChanged asks whether the latest ISO differs from the cached one,
+// sending the recorded ETag and the download time as validators.
+func isoChanged(iso string, meta isoMeta) (bool, error) {
+	info, err := os.Stat(iso)
+	if err != nil {
+		return false, err
+	}
+	if meta.LastModified == "" {
+		meta.LastModified = info.ModTime().UTC().Format(http.TimeFormat)
+	}
+	latest, err := isoValidators(&meta)
+	if err == errNotModified {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	//Some servers ignore the conditions but still send the ETag
+	return meta.ETag == "" || latest.ETag != meta.ETag, nil
+}
+
+var errNotModified = errors.New("not modified")
+
+// isoValidators sends a HEAD request for the latest ISO, conditional on
+// the validators of cached when given, and returns the new validators.
+func isoValidators(cached *isoMeta) (isoMeta, error) {
+	req, err := http.NewRequest("HEAD", latestBoot2DockerURL, nil)
+	if err != nil {
+		return isoMeta{}, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return isoMeta{}, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return isoMeta{}, errNotModified
+	case resp.StatusCode != http.StatusOK:
+		return isoMeta{}, fmt.Errorf("%s: %s", latestBoot2DockerURL, resp.Status)
+	}
+	return isoMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Checked:      time.Now(),
+	}, nil
+}
+
+// copyISO copies the boot2docker ISO into the machine directory. A copy
+// matching the cached ISO is kept, otherwise it is replaced by a hard link
+// to the cached one, or a reflink or copy where linking fails.
+func (d *Driver) copyISO() error {
+	dst := d.ResolveStorePath("boot2docker.iso")
+	if d.Boot2DockerURL != "" {
+		b2dutils := mcnutils.NewB2dUtils(d.StorePath)
+		if err := b2dutils.DownloadISO(d.ResolveStorePath("."), "boot2docker.iso", d.Boot2DockerURL); err != nil {
+			return err
+		}
+		d.logISOVersion(dst)
+		return nil
+	}
+	src := filepath.Join(d.cacheDir(), "boot2docker.iso")
+	if sameFile(src, dst) {
+		log.Debugf("%s matches the cached boot2docker.iso, keeping it", dst)
+		d.logISOVersion(dst)
+		return nil
+	}
+	os.Remove(dst)
+	//The cache replaces the ISO by renaming a new download over it, so a
+	//link keeps pointing at the version the machine was created with
+	if err := os.Link(src, dst); err != nil {
+		log.Debugf("Could not link %s, copying it: %v", src, err)
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	d.logISOVersion(dst)
+	return nil
+}
+
+// sameFile reports whether a and b have the same size and contents.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil || infoA.Size() != infoB.Size() {
+		return false
+	}
+	if os.SameFile(infoA, infoB) {
+		return true
+	}
+	sumA, err := fileSHA256(a)
+	if err != nil {
+		return false
+	}
+	sumB, err := fileSHA256(b)
+	return err == nil && sumA == sumB
+}
+
+// isoVersion returns the volume ID of the ISO, which for boot2docker names
+// its version, like b2d-v19.03.12.
+func isoVersion(iso string) (string, error) {
+	f, err := os.Open(iso)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	//The primary volume descriptor is in sector 16, the volume ID at byte 40
+	id := make([]byte, 32)
+	if _, err := f.ReadAt(id, 16*2048+40); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+func (d *Driver) logISOVersion(iso string) {
+	version, err := isoVersion(iso)
+	if err != nil || version == "" {
+		log.Debugf("Could not read the version of %s: %v", iso, err)
+		return
+	}
+	d.progress("Using %s", version)
+}
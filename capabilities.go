@@ -0,0 +1,112 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Capabilities is what the driver can run on this host, so frontends and
+// scripts can offer only the flags that work instead of failing at create
+// time. Everything is probed with the machine's QEMU location and binary.
+type Capabilities struct {
+	OS             string              `json:"os"`
+	Arch           string              `json:"arch"`
+	Architectures  []ArchCapability    `json:"architectures"`
+	Backends       []BackendCapability `json:"backends"`
+	NetworkModes   []string            `json:"network_modes"`
+	NetworkDevices []string            `json:"network_devices"`
+	Firmwares      []string            `json:"firmwares"`
+	AudioDrivers   []string            `json:"audio_drivers"`
+}
+
+// ArchCapability is a guest architecture, with the accelerators its QEMU
+// binary can use here. Error says why the binary was not found.
+type ArchCapability struct {
+	Name         string   `json:"name"`
+	Binary       string   `json:"binary,omitempty"`
+	Accelerators []string `json:"accelerators"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// BackendCapability is a hypervisor backend. Error says why it cannot run
+// here.
+type BackendCapability struct {
+	Name   string `json:"name"`
+	Binary string `json:"binary,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Capabilities probes what the driver can run on this host.
+func (d *Driver) Capabilities() Capabilities {
+	c := Capabilities{
+		OS:             runtime.GOOS,
+		Arch:           runtime.GOARCH,
+		NetworkModes:   hostNetworkModes(),
+		NetworkDevices: nicModels,
+		AudioDrivers:   hostAudioDrivers(),
+	}
+
+	probe := *d
+	var names []string
+	for name := range archs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		probe.Arch = name
+		arch := ArchCapability{Name: name, Accelerators: []string{}}
+		binary, err := qemuSystemBinary(&probe)
+		if err != nil {
+			arch.Error = err.Error()
+			c.Architectures = append(c.Architectures, arch)
+			continue
+		}
+		arch.Binary = binary
+		if probe.isNativeArch() {
+			probe.Backend, probe.QemuBinary = "qemu", binary
+			for _, accel := range supportedAccels(&probe) {
+				if accelUsable(accel) {
+					arch.Accelerators = append(arch.Accelerators, accel)
+				}
+			}
+		} else {
+			arch.Accelerators = []string{"tcg"}
+		}
+		c.Architectures = append(c.Architectures, arch)
+	}
+
+	probe = *d
+	probe.Arch = defaultArch
+	for _, name := range []string{"qemu", "qemu-kvm", "cloud-hypervisor", "firecracker"} {
+		backend := BackendCapability{Name: name}
+		binary, err := backends[name].binary(&probe)
+		if _, micro := backends[name].(microVMBackend); err == nil && micro && runtime.GOOS != "linux" {
+			binary, err = "", fmt.Errorf("The %s backend only runs on Linux", name)
+		}
+		if err != nil {
+			backend.Error = err.Error()
+		} else {
+			backend.Binary = binary
+		}
+		c.Backends = append(c.Backends, backend)
+	}
+
+	c.Firmwares = []string{"bios"}
+	for _, firmware := range firmwares[1:] {
+		probe.Firmware = firmware
+		if _, err := probe.findOVMF(); err == nil {
+			c.Firmwares = append(c.Firmwares, firmware)
+		}
+	}
+	return c
+}
+
+// HostCapabilities returns the capabilities of this host as JSON, probing
+// the QEMU install in qemuLocation or on the PATH when it is empty. It is
+// run by the plugin binary's capabilities mode.
+func HostCapabilities(qemuLocation string) ([]byte, error) {
+	d := &Driver{QemuLocation: qemuLocation}
+	return json.MarshalIndent(d.Capabilities(), "", "  ")
+}
@@ -0,0 +1,219 @@
+package qemu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// An image catalog is a JSON document listing the guest images an
+// organization approves, for example
+//
+//	{"images": [{"name": "boot2docker", "version": "18.09.0",
+//	  "url": "https://.../boot2docker.iso", "sha256": "..."}]}
+//
+// The first entry of a name is used when no version is asked for. An entry
+// may name the provisioner its image needs, otherwise it is detected.
+type imageCatalog struct {
+	Images []catalogImage `json:"images"`
+}
+
+type catalogImage struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	URL         string `json:"url"`
+	SHA256      string `json:"sha256"`
+	Provisioner string `json:"provisioner"`
+}
+
+// httpURL maps s3://bucket/key locations onto their HTTPS endpoint. The
+// requests are not signed, so the objects have to be public.
+func httpURL(location string) string {
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if len(parts) == 2 {
+			return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", parts[0], parts[1])
+		}
+	}
+	return location
+}
+
+func fetchCatalog(location string) (*imageCatalog, error) {
+	var body io.ReadCloser
+	if strings.Contains(location, "://") {
+		resp, err := http.Get(httpURL(location))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Fetching image catalog %s: %s", location, resp.Status)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	var catalog imageCatalog
+	if err := json.NewDecoder(body).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("Invalid image catalog %s: %v", location, err)
+	}
+	for _, img := range catalog.Images {
+		if err := img.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid image catalog %s: %v", location, err)
+		}
+	}
+	return &catalog, nil
+}
+
+// validate checks that the entry names a URL and the checksum verifying
+// the download.
+func (img *catalogImage) validate() error {
+	ref := img.Name + ":" + img.Version
+	switch {
+	case img.Name == "":
+		return fmt.Errorf("An entry has no name")
+	case img.URL == "":
+		return fmt.Errorf("Image %s has no url", ref)
+	case img.SHA256 == "":
+		return fmt.Errorf("Image %s has no sha256", ref)
+	}
+	if sum, err := hex.DecodeString(img.SHA256); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("Image %s has an invalid sha256 %q", ref, img.SHA256)
+	}
+	return nil
+}
+
+// lookup finds name[:version] in the catalog.
+func (c *imageCatalog) lookup(ref string) (*catalogImage, error) {
+	name, version := ref, ""
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		name, version = ref[:i], ref[i+1:]
+	}
+	for i := range c.Images {
+		img := &c.Images[i]
+		if img.Name == name && (version == "" || img.Version == version) {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("Image %s is not in the image catalog", ref)
+}
+
+// imageCachePath is where a catalog image is cached, next to the
+// boot2docker ISO cache shared by all machines.
+func (d *Driver) imageCachePath() string {
+	name := fmt.Sprintf("%s-%s.img", d.ImageName, d.ImageVersion)
+	return filepath.Join(d.cacheDir(), "images", name)
+}
+
+// safeCacheName reports whether a catalog name or version can be part of
+// a cache file name, without reaching outside the cache.
+func safeCacheName(s string) bool {
+	return !strings.ContainsAny(s, `/\`) && !strings.Contains(s, "..")
+}
+
+// resolveImage looks up --qemu-image in the catalog and makes sure a
+// verified copy is in the cache.
+func (d *Driver) resolveImage() error {
+	catalog, err := fetchCatalog(d.ImageCatalog)
+	if err != nil {
+		return err
+	}
+	img, err := catalog.lookup(d.Image)
+	if err != nil {
+		return err
+	}
+	for _, part := range []string{img.Name, img.Version} {
+		if !safeCacheName(part) {
+			return fmt.Errorf("Invalid image name or version %q in the image catalog", part)
+		}
+	}
+	d.ImageName, d.ImageVersion, d.ImageURL, d.ImageSHA256 = img.Name, img.Version, img.URL, strings.ToLower(img.SHA256)
+	if d.Provisioner == "" {
+		d.Provisioner = img.Provisioner
+	}
+	if err := validateProvisioner(d.Provisioner); err != nil {
+		return err
+	}
+
+	path := d.imageCachePath()
+	if sum, err := fileSHA256(path); err == nil && sum == d.ImageSHA256 {
+		log.Infof("Using cached image %s", path)
+	} else {
+		log.Infof("Downloading image %s:%s from %s...", img.Name, img.Version, img.URL)
+		if err := downloadVerified(httpURL(img.URL), path, d.ImageSHA256); err != nil {
+			return err
+		}
+	}
+
+	if d.Provisioner == "" {
+		d.Provisioner, err = detectProvisioner(path)
+	}
+	return err
+}
+
+// copyImage copies the cached catalog image into the machine directory.
+func (d *Driver) copyImage() error {
+	return copyFile(d.imageCachePath(), d.ResolveStorePath(d.provisioner().imageFile()))
+}
+
+// downloadVerified fetches url into path, only replacing path when the
+// content matches the SHA256 checksum.
+func downloadVerified(url, path, checksum string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Downloading %s: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(path+".download", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != checksum {
+		return fmt.Errorf("Checksum mismatch for %s: got %s, want %s", url, sum, checksum)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
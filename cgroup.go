@@ -0,0 +1,117 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// qemuOverhead is the memory in MB QEMU needs besides the guest RAM.
+const qemuOverhead = 256
+
+var unitNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9:_.\-]`)
+
+func validateCgroup(d *Driver) error {
+	if !d.CgroupScope {
+		if d.CgroupMemory != 0 || d.CgroupCPU != 0 {
+			return fmt.Errorf("--qemu-cgroup-memory and --qemu-cgroup-cpu need --qemu-cgroup-scope")
+		}
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("Cgroup scopes are only supported on Linux hosts")
+	}
+	if d.CgroupMemory != 0 && d.CgroupMemory < d.Mem+qemuOverhead {
+		return fmt.Errorf("A cgroup memory limit of %dMB is too low for %dMB of guest memory, use at least %dMB", d.CgroupMemory, d.Mem, d.Mem+qemuOverhead)
+	}
+	if d.CgroupCPU < 0 {
+		return fmt.Errorf("Invalid cgroup CPU quota %d%%", d.CgroupCPU)
+	}
+	return nil
+}
+
+// checkCgroupLimits compares the machine size with the limits of the cgroup
+// the driver runs in, which QEMU inherits.
+func (d *Driver) checkCgroupLimits() error {
+	dir := ownCgroup()
+	if dir == "" {
+		return nil
+	}
+	if limit := readCgroupValue(filepath.Join(dir, "memory.max")); limit != "" && limit != "max" {
+		bytes, err := strconv.ParseInt(limit, 10, 64)
+		if err == nil && int64(d.Mem+qemuOverhead)<<20 > bytes {
+			return fmt.Errorf("%dMB of guest memory does not fit into the %dMB memory limit of cgroup %s", d.Mem, bytes>>20, dir)
+		}
+	}
+	if quota := strings.Fields(readCgroupValue(filepath.Join(dir, "cpu.max"))); len(quota) == 2 && quota[0] != "max" {
+		max, err1 := strconv.Atoi(quota[0])
+		period, err2 := strconv.Atoi(quota[1])
+		if err1 == nil && err2 == nil && period > 0 && d.Cpus*period > max {
+			log.Warnf("%d vCPUs exceed the CPU quota of %.1f CPUs of cgroup %s, the guest will be throttled", d.Cpus, float64(max)/float64(period), dir)
+		}
+	}
+	return nil
+}
+
+// ownCgroup returns the cgroup v2 directory of this process, or "" on
+// hosts without cgroup v2.
+func ownCgroup() string {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(line, "0::"))
+		}
+	}
+	return ""
+}
+
+func readCgroupValue(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// scopeUnit is the name of the systemd scope QEMU runs in.
+func (d *Driver) scopeUnit() string {
+	return "docker-machine-qemu-" + unitNameUnsafe.ReplaceAllString(d.MachineName, "_") + ".scope"
+}
+
+// scopeCommand wraps cmd in systemd-run so QEMU gets its own scope with the
+// configured limits. The system manager is used when running as root,
+// otherwise the user's.
+func (d *Driver) scopeCommand(cmd *exec.Cmd) (*exec.Cmd, error) {
+	if !d.CgroupScope {
+		return cmd, nil
+	}
+	systemdRun, err := exec.LookPath("systemd-run")
+	if err != nil {
+		return nil, fmt.Errorf("--qemu-cgroup-scope needs systemd-run: %v", err)
+	}
+	args := []string{"--scope", "--quiet", "--collect", "--unit=" + d.scopeUnit(),
+		"--description=docker-machine " + d.MachineName}
+	if os.Geteuid() != 0 {
+		args = append(args, "--user")
+	}
+	if d.CgroupMemory != 0 {
+		args = append(args, fmt.Sprintf("--property=MemoryMax=%dM", d.CgroupMemory))
+	}
+	if d.CgroupCPU != 0 {
+		args = append(args, fmt.Sprintf("--property=CPUQuota=%d%%", d.CgroupCPU))
+	}
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+	return exec.Command(systemdRun, args...), nil
+}
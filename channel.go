@@ -0,0 +1,128 @@
+package qemu
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The virtio-serial channel lets the host push small files (certificates,
+// environment, provisioning manifests) into the guest before networking is
+// up. The protocol is line based, for every file the host sends
+//
+//	PUT <octal mode> <size> <path>\n<size bytes of data>
+//
+// and the guest answers "OK <path>\n" or "ERR <message>\n".
+const (
+	guestChannelName    = "org.docker-machine.qemu.0"
+	guestChannelPidFile = "/var/run/docker-machine-qemu-channel.pid"
+	channelTimeout      = 30 * time.Second
+)
+
+// GuestChannelReader is a shell loop serving the channel protocol inside
+// the guest. Provisioning installs it and starts it on every boot, and
+// then writes the guest files over the channel.
+const GuestChannelReader = `#!/bin/sh
+echo $$ > ` + guestChannelPidFile + `
+port=/dev/virtio-ports/` + guestChannelName + `
+exec 3<>$port
+while read -r cmd mode size path <&3; do
+	if [ "$cmd" != PUT ]; then echo "ERR unknown command $cmd" >&3; continue; fi
+	mkdir -p "$(dirname "$path")"
+	if head -c "$size" <&3 > "$path" && chmod "$mode" "$path"; then
+		echo "OK $path" >&3
+	else
+		echo "ERR writing $path" >&3
+	fi
+done
+`
+
+// channelArgs returns the virtio-serial device and host socket backing the
+// guest channel.
+func (d *Driver) channelArgs() ([]string, error) {
+	if !d.GuestChannel || d.ChannelPort == 0 {
+		return nil, nil
+	}
+	chardev, err := newQemuOpts("socket").
+		Set("id", "channel0").
+		Set("host", "127.0.0.1").
+		Set("port", strconv.Itoa(d.ChannelPort)).
+		Flag("server").
+		Flag("nowait").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"-device", "virtio-serial",
+		"-chardev", chardev,
+		"-device", "virtserialport,chardev=channel0,name=" + guestChannelName,
+	}, nil
+}
+
+// startGuestChannel installs GuestChannelReader, starts it and returns the
+// boot command starting it again, detached from the boot script. Guest
+// files go over the channel once it answered, otherwise over SSH.
+func (d *Driver) startGuestChannel(p guestProvisioner) ([]string, error) {
+	if !d.GuestChannel || d.ChannelPort == 0 {
+		return nil, nil
+	}
+	d.progress("Starting the guest channel reader...")
+	reader := p.persistDir() + "/channel-reader.sh"
+	if err := writeGuestFile(d, reader, []byte(GuestChannelReader)); err != nil {
+		return nil, err
+	}
+	//A pattern matching the reader would match this very command line too
+	start := fmt.Sprintf("kill -0 $(cat %[2]s 2>/dev/null) 2>/dev/null || { command -v systemd-run >/dev/null && systemd-run --unit=docker-machine-qemu-channel sh %[1]s || setsid sh %[1]s </dev/null >/dev/null 2>&1 & }", reader, guestChannelPidFile)
+	if _, err := drivers.RunSSHCommandFromDriver(d, "sudo sh -c '"+start+"'"); err != nil {
+		return nil, err
+	}
+	if err := d.PushGuestFile(p.persistDir()+"/channel.ok", 0644, []byte("ok\n")); err != nil {
+		log.Warnf("The guest channel of %s does not answer, copying files over SSH: %v", d.MachineName, err)
+	} else {
+		d.channelUp = true
+	}
+	return []string{start}, nil
+}
+
+// PushGuestFile sends data to path inside the guest over the virtio-serial
+// channel. It needs --qemu-guest-channel and a provisioned machine, which
+// runs GuestChannelReader.
+func (d *Driver) PushGuestFile(path string, mode os.FileMode, data []byte) error {
+	if !d.GuestChannel || d.ChannelPort == 0 {
+		return fmt.Errorf("The guest channel is not enabled for %s", d.MachineName)
+	}
+	if strings.ContainsAny(path, " \n") {
+		return fmt.Errorf("Guest path %q cannot contain spaces or newlines", path)
+	}
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(d.ChannelPort), channelTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(channelTimeout))
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "PUT %o %d %s\n", mode.Perm(), len(data), path)
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("No reply from the guest channel: %v", err)
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != "OK "+path {
+		return fmt.Errorf("Guest channel failed to write %s: %s", path, reply)
+	}
+	return nil
+}
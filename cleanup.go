@@ -0,0 +1,43 @@
+package qemu
+
+import (
+	"os"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// machineArtifacts are the files the driver writes into the machine
+// directory: the extracted boot files, the logs, the PID files of QEMU and
+// the helpers and the bookkeeping of create and the state. The keys and
+// certificates and config.json are docker-machine's own.
+var machineArtifacts = []string{
+	"boot2docker.iso", "base.img", "vmlinuz64", "initrd.img", "vmlinux",
+	"seed.iso", "config.ign", "efivars.fd", "firecracker.json", "data.qcow2",
+	"qemu.log", "kern.log", "qemu.cmdline", "phases.log", "features.json",
+	"state.json", createSteps, "qemu.pid", "hypervisor.pid",
+	"supervisor.pid", "supervisor.log", "sleepguard.pid", "sleepguard.log",
+	"balloon.pid", "balloon.log",
+	"plainengine.pid", "plainengine.log", "microvm.pid", "microvm.log",
+}
+
+// removeArtifacts deletes the disk kept in the machine directory and the
+// machineArtifacts once QEMU is gone, so a machine store docker-machine
+// fails to remove does not keep gigabytes. Failures are only logged, the
+// directory goes away with the machine anyway.
+func (d *Driver) removeArtifacts() {
+	paths := []string{}
+	if d.DiskPath == "" && d.Disk != "" {
+		paths = append(paths, d.Disk, d.Disk+".old")
+	}
+	for _, name := range machineArtifacts {
+		paths = append(paths, d.ResolveStorePath(name))
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Could not remove %s: %v", path, err)
+		}
+	}
+	if err := os.RemoveAll(d.ResolveStorePath(machineTmp)); err != nil {
+		log.Warnf("Could not remove %s: %v", d.ResolveStorePath(machineTmp), err)
+	}
+}
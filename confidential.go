@@ -0,0 +1,169 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Confidential guests run with encrypted memory. SEV needs the platform's
+// C-bit position, which QEMU reports, and a UEFI firmware built for it;
+// SEV-SNP and TDX need their own OVMF builds set with --qemu-ovmf-code.
+
+// confidentialTechs maps each --qemu-confidential value to the KVM module
+// parameter telling whether the host enabled it.
+var confidentialTechs = map[string]string{
+	"sev":     "/sys/module/kvm_amd/parameters/sev",
+	"sev-es":  "/sys/module/kvm_amd/parameters/sev_es",
+	"sev-snp": "/sys/module/kvm_amd/parameters/sev_snp",
+	"tdx":     "/sys/module/kvm_intel/parameters/tdx",
+}
+
+func validateConfidential(d *Driver) error {
+	if d.Confidential == "" {
+		return nil
+	}
+	if _, ok := confidentialTechs[d.Confidential]; !ok {
+		return fmt.Errorf("Invalid confidential computing technology %q, must be one of sev, sev-es, sev-snp or tdx", d.Confidential)
+	}
+	if runtime.GOOS != "linux" || d.Arch != "x86_64" {
+		return fmt.Errorf("Confidential guests need an x86_64 guest on a Linux host")
+	}
+	if d.Accel != "" && d.Accel != "kvm" {
+		return fmt.Errorf("Confidential guests need the kvm accelerator")
+	}
+	if !d.isUEFI() {
+		return fmt.Errorf("Confidential guests need UEFI firmware, set --qemu-firmware uefi")
+	}
+	if d.SEVPolicy != "" {
+		if _, err := strconv.ParseUint(d.SEVPolicy, 0, 32); err != nil {
+			return fmt.Errorf("Invalid SEV policy %q", d.SEVPolicy)
+		}
+	}
+	return nil
+}
+
+// checkConfidential checks that KVM enabled the requested technology and,
+// for SEV, records the platform's memory encryption parameters.
+func (d *Driver) checkConfidential() error {
+	if d.Confidential == "" {
+		return nil
+	}
+	param, err := ioutil.ReadFile(confidentialTechs[d.Confidential])
+	if err != nil {
+		return fmt.Errorf("This host does not support %s, KVM has no %s parameter", d.Confidential, confidentialTechs[d.Confidential])
+	}
+	if enabled := strings.TrimSpace(string(param)); enabled != "Y" && enabled != "1" {
+		return fmt.Errorf("%s is disabled in KVM on this host", d.Confidential)
+	}
+	if d.Confidential == "tdx" {
+		return nil
+	}
+	return d.probeSEV()
+}
+
+// probeSEV asks a QEMU without a guest for the SEV capabilities.
+func (d *Driver) probeSEV() error {
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return err
+	}
+	port, err := getTCPPort(d)
+	if err != nil {
+		return err
+	}
+	probe := exec.Command(qemuCmd, "-machine", "none,accel=kvm", "-nodefaults", "-display", "none",
+		"-qmp", fmt.Sprintf("tcp:127.0.0.1:%d,server,nowait", port))
+	if err := probe.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		probe.Process.Kill()
+		probe.Wait()
+	}()
+
+	var qmp *qmpClient
+	for i := 0; i < 25; i++ {
+		time.Sleep(200 * time.Millisecond)
+		if qmp, err = dialQMP(port); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not query the SEV capabilities: %v", err)
+	}
+	defer qmp.Close()
+
+	var caps struct {
+		CBitPos         int `json:"cbitpos"`
+		ReducedPhysBits int `json:"reduced-phys-bits"`
+	}
+	if err := qmp.execute("query-sev-capabilities", nil, &caps); err != nil {
+		return fmt.Errorf("Could not query the SEV capabilities: %v", err)
+	}
+	log.Debugf("SEV C-bit position %d, reduced physical bits %d", caps.CBitPos, caps.ReducedPhysBits)
+	d.SEVCBitPos, d.SEVReducedPhysBits = caps.CBitPos, caps.ReducedPhysBits
+	return nil
+}
+
+// confidentialArgs returns the memory encryption object and the machine
+// option tying the guest to it.
+func (d *Driver) confidentialArgs() ([]string, error) {
+	if d.Confidential == "" {
+		return nil, nil
+	}
+	if d.Confidential == "tdx" {
+		return []string{
+			"-object", "tdx-guest,id=cgs0",
+			"-machine", "q35,kernel-irqchip=split,confidential-guest-support=cgs0",
+		}, nil
+	}
+	object := "sev-guest"
+	if d.Confidential == "sev-snp" {
+		object = "sev-snp-guest"
+	}
+	opts := newQemuOpts(object).
+		Set("id", "cgs0").
+		Set("cbitpos", strconv.Itoa(d.SEVCBitPos)).
+		Set("reduced-phys-bits", strconv.Itoa(d.SEVReducedPhysBits))
+	policy := d.SEVPolicy
+	if policy == "" && d.Confidential == "sev-es" {
+		// No debugging and encrypted register state
+		policy = "0x5"
+	}
+	if policy != "" {
+		opts.Set("policy", policy)
+	}
+	sev, err := opts.Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-object", sev, "-machine", "q35,confidential-guest-support=cgs0"}, nil
+}
+
+// LaunchMeasurement returns the base64 launch measurement of a running SEV
+// guest, for attestation by the guest owner.
+func (d *Driver) LaunchMeasurement() (string, error) {
+	if d.Confidential != "sev" && d.Confidential != "sev-es" {
+		return "", fmt.Errorf("Launch measurements are only available for sev and sev-es guests")
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return "", err
+	}
+	defer qmp.Close()
+
+	var measure struct {
+		Data string `json:"data"`
+	}
+	if err := qmp.execute("query-sev-launch-measure", nil, &measure); err != nil {
+		return "", err
+	}
+	return measure.Data, nil
+}
@@ -0,0 +1,103 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// configBackup keeps the config.json the driver last replaced. A
+// config.json that no longer parses, say because a process died while
+// writing it, is restored from it.
+const configBackup = "config.json.bak"
+
+// saveConfig writes the driver settings back into the machine's
+// config.json, for operations run outside of a docker-machine command that
+// would save them.
+func (d *Driver) saveConfig() error {
+	dir := d.ResolveStorePath(".")
+	data, err := readHostConfig(dir)
+	if err != nil {
+		return err
+	}
+	var host map[string]json.RawMessage
+	if err := json.Unmarshal(data, &host); err != nil {
+		return err
+	}
+	driver, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	host["Driver"] = driver
+	updated, err := json.MarshalIndent(host, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, configBackup), data, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "config.json"), updated, 0600)
+}
+
+// readHostConfig returns the config.json of the machine in machineDir,
+// restoring the backup first when config.json is not valid JSON.
+func readHostConfig(machineDir string) ([]byte, error) {
+	path := filepath.Join(machineDir, "config.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && json.Valid(data) {
+		return data, nil
+	}
+	backup, berr := ioutil.ReadFile(filepath.Join(machineDir, configBackup))
+	if berr != nil || !json.Valid(backup) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is corrupted and there is no backup to restore", path)
+	}
+	log.Warnf("%s is missing or corrupted, restoring the last good config from %s", path, configBackup)
+	if err := writeFileAtomic(path, backup, 0600); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// RecoverConfig restores the config.json of the machine stored in
+// machineDir from its backup when it does not parse, so docker-machine can
+// load the machine again. It is run by the plugin binary's recover-config
+// mode.
+func RecoverConfig(machineDir string) error {
+	_, err := readHostConfig(machineDir)
+	return err
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so a crash leaves either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && perm&0077 == 0 {
+		err = restrictToOwner(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,132 @@
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The kernel console is written to kern.log in the machine directory. It is
+// the architecture's serial port unless --qemu-console picks a virtio
+// console (hvc0), or the graphical console with the serial port kept as a
+// second console for the log.
+
+var consoles = []string{"serial", "virtio", "graphical"}
+
+func validateConsole(console string) error {
+	if console != "" && !stringIn(consoles, console) {
+		return fmt.Errorf("Invalid console %q, must be one of %v", console, consoles)
+	}
+	return nil
+}
+
+// kernelConsoles returns the console= parameters of the kernel command
+// line. The last one is /dev/console.
+func (d *Driver) kernelConsoles() string {
+	switch d.Console {
+	case "virtio":
+		return "console=hvc0"
+	case "graphical":
+		return "console=" + d.arch().console + " console=tty0"
+	}
+	return "console=" + d.arch().console
+}
+
+// kernelCmdline returns the command line of the boot2docker kernel.
+func (d *Driver) kernelCmdline() string {
+	return "loglevel=4 user=docker host=" + d.guestHostname() + " " + d.kernelConsoles() + " noembed nomodeset norestore base"
+}
+
+// consoleArgs wires the console to kern.log and sets up the display.
+func (d *Driver) consoleArgs() ([]string, error) {
+	kernLog, err := newQemuOpts("file").
+		Set("id", "serial0").
+		Set("path", qemuPath(d.ResolveStorePath("kern.log"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-chardev", kernLog}
+	if d.Console != "graphical" {
+		args = append(args, "-nographic")
+	}
+	if d.Console == "virtio" {
+		return append(args,
+			"-device", "virtio-serial,id=console0",
+			"-device", "virtconsole,bus=console0.0,chardev=serial0"), nil
+	}
+	return append(args, "-serial", "chardev:serial0"), nil
+}
+
+// consolePoll is how often FollowConsole looks for new console output.
+const consolePoll = 200 * time.Millisecond
+
+// FollowConsole calls fn with every line of kern.log, first the ones written
+// so far and then the new ones as the guest writes them, until stop is
+// closed. A log QEMU truncated to boot again is followed from its start,
+// and the log of a machine not started yet is waited for.
+func (d *Driver) FollowConsole(stop <-chan struct{}, fn func(line string)) error {
+	path := d.ResolveStorePath("kern.log")
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var offset int64
+	var partial []byte
+	buf := make([]byte, 32*1024)
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if f != nil {
+			if info, err := f.Stat(); err == nil && info.Size() < offset {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				offset, partial = 0, nil
+			}
+			for {
+				n, err := f.Read(buf)
+				offset += int64(n)
+				partial = append(partial, buf[:n]...)
+				for {
+					i := bytes.IndexByte(partial, '\n')
+					if i < 0 {
+						break
+					}
+					fn(strings.TrimRight(string(partial[:i]), "\r"))
+					partial = partial[i+1:]
+				}
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(consolePoll):
+		}
+	}
+}
+
+// FollowMachineConsole follows the console of the machine stored in
+// machineDir, see FollowConsole. It is run by the plugin binary's console
+// mode.
+func FollowMachineConsole(machineDir string, stop <-chan struct{}, fn func(line string)) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	return d.FollowConsole(stop, fn)
+}
@@ -0,0 +1,156 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// DiskConversion describes the disk a stopped machine is converted to.
+type DiskConversion struct {
+	// Format is raw or qcow2.
+	Format string
+	// Compress compresses the qcow2 clusters written by the conversion.
+	Compress bool
+	// Encrypt makes the qcow2 disk LUKS encrypted, or decrypts it when
+	// false.
+	Encrypt bool
+}
+
+// ConvertDisk rewrites the disk of the stopped machine with qemu-img. The
+// new disk is written to the tmp directory, or next to a disk kept outside
+// the machine directory, and only replaces it, together with the config,
+// once complete; a failure at any point leaves the
+// machine with its old disk.
+func (d *Driver) ConvertDisk(c DiskConversion) error {
+	if c.Format != "raw" && c.Format != "qcow2" {
+		return fmt.Errorf("Unknown disk format %q, must be raw or qcow2", c.Format)
+	}
+	if c.Format == "raw" && (c.Compress || c.Encrypt) {
+		return fmt.Errorf("Only qcow2 disks can be compressed or encrypted")
+	}
+	if isBlockDevice(d.Disk) {
+		return fmt.Errorf("%s is a block device and cannot be converted", d.Disk)
+	}
+	//The data disk shares the key of the disk
+	if d.DataDiskSize != 0 && c.Encrypt != d.DiskEncrypt {
+		return fmt.Errorf("%s has a data disk encrypted like its disk, the encryption cannot be changed", d.MachineName)
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if s != state.Stopped {
+		return fmt.Errorf("%s has to be stopped to convert its disk", d.MachineName)
+	}
+	return d.transition("converting", "stopped", func() error {
+		return d.rewriteDisk(c)
+	})
+}
+
+// ConvertMachineDisk converts the disk of the stopped machine stored in
+// machineDir. It is run by the plugin binary's convert-disk mode.
+func ConvertMachineDisk(machineDir string, c DiskConversion) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	return d.ConvertDisk(c)
+}
+
+func (d *Driver) rewriteDisk(c DiskConversion) error {
+	qemuImg, err := getQemuImgCommand(d)
+	if err != nil {
+		return err
+	}
+	old := *d
+	target := strings.TrimSuffix(d.Disk, "."+d.DiskFormat) + "." + c.Format
+	tmp, err := d.scratchFor(target, ".converting")
+	if err != nil {
+		return err
+	}
+
+	newKey := c.Encrypt && !d.DiskEncrypt
+	if newKey {
+		if d.SecretStore == "" {
+			if err := d.chooseSecretStore(); err != nil {
+				return err
+			}
+		}
+		d.DiskEncrypt = true
+		if err := d.createDiskKey(); err != nil {
+			*d = old
+			return err
+		}
+	}
+	rollback := func(err error) error {
+		os.Remove(tmp)
+		if newKey {
+			if s, serr := d.secrets(); serr == nil {
+				s.remove(d.secretName("disk"))
+			}
+		}
+		*d = old
+		return err
+	}
+
+	//The source is opened with the key when it is encrypted
+	d.DiskEncrypt = old.DiskEncrypt || c.Encrypt
+	secret, cleanup, err := d.diskSecretArgs()
+	if err != nil {
+		return rollback(err)
+	}
+	defer cleanup()
+	args := append([]string{"convert", "-p"}, secret...)
+	if old.DiskEncrypt {
+		source, err := d.diskImageArgs()
+		if err != nil {
+			return rollback(err)
+		}
+		args = append(args, source...)
+	} else {
+		args = append(args, "-f", d.DiskFormat, d.Disk)
+	}
+	args = append(args, "-O", c.Format)
+	if c.Compress {
+		args = append(args, "-c")
+	}
+	if c.Encrypt {
+		args = append(args, d.encryptCreateArgs()...)
+	}
+	args = append(args, tmp)
+
+	log.Infof("Converting the disk of %s to %s...", d.MachineName, c.Format)
+	if out, err := exec.Command(qemuImg, args...).CombinedOutput(); err != nil {
+		return rollback(fmt.Errorf("qemu-img convert failed: %v: %s", err, out))
+	}
+	if err := restrictToOwner(tmp); err != nil {
+		return rollback(err)
+	}
+
+	//Keep the old disk until the config points at the new one
+	backup := old.Disk + ".old"
+	if err := os.Rename(old.Disk, backup); err != nil {
+		return rollback(err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Rename(backup, old.Disk)
+		return rollback(err)
+	}
+	d.Disk, d.DiskFormat, d.DiskEncrypt = target, c.Format, c.Encrypt
+	if err := d.saveConfig(); err != nil {
+		os.Remove(target)
+		os.Rename(backup, old.Disk)
+		return rollback(err)
+	}
+	if old.DiskEncrypt && !c.Encrypt {
+		if s, err := d.secrets(); err == nil {
+			s.remove(d.secretName("disk"))
+		}
+	}
+	return os.Remove(backup)
+}
@@ -0,0 +1,75 @@
+package qemu
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// copyBlock is the unit in which copyFile looks for holes. Blocks of zeros
+// are skipped instead of written, so the copy of a sparse image stays
+// sparse.
+const copyBlock = 64 * 1024
+
+// copyFile copies src to dst with the mode of src. The copy is a reflink
+// sharing the blocks of src where the filesystem supports it, and a sparse
+// byte copy otherwise.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = reflink(in, out)
+	if err == nil {
+		log.Debugf("Cloned %s to %s", src, dst)
+		return out.Close()
+	}
+	log.Debugf("Could not clone %s, copying it: %v", src, err)
+
+	if err := sparseCopy(in, out, info.Size()); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+// sparseCopy copies size bytes of in to out, seeking over blocks of zeros.
+func sparseCopy(in io.Reader, out *os.File, size int64) error {
+	buf := make([]byte, copyBlock)
+	zero := make([]byte, copyBlock)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, serr := out.Seek(int64(n), io.SeekCurrent); serr != nil {
+					return serr
+				}
+			} else if _, werr := out.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	//A trailing hole is only allocated by setting the size
+	return out.Truncate(size)
+}
@@ -0,0 +1,81 @@
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+var guestOSes = []string{"linux", "windows"}
+
+func validateGuestOS(d *Driver) error {
+	if d.GuestOS != "" && !stringIn(guestOSes, d.GuestOS) {
+		return fmt.Errorf("Invalid guest OS %q, must be one of %v", d.GuestOS, guestOSes)
+	}
+	return nil
+}
+
+func (d *Driver) isWindowsGuest() bool {
+	return d.GuestOS == "windows"
+}
+
+// cpuArgs returns the -cpu option turning on the paravirtual features of
+// the guest OS under KVM: the KVM clock and interrupt features for Linux,
+// the Hyper-V enlightenments for Windows. The model stays QEMU's default so
+// the guest sees the same CPU as before.
+func (d *Driver) cpuArgs() []string {
+	if d.requestedAccel() != "kvm" || d.arch().cpuModel == "" {
+		return nil
+	}
+	if d.isWindowsGuest() {
+		return []string{"-cpu", d.arch().cpuModel + ",hv_relaxed,hv_spinlocks=0x1fff,hv_vapic,hv_time"}
+	}
+	return []string{"-cpu", d.arch().cpuModel + ",kvmclock=on,kvm-pv-eoi=on,kvm-pv-unhalt=on"}
+}
+
+// diskInterface is the bus of the root disk. Windows has no virtio drivers
+// out of the box.
+func (d *Driver) diskInterface() string {
+	if d.isWindowsGuest() {
+		return "ide"
+	}
+	return "virtio"
+}
+
+// hasDevice reports whether the QEMU binary was built with the device. When
+// QEMU cannot be asked the device is assumed to be there.
+func hasDevice(d *Driver, device string) bool {
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return true
+	}
+	out, err := exec.Command(qemuCmd, "-device", "help").Output()
+	if err != nil {
+		return true
+	}
+	if !strings.Contains(string(out), `name "`+device+`"`) && !strings.Contains(string(out), `alias "`+device+`"`) {
+		log.Debugf("%s has no %s device", qemuCmd, device)
+		return false
+	}
+	return true
+}
+
+// hasOption reports whether the QEMU binary lists the command line option
+// in its -help. When QEMU cannot be asked the option is assumed to be there.
+func hasOption(d *Driver, option string) bool {
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return true
+	}
+	out, err := exec.Command(qemuCmd, "-help").Output()
+	if err != nil {
+		return true
+	}
+	if !strings.Contains("\n"+string(out), "\n"+option+" ") {
+		log.Debugf("%s has no %s option", qemuCmd, option)
+		return false
+	}
+	return true
+}
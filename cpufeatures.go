@@ -0,0 +1,156 @@
+package qemu
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// watchedCPUFeatures are the instruction set extensions native code in
+// containers commonly depends on, by their /proc/cpuinfo names.
+var watchedCPUFeatures = []string{
+	"ssse3", "sse4_1", "sse4_2", "popcnt", "aes", "pclmulqdq",
+	"avx", "avx2", "fma", "bmi1", "bmi2", "sha_ni", "avx512f",
+}
+
+// CPUFeature tells whether an instruction set extension is available on
+// the host and inside the guest. HostKnown is false when the host could not
+// be asked about it.
+type CPUFeature struct {
+	Name      string
+	Host      bool
+	HostKnown bool
+	Guest     bool
+}
+
+// Missing reports whether the host has the feature but the guest CPU model
+// hides it.
+func (f CPUFeature) Missing() bool {
+	return f.Host && !f.Guest
+}
+
+// CPUFeatures compares the host's CPU features with those the running
+// guest sees under its CPU model.
+func (d *Driver) CPUFeatures() ([]CPUFeature, error) {
+	if d.arch().cpuModel == "" {
+		return nil, fmt.Errorf("CPU features are only reported for x86 guests")
+	}
+	if d.isWindowsGuest() {
+		return nil, fmt.Errorf("CPU features are only reported for Linux guests")
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return nil, err
+	}
+	if s != state.Running {
+		return nil, fmt.Errorf("%s has to be running to report its CPU features", d.MachineName)
+	}
+	out, err := drivers.RunSSHCommandFromDriver(d, "grep -m1 '^flags' /proc/cpuinfo")
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the guest CPU features: %v", err)
+	}
+	guest := cpuFlags(out)
+	host := hostCPUFlags()
+
+	var features []CPUFeature
+	for _, name := range watchedCPUFeatures {
+		has, known := host[name]
+		features = append(features, CPUFeature{Name: name, Host: has, HostKnown: known, Guest: guest[name]})
+	}
+	return features, nil
+}
+
+// warnMissingCPUFeatures logs the host CPU features the new guest does not
+// get, which is not worth failing the create for.
+func (d *Driver) warnMissingCPUFeatures() {
+	if d.arch().cpuModel == "" || d.isWindowsGuest() {
+		return
+	}
+	features, err := d.CPUFeatures()
+	if err != nil {
+		log.Debugf("Could not compare the CPU features of %s: %v", d.MachineName, err)
+		return
+	}
+	var missing []string
+	for _, f := range features {
+		if f.Missing() {
+			missing = append(missing, f.Name)
+		}
+	}
+	if len(missing) > 0 {
+		log.Warnf("The %s CPU model of %s hides %s of the host CPU, native code built for the host may fail in the guest", d.guestCPUModel(), d.MachineName, strings.Join(missing, ", "))
+	}
+}
+
+// cpuFlags parses the flags line of /proc/cpuinfo.
+func cpuFlags(line string) map[string]bool {
+	flags := map[string]bool{}
+	if i := strings.Index(line, ":"); i >= 0 {
+		line = line[i+1:]
+	}
+	for _, f := range strings.Fields(line) {
+		flags[f] = true
+	}
+	return flags
+}
+
+// cpuFeatureReport renders the features as a table, followed by a note on
+// the ones the guest is missing.
+func (d *Driver) cpuFeatureReport() (string, error) {
+	features, err := d.CPUFeatures()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CPU model: %s (%s)\n\n", d.guestCPUModel(), d.requestedAccel())
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FEATURE\tHOST\tGUEST\t")
+	var missing []string
+	for _, f := range features {
+		mark := ""
+		if f.Missing() {
+			mark = "missing"
+			missing = append(missing, f.Name)
+		}
+		host := "?"
+		if f.HostKnown {
+			host = yesNo(f.Host)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Name, host, yesNo(f.Guest), mark)
+	}
+	w.Flush()
+	if len(missing) > 0 {
+		fmt.Fprintf(&b, "\nThe guest CPU model hides %s. Binaries built for the host CPU, or using these\n", strings.Join(missing, ", "))
+		fmt.Fprintf(&b, "instructions without checking, fail with illegal instruction errors inside the guest.\n")
+	}
+	return b.String(), nil
+}
+
+// guestCPUModel is the -cpu model the guest runs with.
+func (d *Driver) guestCPUModel() string {
+	if args := d.cpuArgs(); len(args) == 2 {
+		return strings.SplitN(args[1], ",", 2)[0]
+	}
+	return d.arch().cpuModel
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// CPUFeatureReport returns the CPU feature report of the machine stored in
+// machineDir. It is run by the plugin binary's cpu-features mode.
+func CPUFeatureReport(machineDir string) (string, error) {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return "", err
+	}
+	return d.cpuFeatureReport()
+}
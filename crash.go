@@ -0,0 +1,93 @@
+package qemu
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// crashSignatures are the kernel messages telling why a guest died. The
+// boot command line uses loglevel=4 so OOM kills reach the serial log.
+var crashSignatures = []string{
+	"Kernel panic",
+	"Oops:",
+	"BUG: unable to handle",
+	"general protection fault",
+	"Out of memory: Kill",
+	"oom-kill:",
+}
+
+// Diagnostics returns the kernel panic, oops and OOM lines of the last
+// boot, as written to the serial log.
+func (d *Driver) Diagnostics() []string {
+	f, err := os.Open(d.ResolveStorePath("kern.log"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, sig := range crashSignatures {
+			if strings.Contains(line, sig) {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// checkCrashed reports Error for a guest that is not up when the serial log
+// shows it panicked or ran out of memory, or QEMU says it panicked.
+func (d *Driver) checkCrashed() (state.State, bool) {
+	panicked := d.guestPanicked()
+	lines := d.Diagnostics()
+	if !panicked && len(lines) == 0 {
+		return state.None, false
+	}
+	log.Warnf("%s crashed, see %s:", d.MachineName, d.ResolveStorePath("kern.log"))
+	for _, line := range lines {
+		log.Warnf("  %s", line)
+	}
+	d.recordState("crashed")
+	return state.Error, true
+}
+
+func (d *Driver) guestPanicked() bool {
+	if d.QMPPort == 0 {
+		return false
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return false
+	}
+	defer qmp.Close()
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	return qmp.execute("query-status", nil, &status) == nil && status.Status == "guest-panicked"
+}
+
+// panicArgs adds the pvpanic device, through which the guest kernel reports
+// a panic to QEMU as a GUEST_PANICKED event. QEMU builds without it still
+// boot, relying on the serial log alone.
+func (d *Driver) panicArgs() []string {
+	if d.arch().panicDevice == "" || !hasDevice(d, d.arch().panicDevice) {
+		return nil
+	}
+	args := []string{"-device", d.arch().panicDevice}
+	//QEMU exits on a panic by default, pausing keeps the guest-panicked
+	//status for guestPanicked. QEMU before 6.0 has no -action and exits,
+	//-no-shutdown would keep it around after every power-off too.
+	if hasOption(d, "-action") {
+		args = append(args, "-action", "panic=pause")
+	}
+	return args
+}
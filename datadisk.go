@@ -0,0 +1,107 @@
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// --qemu-data-disk-size adds a second disk holding /var/lib/docker, so
+// images and volumes survive replacing the root disk or the ISO. The
+// guest formats it on first boot and mounts it by label before the engine
+// starts on every boot. The disk carries a serial number, so the guest
+// finds it under /dev/disk/by-id whatever name the kernel gave it.
+
+const (
+	dataDiskLabel  = "dm-data"
+	dataDiskSerial = "dm-data"
+)
+
+var dataDiskFilesystems = []string{"ext4", "xfs"}
+
+func validateDataDisk(d *Driver) error {
+	if d.DataDiskSize == 0 {
+		return nil
+	}
+	if d.DataDiskSize < 0 {
+		return fmt.Errorf("Invalid data disk size %dMB", d.DataDiskSize)
+	}
+	if !stringIn(dataDiskFilesystems, d.DataDiskFS) {
+		return fmt.Errorf("Unknown data disk filesystem %q, must be ext4 or xfs", d.DataDiskFS)
+	}
+	if d.isWindowsGuest() {
+		return fmt.Errorf("--qemu-data-disk-size is provisioned over SSH, which Windows guests do not get")
+	}
+	return nil
+}
+
+func (d *Driver) dataDiskPath() string {
+	return d.ResolveStorePath("data.qcow2")
+}
+
+// createDataDisk creates the empty data disk, encrypted like the root disk.
+func (d *Driver) createDataDisk() error {
+	if d.DataDiskSize == 0 {
+		return nil
+	}
+	qemuImg, err := getQemuImgCommand(d)
+	if err != nil {
+		return err
+	}
+	secret, cleanup, err := d.diskSecretArgs()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args := append([]string{"create"}, secret...)
+	args = append(args, "-f", "qcow2")
+	args = append(args, d.encryptCreateArgs()...)
+	args = append(args, d.dataDiskPath(), strconv.Itoa(d.DataDiskSize)+"M")
+	if out, err := exec.Command(qemuImg, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-img create failed: %v: %s", err, out)
+	}
+	return restrictToOwner(d.dataDiskPath())
+}
+
+// dataDiskArgs attaches the data disk as a virtio disk with the serial
+// number the guest looks it up by.
+func (d *Driver) dataDiskArgs() ([]string, error) {
+	if d.DataDiskSize == 0 {
+		return nil, nil
+	}
+	drive := qemucmd.Drive{
+		File:      qemuPath(d.dataDiskPath()),
+		Interface: "none",
+		Format:    "qcow2",
+		WError:    d.DiskWError,
+		RError:    d.DiskRError,
+		Extra:     []qemucmd.Option{{Key: "id", Value: "datadisk"}},
+	}
+	if d.DiskEncrypt {
+		drive.Extra = append(drive.Extra, qemucmd.Option{Key: "encrypt.key-secret", Value: diskSecretID})
+	}
+	var builder qemucmd.Command
+	builder.Option("-drive", drive).
+		Option("-device", qemucmd.Device{Driver: "virtio-blk-pci", Props: []qemucmd.Option{
+			{Key: "drive", Value: "datadisk"},
+			{Key: "serial", Value: dataDiskSerial},
+		}})
+	return builder.Args()
+}
+
+// dataDiskCommands returns the guest commands formatting the data disk
+// once and mounting it at /var/lib/docker.
+func (d *Driver) dataDiskCommands(p guestProvisioner) []string {
+	if d.DataDiskSize == 0 {
+		return nil
+	}
+	d.progress("Mounting the data disk at /var/lib/docker...")
+	return []string{
+		fmt.Sprintf("blkid -L %[1]s >/dev/null || { dev=$(ls /dev/disk/by-id/*%[2]s | head -n 1) && [ -n \"$dev\" ] && mkfs.%[3]s -L %[1]s \"$dev\"; }",
+			dataDiskLabel, dataDiskSerial, d.DataDiskFS),
+		"mkdir -p /var/lib/docker",
+		fmt.Sprintf("if ! mountpoint -q /var/lib/docker; then mount LABEL=%s /var/lib/docker && %s; fi", dataDiskLabel, p.restartDocker()),
+	}
+}
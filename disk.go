@@ -0,0 +1,62 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// diskLocation returns where the root disk goes and its format. By default
+// it is disk.qcow2 in the machine store, --qemu-disk-path moves it into
+// another directory or onto a raw block device.
+func (d *Driver) diskLocation() (string, string, error) {
+	if d.DiskPath == "" {
+		return d.ResolveStorePath("disk.qcow2"), "qcow2", nil
+	}
+	fi, err := os.Stat(d.DiskPath)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case fi.Mode()&os.ModeDevice != 0:
+		return d.DiskPath, "raw", nil
+	case fi.IsDir():
+		return filepath.Join(d.DiskPath, d.MachineName+".qcow2"), "qcow2", nil
+	}
+	return "", "", fmt.Errorf("Disk path %s must be a directory or a block device", d.DiskPath)
+}
+
+func isBlockDevice(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeDevice != 0
+}
+
+func validateDiskPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("Disk path %s must be absolute", path)
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
+// removeExternalDisk deletes a disk kept outside the machine store, which
+// docker-machine would otherwise leave behind. Block devices are never
+// touched.
+func (d *Driver) removeExternalDisk() error {
+	if d.DiskPath == "" || d.Disk == "" {
+		return nil
+	}
+	if d.KeepDisk || isBlockDevice(d.Disk) {
+		log.Infof("Keeping disk %s", d.Disk)
+		return nil
+	}
+	if err := os.Remove(d.Disk); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
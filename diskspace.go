@@ -0,0 +1,101 @@
+package qemu
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// qemu-img and a growing qcow2 disk fail with errors that do not tell the
+// host filesystem is full. Create checks the space up front and explains a
+// failed step by the filesystem that ran out, and every boot checks there
+// is room left for the disks to grow, as QEMU pauses the guest on a full
+// disk.
+
+// noSpaceMessages are how the hosts word ENOSPC.
+var noSpaceMessages = []string{"No space left on device", "There is not enough space on the disk"}
+
+// storeNeeds maps the directories holding the machine to the MB it needs in
+// them: the ISO and the files extracted from it in the machine directory
+// and the disk in its directory, unless it is a block device.
+func (d *Driver) storeNeeds() (map[string]int, error) {
+	needs := map[string]int{existingParent(d.ResolveStorePath(".")): isoReserve}
+	disk, format, err := d.diskLocation()
+	if err != nil {
+		return nil, err
+	}
+	if format != "raw" {
+		needs[existingParent(filepath.Dir(disk))] += d.DiskSize
+	}
+	return needs, nil
+}
+
+// spaceError names the filesystem holding dir, its free space and the
+// space needed in MB.
+func spaceError(dir string, free uint64, need int) error {
+	return fmt.Errorf("The filesystem at %s holding %s has %dMB free, the machine needs %dMB", mountPoint(dir), dir, free>>20, need)
+}
+
+// explainNoSpace returns err of a failed create step together with the
+// filesystem that ran full, when one of the machine's did.
+func (d *Driver) explainNoSpace(err error) error {
+	needs, nerr := d.storeNeeds()
+	if nerr != nil {
+		return err
+	}
+	full := false
+	for _, msg := range noSpaceMessages {
+		full = full || strings.Contains(err.Error(), msg)
+	}
+	fullest, least := "", uint64(0)
+	for dir := range needs {
+		free, ferr := freeDiskSpace(dir)
+		if ferr == nil && (fullest == "" || free < least) {
+			fullest, least = dir, free
+		}
+	}
+	if fullest == "" || !full && least >= diskResumeFree {
+		return err
+	}
+	return fmt.Errorf("%v: %v", err, spaceError(fullest, least, needs[fullest]))
+}
+
+// checkDiskGrowth fails the boot when the filesystem of a disk is all but
+// full, as the guest would be paused right away, and warns when the disks
+// can grow beyond the free space.
+func (d *Driver) checkDiskGrowth() error {
+	growth := map[string]int64{}
+	for _, disk := range []struct {
+		path string
+		size int
+	}{{d.Disk, d.DiskSize}, {d.dataDiskPath(), d.DataDiskSize}} {
+		if disk.path == "" || disk.size == 0 || isBlockDevice(disk.path) {
+			continue
+		}
+		used, err := allocatedSize(disk.path)
+		if err != nil {
+			continue
+		}
+		left := int64(disk.size)<<20 - used
+		if left < 0 {
+			left = 0
+		}
+		growth[filepath.Dir(disk.path)] += left
+	}
+	for dir, left := range growth {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			continue
+		}
+		if free < diskResumeFree {
+			return spaceError(dir, free, diskResumeFree>>20)
+		}
+		if uint64(left) > free {
+			log.Warnf("The disks of %s can grow by %dMB but the filesystem at %s has %dMB free, the guest is paused when it fills up",
+				d.MachineName, left>>20, mountPoint(dir), free>>20)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// With --qemu-dns-name the machine's host-only address is registered as
+// <machine>.qemu.local in the host's hosts file while it runs. Each entry is
+// tagged with the machine name so it can be updated and removed again.
+
+const dnsDomain = "qemu.local"
+
+func validateDNSName(d *Driver) error {
+	if d.DNSName && !d.HostOnly {
+		return fmt.Errorf("--qemu-dns-name needs --qemu-host-only")
+	}
+	return nil
+}
+
+func (d *Driver) dnsName() string {
+	return d.MachineName + "." + dnsDomain
+}
+
+func (d *Driver) hostsTag() string {
+	return "# docker-machine-qemu " + d.MachineName
+}
+
+// registerName points the machine's name at its host-only address.
+func (d *Driver) registerName() error {
+	if !d.DNSName || d.HostOnlyIP == "" {
+		return nil
+	}
+	entry := fmt.Sprintf("%s\t%s %s", d.HostOnlyIP, d.dnsName(), d.hostsTag())
+	return d.updateHosts(entry)
+}
+
+// unregisterName drops the machine's entry.
+func (d *Driver) unregisterName() error {
+	if !d.DNSName {
+		return nil
+	}
+	return d.updateHosts("")
+}
+
+// releaseName unregisters the machine once it stopped, as the next start
+// may get another address. Failures are only logged.
+func (d *Driver) releaseName() {
+	if err := d.unregisterName(); err != nil {
+		log.Warnf("Could not unregister %s: %v", d.dnsName(), err)
+	}
+}
+
+// updateHosts replaces the machine's hosts file entry with entry, removing
+// it when entry is empty.
+func (d *Driver) updateHosts(entry string) error {
+	path := hostsFilePath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if !strings.HasSuffix(line, d.hostsTag()) {
+			lines = append(lines, line)
+		}
+	}
+	if entry != "" {
+		lines = append(lines, entry)
+	}
+	updated := strings.Join(lines, "\n") + "\n"
+	if updated == string(data) {
+		return nil
+	}
+	log.Debugf("Updating %s for %s", path, d.dnsName())
+	return writeHostsFile(path, []byte(updated))
+}
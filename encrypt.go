@@ -0,0 +1,96 @@
+package qemu
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// With --qemu-disk-encrypt the qcow2 disk is LUKS encrypted. The key is
+// random, kept in the machine's secret store, and handed to qemu-img and
+// QEMU as a secret object so it never shows on a command line.
+
+const diskSecretID = "disksec"
+
+func validateDiskEncrypt(d *Driver) error {
+	if !d.DiskEncrypt {
+		return nil
+	}
+	if _, format, err := d.diskLocation(); err == nil && format == "raw" {
+		return fmt.Errorf("--qemu-disk-encrypt needs a qcow2 disk, not a block device")
+	}
+	return nil
+}
+
+// createDiskKey generates the disk encryption key.
+func (d *Driver) createDiskKey() error {
+	if !d.DiskEncrypt {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return d.saveSecret("disk", []byte(base64.StdEncoding.EncodeToString(key)))
+}
+
+// diskSecretArgs returns the secret object holding the disk key, for
+// qemu-img and QEMU alike. cleanup removes the key file once the command
+// read it.
+func (d *Driver) diskSecretArgs() ([]string, func(), error) {
+	if !d.DiskEncrypt {
+		return nil, func() {}, nil
+	}
+	path, cleanup, err := d.secretFile("disk")
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := newQemuOpts("secret").
+		Set("id", diskSecretID).
+		Set("file", qemuPath(path)).
+		Set("format", "base64").
+		Build()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return []string{"--object", secret}, cleanup, nil
+}
+
+// encryptCreateArgs returns the qemu-img create or convert options making
+// the new qcow2 image encrypted.
+func (d *Driver) encryptCreateArgs() []string {
+	if !d.DiskEncrypt {
+		return nil
+	}
+	return []string{"-o", "encrypt.format=luks,encrypt.key-secret=" + diskSecretID}
+}
+
+// diskImageArgs names the disk for qemu-img commands that open it, which an
+// encrypted image only allows together with its key.
+func (d *Driver) diskImageArgs() ([]string, error) {
+	if !d.DiskEncrypt {
+		return []string{d.Disk}, nil
+	}
+	opts, err := newQemuOpts("").
+		Set("driver", "qcow2").
+		Set("file.filename", d.Disk).
+		Set("encrypt.key-secret", diskSecretID).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--image-opts", opts}, nil
+}
+
+// resizeArgs returns the qemu-img arguments growing the qcow2 disk to
+// size, "+NM" or "NM", given the disk's secret arguments.
+func (d *Driver) resizeArgs(secret []string, size string) ([]string, error) {
+	image, err := d.diskImageArgs()
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"resize"}, secret...)
+	args = append(args, image...)
+	return append(args, size), nil
+}
@@ -0,0 +1,36 @@
+package qemu
+
+import (
+	"fmt"
+)
+
+// With --qemu-engine-ssh the docker CLI can reach the engine's unix socket
+// over the SSH forward of the machine instead of the TLS port. The SSH user
+// joins the docker group so it may use the socket. The engine URL stays the
+// TLS port, which docker-machine env and config expect, and the SSH
+// DOCKER_HOST is printed at create.
+
+func validateEngineSSH(d *Driver) error {
+	if d.EngineSSH && d.isWindowsGuest() {
+		return fmt.Errorf("--qemu-engine-ssh needs a Linux guest, Windows engines listen on a named pipe")
+	}
+	return nil
+}
+
+// engineSSHURL is the DOCKER_HOST reaching the engine through SSH.
+func (d *Driver) engineSSHURL() string {
+	return fmt.Sprintf("ssh://%s@%s:%d", d.GetSSHUsername(), d.IPAddress, d.SSHPort)
+}
+
+// engineSSHCommands lets the SSH user use the engine's socket.
+func (d *Driver) engineSSHCommands() []string {
+	if !d.EngineSSH {
+		return nil
+	}
+	d.progress("Giving %s access to the docker socket, use DOCKER_HOST=%s to reach it...", d.GetSSHUsername(), d.engineSSHURL())
+	user := d.GetSSHUsername()
+	return []string{
+		"getent group docker >/dev/null || groupadd docker 2>/dev/null || addgroup docker",
+		fmt.Sprintf("id -nG %[1]s | grep -qw docker || usermod -aG docker %[1]s 2>/dev/null || addgroup %[1]s docker", user),
+	}
+}
@@ -0,0 +1,168 @@
+package qemu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// featureUsage compares what the driver asked QEMU for with what QEMU
+// reports it is actually using.
+type featureUsage struct {
+	Feature   string `json:"feature"`
+	Requested string `json:"requested"`
+	Effective string `json:"effective"`
+}
+
+func (f featureUsage) downgraded() bool {
+	return f.Requested != "" && f.Effective != "" && f.Requested != f.Effective
+}
+
+type featureReport struct {
+	Features []featureUsage `json:"features"`
+	Devices  []string       `json:"devices"`
+}
+
+// reportFeatures queries the running QEMU for the acceleration, drives,
+// network backend and devices in use, logs any silent downgrade and saves
+// the report as features.json in the machine directory.
+func (d *Driver) reportFeatures() error {
+	if d.QMPPort == 0 {
+		return nil
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	var report featureReport
+
+	accel := featureUsage{Feature: "accel", Requested: d.requestedAccel()}
+	if accel.Effective, err = runningAccel(qmp, accel.Requested); err != nil {
+		return err
+	}
+	report.Features = append(report.Features, accel)
+	d.effectiveAccel = accel.Effective
+
+	var blocks []struct {
+		Device   string `json:"device"`
+		Inserted *struct {
+			Drv   string `json:"drv"`
+			Cache struct {
+				Writeback bool `json:"writeback"`
+				Direct    bool `json:"direct"`
+				NoFlush   bool `json:"no-flush"`
+			} `json:"cache"`
+		} `json:"inserted"`
+	}
+	if err := qmp.execute("query-block", nil, &blocks); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if b.Inserted == nil {
+			continue
+		}
+		report.Features = append(report.Features,
+			featureUsage{Feature: b.Device + " format", Effective: b.Inserted.Drv},
+			featureUsage{Feature: b.Device + " cache", Requested: "writeback", Effective: cacheMode(b.Inserted.Cache.Writeback, b.Inserted.Cache.Direct, b.Inserted.Cache.NoFlush)})
+	}
+
+	network, err := qmp.hmp("info network")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(network, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, `\ mynet0:`) {
+			continue
+		}
+		netdev := featureUsage{Feature: "network", Requested: "user"}
+		for _, opt := range strings.Split(line, ",") {
+			if strings.HasPrefix(opt, "type=") {
+				netdev.Effective = strings.TrimPrefix(opt, "type=")
+			}
+		}
+		report.Features = append(report.Features, netdev)
+	}
+
+	var buses []struct {
+		Devices []struct {
+			QdevID    string `json:"qdev_id"`
+			ClassInfo struct {
+				Desc string `json:"desc"`
+			} `json:"class_info"`
+		} `json:"devices"`
+	}
+	if err := qmp.execute("query-pci", nil, &buses); err != nil {
+		return err
+	}
+	for _, bus := range buses {
+		for _, dev := range bus.Devices {
+			name := dev.ClassInfo.Desc
+			if dev.QdevID != "" {
+				name = dev.QdevID + " (" + name + ")"
+			}
+			report.Devices = append(report.Devices, name)
+		}
+	}
+
+	for _, f := range report.Features {
+		if f.downgraded() {
+			log.Warnf("QEMU is using %s %s instead of the requested %s", f.Feature, f.Effective, f.Requested)
+		} else {
+			log.Debugf("QEMU %s: %s", f.Feature, f.Effective)
+		}
+	}
+	if accel.Effective == "tcg" && accel.Requested != "tcg" {
+		log.Warnf("Hardware acceleration is not active, the machine will be very slow")
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ResolveStorePath("features.json"), data, 0644)
+}
+
+// runningAccel names the accelerator the guest runs under, or returns ""
+// when QEMU does not tell. query-kvm only knows KVM, so HAXM, WHPX and HVF
+// are told from TCG by "info jit", which only TCG answers.
+func runningAccel(qmp *qmpClient, requested string) (string, error) {
+	var kvm struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := qmp.execute("query-kvm", nil, &kvm); err != nil {
+		return "", err
+	}
+	if kvm.Enabled {
+		return "kvm", nil
+	}
+	jit, err := qmp.hmp("info jit")
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.Contains(jit, "only available with accel=tcg"):
+		return requested, nil
+	case strings.Contains(jit, "TB count"):
+		return "tcg", nil
+	}
+	return "", nil
+}
+
+func cacheMode(writeback, direct, noFlush bool) string {
+	switch {
+	case noFlush:
+		return "unsafe"
+	case writeback && direct:
+		return "none"
+	case writeback:
+		return "writeback"
+	case direct:
+		return "directsync"
+	}
+	return "writethrough"
+}
@@ -0,0 +1,127 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ovmfBuild is a pair of OVMF firmware code and variable store template.
+type ovmfBuild struct {
+	code string
+	vars string
+}
+
+// ovmfBuilds lists where distributions, the QEMU Windows installer and
+// Homebrew put OVMF, per firmware. The secure boot variable templates have
+// the Microsoft and UEFI CA keys enrolled, so signed shims and kernels boot.
+var ovmfBuilds = map[string][]ovmfBuild{
+	"uefi": {
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		{"/usr/share/qemu/edk2-x86_64-code.fd", "/usr/share/qemu/edk2-i386-vars.fd"},
+		{"share/edk2-x86_64-code.fd", "share/edk2-i386-vars.fd"},
+		{"/opt/homebrew/share/qemu/edk2-x86_64-code.fd", "/opt/homebrew/share/qemu/edk2-i386-vars.fd"},
+		{"/usr/local/share/qemu/edk2-x86_64-code.fd", "/usr/local/share/qemu/edk2-i386-vars.fd"},
+	},
+	"uefi-secureboot": {
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+		{"/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+	},
+}
+
+var firmwares = []string{"bios", "uefi", "uefi-secureboot"}
+
+func validateFirmware(d *Driver) error {
+	if d.Firmware == "" {
+		return nil
+	}
+	if !stringIn(firmwares, d.Firmware) {
+		return fmt.Errorf("Invalid firmware %q, must be one of %v", d.Firmware, firmwares)
+	}
+	if d.Firmware != "bios" && d.Arch != "x86_64" {
+		return fmt.Errorf("The %s firmware is only supported for x86_64 guests", d.Firmware)
+	}
+	if (d.OVMFCode == "") != (d.OVMFVars == "") {
+		return fmt.Errorf("--qemu-ovmf-code and --qemu-ovmf-vars must be set together")
+	}
+	return nil
+}
+
+func (d *Driver) isUEFI() bool {
+	return d.Firmware == "uefi" || d.Firmware == "uefi-secureboot"
+}
+
+// findOVMF returns the firmware code and variable template to use, either
+// set by flags or found in the known install locations.
+func (d *Driver) findOVMF() (ovmfBuild, error) {
+	if d.OVMFCode != "" {
+		return ovmfBuild{d.OVMFCode, d.OVMFVars}, nil
+	}
+	for _, build := range ovmfBuilds[d.Firmware] {
+		if !filepath.IsAbs(build.code) {
+			if d.QemuLocation == "" {
+				continue
+			}
+			build = ovmfBuild{filepath.Join(d.QemuLocation, build.code), filepath.Join(d.QemuLocation, build.vars)}
+		}
+		if fileExists(build.code) && fileExists(build.vars) {
+			return build, nil
+		}
+	}
+	return ovmfBuild{}, fmt.Errorf("No OVMF build for %s found, install OVMF or set --qemu-ovmf-code and --qemu-ovmf-vars", d.Firmware)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// createFirmwareVars copies the variable store template into the machine
+// directory, where the guest's boot entries and keys are kept.
+func (d *Driver) createFirmwareVars() error {
+	if !d.isUEFI() {
+		return nil
+	}
+	build, err := d.findOVMF()
+	if err != nil {
+		return err
+	}
+	d.OVMFCode = build.code
+	return copyFile(build.vars, d.ResolveStorePath("efivars.fd"))
+}
+
+// firmwareArgs returns the pflash drives of the UEFI firmware. Secure boot
+// also needs SMM so the guest cannot write the variable store directly.
+func (d *Driver) firmwareArgs() ([]string, error) {
+	if !d.isUEFI() {
+		return nil, nil
+	}
+	code, err := newQemuOpts("").
+		Set("if", "pflash").
+		Set("format", "raw").
+		Set("unit", "0").
+		Set("readonly", "on").
+		Set("file", qemuPath(d.OVMFCode)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	vars, err := newQemuOpts("").
+		Set("if", "pflash").
+		Set("format", "raw").
+		Set("unit", "1").
+		Set("file", qemuPath(d.ResolveStorePath("efivars.fd"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-drive", code, "-drive", vars}
+	if d.Firmware == "uefi-secureboot" {
+		args = append(args,
+			"-machine", "q35,smm=on",
+			"-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+	return args, nil
+}
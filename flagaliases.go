@@ -0,0 +1,138 @@
+package qemu
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// Renamed create flags stay accepted under their old names, so scripts
+// written for earlier releases keep working. An old flag is registered
+// without a default, and when it is given its value is read for the
+// current flag with a warning.
+
+// flagAlias is the old name of a create flag.
+type flagAlias struct {
+	old     string
+	current string
+}
+
+var flagAliases = []flagAlias{
+	//Names the first README documented
+	{"qemu-vcpu-count", "qemu-cpu-count"},
+	{"qemu-memory-size", "qemu-memory"},
+}
+
+// aliasFlags returns the flags registered under the old names, typed like
+// the current flags.
+func aliasFlags(flags []mcnflag.Flag) []mcnflag.Flag {
+	byName := map[string]mcnflag.Flag{}
+	for _, f := range flags {
+		byName[f.String()] = f
+	}
+	var aliases []mcnflag.Flag
+	for _, a := range flagAliases {
+		usage := fmt.Sprintf("Deprecated, use --%s", a.current)
+		switch byName[a.current].(type) {
+		case mcnflag.StringFlag:
+			aliases = append(aliases, mcnflag.StringFlag{Name: a.old, Usage: usage})
+		case mcnflag.StringSliceFlag:
+			aliases = append(aliases, mcnflag.StringSliceFlag{Name: a.old, Usage: usage})
+		case mcnflag.IntFlag:
+			aliases = append(aliases, mcnflag.IntFlag{Name: a.old, Usage: usage})
+		case mcnflag.BoolFlag:
+			aliases = append(aliases, mcnflag.BoolFlag{Name: a.old, Usage: usage})
+		}
+	}
+	return aliases
+}
+
+// aliasedOptions reads the current flags from their old names where those
+// were given.
+type aliasedOptions struct {
+	drivers.DriverOptions
+	// given maps the current names to the old ones that were given
+	given map[string]string
+}
+
+func (o aliasedOptions) name(key string) string {
+	if old, ok := o.given[key]; ok {
+		return old
+	}
+	return key
+}
+
+func (o aliasedOptions) String(key string) string {
+	return o.DriverOptions.String(o.name(key))
+}
+
+func (o aliasedOptions) StringSlice(key string) []string {
+	return o.DriverOptions.StringSlice(o.name(key))
+}
+
+func (o aliasedOptions) Int(key string) int {
+	return o.DriverOptions.Int(o.name(key))
+}
+
+func (o aliasedOptions) Bool(key string) bool {
+	return o.DriverOptions.Bool(o.name(key))
+}
+
+// resolveFlagAliases warns about the old flag names given and returns the
+// options reading through them. Giving a flag under both names with
+// different values is an error.
+func (d *Driver) resolveFlagAliases(flags drivers.DriverOptions) (drivers.DriverOptions, error) {
+	byName := map[string]mcnflag.Flag{}
+	for _, f := range d.GetCreateFlags() {
+		byName[f.String()] = f
+	}
+	given := map[string]string{}
+	for _, a := range flagAliases {
+		f, ok := byName[a.current]
+		if !ok {
+			continue
+		}
+		var oldValue, value interface{}
+		switch f.(type) {
+		case mcnflag.StringFlag:
+			oldValue, value = flags.String(a.old), flags.String(a.current)
+		case mcnflag.StringSliceFlag:
+			oldValue, value = flags.StringSlice(a.old), flags.StringSlice(a.current)
+		case mcnflag.IntFlag:
+			oldValue, value = flags.Int(a.old), flags.Int(a.current)
+		case mcnflag.BoolFlag:
+			oldValue, value = flags.Bool(a.old), flags.Bool(a.current)
+		default:
+			continue
+		}
+		if isZeroFlag(oldValue) {
+			continue
+		}
+		if !isZeroFlag(value) && !reflect.DeepEqual(value, f.Default()) && !reflect.DeepEqual(value, oldValue) {
+			return nil, fmt.Errorf("--%s and --%s are the same flag, give only --%s", a.old, a.current, a.current)
+		}
+		log.Warnf("--%s is deprecated, use --%s", a.old, a.current)
+		given[a.current] = a.old
+	}
+	if len(given) == 0 {
+		return flags, nil
+	}
+	return aliasedOptions{flags, given}, nil
+}
+
+func isZeroFlag(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case []string:
+		return len(v) == 0
+	case int:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return true
+}
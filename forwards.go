@@ -0,0 +1,286 @@
+package qemu
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// QEMU's user network drops a --qemu-open-ports forward it cannot set up
+// without failing the start, so after Start every forward is tried: a
+// listener is started on the port in the guest and the host connects to it
+// through the forward. Ports a guest service already listens on are only
+// connected to.
+
+// maxForwardChecks caps the forwards tried per start, so wide ranges do not
+// hold up Start.
+const maxForwardChecks = 32
+
+// forwardCheck is the outcome of trying one forward.
+type forwardCheck struct {
+	port     int
+	protocol string
+	ok       bool
+	result   string
+}
+
+func (c forwardCheck) String() string {
+	return fmt.Sprintf("%d/%s %s", c.port, c.protocol, c.result)
+}
+
+// checkForwards tries the machine's open ports and logs which work. A
+// broken forward is worth a warning, not failing the start.
+func (d *Driver) checkForwards() {
+	if len(d.OpenPorts)+len(d.OpenUDPPorts) == 0 || d.isWindowsGuest() {
+		return
+	}
+	checks, err := d.tryForwards()
+	if err != nil {
+		log.Debugf("Could not check the port forwards of %s: %v", d.MachineName, err)
+		return
+	}
+	var working, broken []string
+	for _, c := range checks {
+		if c.ok {
+			working = append(working, c.String())
+		} else {
+			broken = append(broken, c.String())
+		}
+	}
+	if len(working) > 0 {
+		log.Infof("Working port forwards of %s: %s", d.MachineName, strings.Join(working, ", "))
+	}
+	if len(broken) > 0 {
+		log.Warnf("Broken port forwards of %s: %s", d.MachineName, strings.Join(broken, ", "))
+	}
+	if skipped := len(d.OpenPorts) + len(d.OpenUDPPorts) - len(checks); skipped > 0 {
+		log.Infof("%d more port forwards of %s were not checked", skipped, d.MachineName)
+	}
+}
+
+// tryForwards runs the listeners in the guest and connects to them.
+func (d *Driver) tryForwards() ([]forwardCheck, error) {
+	var checks []forwardCheck
+	for _, port := range d.OpenPorts {
+		checks = append(checks, forwardCheck{port: port, protocol: "tcp"})
+	}
+	for _, port := range d.OpenUDPPorts {
+		checks = append(checks, forwardCheck{port: port, protocol: "udp"})
+	}
+	if len(checks) > maxForwardChecks {
+		checks = checks[:maxForwardChecks]
+	}
+
+	registered := d.registeredForwards()
+	var pending []*forwardCheck
+	for i := range checks {
+		c := &checks[i]
+		if registered != nil && !registered[portClaim(c.port, c.protocol)] {
+			c.result = "not set up by QEMU"
+			continue
+		}
+		pending = append(pending, c)
+	}
+	if len(pending) == 0 {
+		return checks, nil
+	}
+
+	token, err := forwardToken()
+	if err != nil {
+		return nil, err
+	}
+	out, err := runGuestScript(d, listenScript(token, pending))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "nonc" {
+		return nil, fmt.Errorf("The guest has no nc")
+	}
+	busy := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == "busy" {
+			busy[f[2]+"/"+f[1]] = true
+		}
+	}
+	//Give the listeners a moment to bind
+	time.Sleep(300 * time.Millisecond)
+
+	//Probes time out after seconds, so they run all at once
+	var wg sync.WaitGroup
+	for _, c := range pending {
+		wg.Add(1)
+		go func(c *forwardCheck) {
+			defer wg.Done()
+			key := fmt.Sprintf("%d/%s", c.port, c.protocol)
+			switch {
+			case c.protocol == "tcp" && busy[key]:
+				c.ok, c.result = probeTCPService(c.port)
+			case c.protocol == "tcp":
+				c.ok, c.result = probeTCPListener(c.port, token)
+			case busy[key]:
+				c.result = "in use in the guest, not checked"
+			default:
+				if err := sendUDP(c.port, token); err != nil {
+					c.result = err.Error()
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	out, err = runGuestScript(d, collectScript())
+	if err != nil {
+		return nil, err
+	}
+	received := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[1] == token {
+			received[f[0]] = true
+		}
+	}
+	for _, c := range pending {
+		if c.protocol != "udp" || busy[fmt.Sprintf("%d/udp", c.port)] || c.result != "" {
+			continue
+		}
+		if received[strconv.Itoa(c.port)] {
+			c.ok, c.result = true, "ok"
+		} else {
+			c.result = "datagram did not arrive in the guest"
+		}
+	}
+	return checks, nil
+}
+
+// registeredForwards returns the forwards QEMU's user network lists, keyed
+// like the port claims, or nil when they cannot be listed.
+func (d *Driver) registeredForwards() map[string]bool {
+	if d.isMicroVM() {
+		return nil
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return nil
+	}
+	defer qmp.Close()
+	out, err := qmp.hmp("info usernet")
+	if err != nil {
+		return nil
+	}
+	forwards := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || !strings.HasSuffix(f[0], "[HOST_FORWARD]") {
+			continue
+		}
+		port, err := strconv.Atoi(f[3])
+		if err != nil {
+			continue
+		}
+		forwards[portClaim(port, strings.ToLower(strings.TrimSuffix(f[0], "[HOST_FORWARD]")))] = true
+	}
+	return forwards
+}
+
+func forwardToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "dmq-" + hex.EncodeToString(b), nil
+}
+
+// listenScript starts a listener on every free port, TCP ones answering
+// with the token and UDP ones saving what they receive. Ports a guest
+// service holds are reported busy.
+func listenScript(token string, checks []*forwardCheck) string {
+	var b strings.Builder
+	b.WriteString("command -v nc >/dev/null || { echo nonc; exit 0; }\n")
+	b.WriteString("mkdir -p /tmp/dmq-forwards\n")
+	for _, c := range checks {
+		listing := "-ltn"
+		if c.protocol == "udp" {
+			listing = "-lun"
+		}
+		fmt.Fprintf(&b, "if (netstat %[1]s 2>/dev/null || ss %[1]s 2>/dev/null) | grep -q ':%[2]d '; then echo busy %[3]s %[2]d; ", listing, c.port, c.protocol)
+		if c.protocol == "udp" {
+			fmt.Fprintf(&b, "else nc -u -l -p %[1]d > /tmp/dmq-forwards/%[1]d 2>/dev/null & echo $! >> /tmp/dmq-forwards/pids; fi\n", c.port)
+		} else {
+			fmt.Fprintf(&b, "else echo %s | nc -l -p %d >/dev/null 2>&1 & echo $! >> /tmp/dmq-forwards/pids; fi\n", token, c.port)
+		}
+	}
+	return b.String()
+}
+
+// collectScript prints what the UDP listeners received and stops them all.
+func collectScript() string {
+	return "cd /tmp/dmq-forwards 2>/dev/null || exit 0\n" +
+		"for f in [0-9]*; do [ -f \"$f\" ] && echo \"$f $(head -c 64 \"$f\")\"; done\n" +
+		"kill $(cat pids 2>/dev/null) 2>/dev/null\n" +
+		"cd / && rm -rf /tmp/dmq-forwards\n"
+}
+
+// runGuestScript runs a shell script as root in the guest.
+func runGuestScript(d *Driver, script string) (string, error) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	return drivers.RunSSHCommandFromDriver(d, fmt.Sprintf("echo %s | base64 -d | sudo sh", encoded))
+}
+
+// probeTCPListener connects through the forward and expects the guest
+// listener's token.
+func probeTCPListener(port int, token string) (bool, string) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), 2*time.Second)
+	if err != nil {
+		return false, "host connection failed"
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(token))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != token {
+		return false, "does not reach the guest"
+	}
+	return true, "ok"
+}
+
+// probeTCPService connects to a port a guest service listens on. QEMU
+// accepts every connection on the host and closes it at once when the
+// guest refuses it, so a connection staying open or answering counts.
+func probeTCPService(port int) (bool, string) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), 2*time.Second)
+	if err != nil {
+		return false, "host connection failed"
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == io.EOF {
+		return false, "closed by the guest"
+	}
+	return true, "ok"
+}
+
+func sendUDP(port int, token string) error {
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return fmt.Errorf("host socket failed")
+	}
+	defer conn.Close()
+	//A lost datagram is sent again
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte(token + "\n")); err != nil {
+			return fmt.Errorf("host send failed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
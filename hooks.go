@@ -0,0 +1,53 @@
+package qemu
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// hookTimeout bounds how long a host hook may hold up the operation.
+const hookTimeout = time.Minute
+
+// runHook runs the --qemu-on-ready or --qemu-on-stop command line on the
+// host with the machine described in its environment. Hooks are for
+// notification only, so a failing hook is logged and otherwise ignored.
+func (d *Driver) runHook(name, cmdline, machineState string) {
+	if cmdline == "" {
+		return
+	}
+	cmd := shellCommand(cmdline)
+	cmd.Env = append(os.Environ(),
+		"QEMU_MACHINE_NAME="+d.MachineName,
+		"QEMU_MACHINE_STATE="+machineState,
+		"QEMU_STORE_PATH="+d.ResolveStorePath("."),
+		"QEMU_SSH_PORT="+strconv.Itoa(d.SSHPort),
+		"QEMU_ENGINE_PORT="+strconv.Itoa(d.EnginePort))
+	if err := cmd.Start(); err != nil {
+		log.Warnf("Could not run the %s hook of %s: %v", name, d.MachineName, err)
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Warnf("The %s hook of %s failed: %v", name, d.MachineName, err)
+		}
+	case <-time.After(hookTimeout):
+		cmd.Process.Kill()
+		log.Warnf("The %s hook of %s did not finish within %s", name, d.MachineName, hookTimeout)
+	}
+}
+
+// stateChanged runs the hook for a machine that reached or left Running.
+func (d *Driver) stateChanged(machineState string) {
+	switch machineState {
+	case "running":
+		d.runHook("on-ready", d.OnReady, machineState)
+	case "stopped", "removed":
+		d.runHook("on-stop", d.OnStop, machineState)
+	}
+}
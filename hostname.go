@@ -0,0 +1,28 @@
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The guest is named after the machine unless --qemu-hostname says
+// otherwise, so machines are told apart in container logs and swarm node
+// lists. boot2docker takes it from the host= boot code, disk images from
+// their provisioner.
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+func validateHostname(hostname string) error {
+	if hostname != "" && (len(hostname) > 253 || !hostnamePattern.MatchString(hostname)) {
+		return fmt.Errorf("Invalid hostname %q", hostname)
+	}
+	return nil
+}
+
+// guestHostname is the hostname the guest gets.
+func (d *Driver) guestHostname() string {
+	if d.Hostname != "" {
+		return d.Hostname
+	}
+	return d.MachineName
+}
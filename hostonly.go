@@ -0,0 +1,107 @@
+package qemu
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// With --qemu-host-only the machine gets a second NIC on a host bridge the
+// driver creates on first use, like VirtualBox's host-only network. A
+// dnsmasq run by the driver hands out addresses, and the machine's IP and
+// engine URL use that address instead of the localhost forwards. SSH keeps
+// using the forward.
+
+const (
+	hostOnlyBridge   = "dmqemu0"
+	hostOnlyHostCIDR = "192.168.99.1/24"
+	hostOnlySubnet   = "192.168.99.0/24"
+	hostOnlyDHCP     = "192.168.99.100,192.168.99.254,12h"
+	hostOnlyRunDir   = "/run/docker-machine-qemu"
+	hostOnlyLeases   = hostOnlyRunDir + "/" + hostOnlyBridge + ".leases"
+)
+
+func validateHostOnly(d *Driver) error {
+	if !d.HostOnly {
+		return nil
+	}
+	if d.LazyStart {
+		return fmt.Errorf("--qemu-host-only cannot be combined with --qemu-lazy-start")
+	}
+	return nil
+}
+
+// hostOnlyMAC derives a stable locally administered MAC address from the
+// machine name, so the machine keeps its lease across restarts.
+func (d *Driver) hostOnlyMAC() string {
+	sum := sha1.Sum([]byte(d.MachineName))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+// hostOnlyArgs returns the second NIC, attached to the bridge through
+// qemu-bridge-helper.
+func (d *Driver) hostOnlyArgs() ([]string, error) {
+	if !d.HostOnly {
+		return nil, nil
+	}
+	netdev, err := newQemuOpts("bridge").
+		Set("id", "hostonly0").
+		Set("br", hostOnlyBridge).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	nic, err := qemucmd.Device{Driver: d.nicModel(1), Props: []qemucmd.Option{
+		{Key: "netdev", Value: "hostonly0"},
+		{Key: "mac", Value: d.hostOnlyMAC()},
+	}}.Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-netdev", netdev, "-device", nic}, nil
+}
+
+// waitHostOnlyIP waits for the guest to lease an address on the bridge.
+func (d *Driver) waitHostOnlyIP() error {
+	if !d.HostOnly {
+		return nil
+	}
+	for i := 0; i < 120; i++ {
+		if ip := leasedIP(hostOnlyLeases, d.hostOnlyMAC()); ip != "" {
+			log.Debugf("%s has the host-only address %s", d.MachineName, ip)
+			d.HostOnlyIP = ip
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if d.nicModel(1) == "virtio-net" {
+		return fmt.Errorf("%s got no host-only address, does the guest run DHCP on its second interface and have a virtio-net driver?", d.MachineName)
+	}
+	return fmt.Errorf("%s got no host-only address, does the guest run DHCP on its second interface?", d.MachineName)
+}
+
+// leasedIP looks mac up in a dnsmasq lease file, whose lines read
+// "<expiry> <mac> <ip> <hostname> <client-id>".
+func leasedIP(leases, mac string) string {
+	f, err := os.Open(leases)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	ip := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && strings.EqualFold(fields[1], mac) && net.ParseIP(fields[2]) != nil {
+			ip = fields[2]
+		}
+	}
+	return ip
+}
@@ -0,0 +1,183 @@
+package qemu
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Memory is hot-plugged in DIMMs which the Linux guest onlines per memory
+// block, so sizes have to be a multiple of the block size.
+const (
+	memorySlots     = 8
+	memoryBlockSize = 128
+)
+
+// smpArg returns the -smp value, reserving room for hot-plugged CPUs when
+// --qemu-max-cpus is set.
+func (d *Driver) smpArg() string {
+	if d.MaxCpus > d.Cpus {
+		return fmt.Sprintf("%d,maxcpus=%d", d.Cpus, d.MaxCpus)
+	}
+	return strconv.Itoa(d.Cpus)
+}
+
+// memArg returns the -m value, reserving DIMM slots when --qemu-max-memory
+// is set.
+func (d *Driver) memArg() string {
+	if d.MaxMem > d.Mem {
+		return fmt.Sprintf("size=%dM,slots=%d,maxmem=%dM", d.Mem, memorySlots, d.MaxMem)
+	}
+	return strconv.Itoa(d.Mem)
+}
+
+func validateHotplug(d *Driver) error {
+	if d.MaxCpus != 0 && d.MaxCpus < d.Cpus {
+		return fmt.Errorf("Maximum CPU count %d is lower than the CPU count %d", d.MaxCpus, d.Cpus)
+	}
+	if d.MaxMem != 0 && d.MaxMem < d.Mem {
+		return fmt.Errorf("Maximum memory %dMB is lower than the memory size %dMB", d.MaxMem, d.Mem)
+	}
+	return nil
+}
+
+// AddCPUs hot-plugs count vCPUs into the running machine.
+func (d *Driver) AddCPUs(count int) error {
+	if count <= 0 {
+		return fmt.Errorf("CPU count %d must be positive", count)
+	}
+	if d.Cpus+count > d.MaxCpus {
+		return fmt.Errorf("Cannot grow to %d CPUs, the machine was started with a maximum of %d", d.Cpus+count, d.MaxCpus)
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	var slots []struct {
+		Type    string                 `json:"type"`
+		Props   map[string]interface{} `json:"props"`
+		QomPath string                 `json:"qom-path"`
+	}
+	if err := qmp.execute("query-hotpluggable-cpus", nil, &slots); err != nil {
+		return err
+	}
+	added := 0
+	for i := len(slots) - 1; i >= 0 && added < count; i-- {
+		slot := slots[i]
+		if slot.QomPath != "" {
+			continue
+		}
+		args := map[string]interface{}{
+			"driver": slot.Type,
+			"id":     fmt.Sprintf("cpu%d", d.Cpus+added),
+		}
+		for k, v := range slot.Props {
+			args[k] = v
+		}
+		if err := qmp.execute("device_add", args, nil); err != nil {
+			return err
+		}
+		added++
+	}
+	d.Cpus += added
+	if added < count {
+		return fmt.Errorf("Only %d free CPU slots were available", added)
+	}
+	onlineGuestResources(d)
+	return nil
+}
+
+// AddMemory hot-plugs a DIMM of sizeMB into the running machine.
+func (d *Driver) AddMemory(sizeMB int) error {
+	if sizeMB <= 0 || sizeMB%memoryBlockSize != 0 {
+		return fmt.Errorf("Memory must be added in multiples of %dMB", memoryBlockSize)
+	}
+	if d.Mem+sizeMB > d.MaxMem {
+		return fmt.Errorf("Cannot grow to %dMB, the machine was started with a maximum of %dMB", d.Mem+sizeMB, d.MaxMem)
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	var dimms []interface{}
+	if err := qmp.execute("query-memory-devices", nil, &dimms); err != nil {
+		return err
+	}
+	id := len(dimms)
+	memdev := fmt.Sprintf("mem%d", id)
+	size := uint64(sizeMB) << 20
+
+	err = qmp.execute("object-add", map[string]interface{}{
+		"qom-type": "memory-backend-ram",
+		"id":       memdev,
+		"size":     size,
+	}, nil)
+	if err != nil {
+		//QEMU before 6.0 takes the backend properties nested
+		err = qmp.execute("object-add", map[string]interface{}{
+			"qom-type": "memory-backend-ram",
+			"id":       memdev,
+			"props":    map[string]interface{}{"size": size},
+		}, nil)
+	}
+	if err != nil {
+		return err
+	}
+	err = qmp.execute("device_add", map[string]interface{}{
+		"driver": "pc-dimm",
+		"id":     fmt.Sprintf("dimm%d", id),
+		"memdev": memdev,
+	}, nil)
+	if err != nil {
+		qmp.execute("object-del", map[string]interface{}{"id": memdev}, nil)
+		return err
+	}
+	d.Mem += sizeMB
+	onlineGuestResources(d)
+	return nil
+}
+
+// HotplugMachine adds cpus vCPUs and memMB of memory to the running machine
+// stored in machineDir and saves its new size.
+func HotplugMachine(machineDir string, cpus, memMB int) error {
+	if cpus < 0 || memMB < 0 {
+		return fmt.Errorf("CPU count and memory size cannot be negative")
+	}
+	if cpus == 0 && memMB == 0 {
+		return fmt.Errorf("Nothing to add, the CPU count or memory size must be positive")
+	}
+	if memMB%memoryBlockSize != 0 {
+		return fmt.Errorf("Memory must be added in multiples of %dMB", memoryBlockSize)
+	}
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if cpus > 0 {
+		err = d.AddCPUs(cpus)
+	}
+	if err == nil && memMB > 0 {
+		err = d.AddMemory(memMB)
+	}
+	//CPUs plugged before a failure are kept
+	if err := d.saveConfig(); err != nil {
+		return err
+	}
+	return err
+}
+
+// onlineGuestResources brings hot-plugged CPUs and memory blocks online in
+// guests that do not do so automatically.
+func onlineGuestResources(d *Driver) {
+	cmd := `for f in /sys/devices/system/cpu/cpu*/online; do [ "$(cat $f)" = 1 ] || echo 1 | sudo tee $f; done; ` +
+		`for f in /sys/devices/system/memory/memory*/state; do [ "$(cat $f)" = online ] || echo online | sudo tee $f; done`
+	if _, err := drivers.RunSSHCommandFromDriver(d, cmd); err != nil {
+		log.Warnf("Could not online hot-plugged resources in the guest: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/qeedquan/iso9660"
+)
+
+// initrdMagics are the headers of the compression formats and the plain
+// cpio archive an initrd can come in.
+var initrdMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0x02, 0x21, 0x4c, 0x18},           // lz4
+	{'B', 'Z', 'h'},                    // bzip2
+	{0x5d, 0x00, 0x00},                 // lzma
+	[]byte("070701"), []byte("070702"), // cpio
+}
+
+// extractKernel makes sure the machine directory holds the kernel and initrd
+// of the ISO. Files left from an earlier boot are reused when they have the
+// size and modification time of the ISO entry and the expected header,
+// otherwise they are extracted again, so deleted or truncated files are
+// repaired and a replaced ISO is picked up on start.
+func extractKernel(d *Driver) error {
+	isofs, err := iso9660.Open(d.ResolveStorePath("boot2docker.iso"))
+	if ferr, ok := err.(*iso9660.FormatError); ok {
+		return fmt.Errorf("%s is not a boot ISO, remove it and recreate the machine: %v", d.ResolveStorePath("boot2docker.iso"), ferr)
+	} else if err != nil {
+		return err
+	}
+	defer isofs.Close()
+
+	files := []struct {
+		entry, output string
+		valid         func(header []byte) bool
+	}{
+		{d.arch().kernel, d.ResolveStorePath("vmlinuz64"), d.isKernelHeader},
+		{d.arch().initrd, d.ResolveStorePath("initrd.img"), isInitrdHeader},
+	}
+	for _, f := range files {
+		entry, err := isofs.Stat(f.entry)
+		if err != nil {
+			return fmt.Errorf("%s not found in %s: %v", f.entry, d.ResolveStorePath("boot2docker.iso"), err)
+		}
+		if isExtracted(f.output, entry, f.valid) {
+			continue
+		}
+		log.Debugf("Extracting %s from the ISO", f.entry)
+		//Windows cannot replace files in place. Failing is ok!
+		os.Remove(f.output)
+		if err := getFileOutofFS(isofs, f.entry, f.output); err != nil {
+			return err
+		}
+		if !isExtracted(f.output, entry, f.valid) {
+			return fmt.Errorf("%s in %s is corrupted, remove the ISO and recreate the machine", f.entry, d.ResolveStorePath("boot2docker.iso"))
+		}
+		if err := verifyExtracted(isofs, f.entry, f.output); err != nil {
+			os.Remove(f.output)
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyExtracted compares the digest of an extracted file with the one of
+// its ISO entry.
+func verifyExtracted(isofs *iso9660.FileSystem, entry, output string) error {
+	want, err := isofs.SHA256(entry)
+	if err != nil {
+		return err
+	}
+	got, err := fileSHA256(output)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s does not match %s of the ISO, the disk may be failing", output, entry)
+	}
+	return nil
+}
+
+// isExtracted checks an extracted file against the size and modification
+// time of its ISO entry and its header.
+func isExtracted(path string, entry os.FileInfo, valid func(header []byte) bool) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() != entry.Size() || info.ModTime().Unix() != entry.ModTime().Unix() {
+		return false
+	}
+	header := make([]byte, 4096)
+	n, _ := f.ReadAt(header, 0)
+	return valid(header[:n])
+}
+
+func (d *Driver) isKernelHeader(header []byte) bool {
+	spec := d.arch()
+	end := spec.kernelMagicOffset + len(spec.kernelMagic)
+	return len(header) >= end && string(header[spec.kernelMagicOffset:end]) == spec.kernelMagic
+}
+
+func isInitrdHeader(header []byte) bool {
+	for _, magic := range initrdMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
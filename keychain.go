@@ -0,0 +1,133 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Machine secrets such as the disk encryption key live in the host OS
+// keychain where there is one, so the store path holds no plaintext keys.
+// --qemu-secret-store file keeps them as files readable by the current
+// user only, which is also the fallback of auto without a keychain.
+
+const keychainService = "docker-machine-qemu"
+
+var secretStores = []string{"auto", "keychain", "file"}
+
+// secretStore keeps named secrets of one user.
+type secretStore interface {
+	load(name string) ([]byte, error)
+	store(name string, secret []byte) error
+	remove(name string) error
+}
+
+// fileStore keeps each secret in a file of the machine directory.
+type fileStore struct{ d *Driver }
+
+func (s fileStore) path(name string) string { return s.d.ResolveStorePath(name + ".key") }
+
+func (s fileStore) load(name string) ([]byte, error) { return ioutil.ReadFile(s.path(name)) }
+
+func (s fileStore) store(name string, secret []byte) error {
+	if err := ioutil.WriteFile(s.path(name), secret, 0600); err != nil {
+		return err
+	}
+	return restrictToOwner(s.path(name))
+}
+
+func (s fileStore) remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func validateSecretStore(name string) error {
+	if name != "" && !stringIn(secretStores, name) {
+		return fmt.Errorf("Unknown secret store %q, must be auto, keychain or file", name)
+	}
+	return nil
+}
+
+// chooseSecretStore settles where the machine keeps its secrets, once at
+// create.
+func (d *Driver) chooseSecretStore() error {
+	if d.SecretStore != "auto" && d.SecretStore != "" {
+		if d.SecretStore == "keychain" && hostKeychain() == nil {
+			return fmt.Errorf("No OS keychain available for --qemu-secret-store keychain")
+		}
+		return nil
+	}
+	d.SecretStore = "file"
+	if hostKeychain() != nil {
+		d.SecretStore = "keychain"
+	} else {
+		log.Debugf("No OS keychain available, keeping the secrets of %s in its store path", d.MachineName)
+	}
+	return nil
+}
+
+// secrets returns the machine's secret store.
+func (d *Driver) secrets() (secretStore, error) {
+	if d.SecretStore != "keychain" {
+		return fileStore{d}, nil
+	}
+	if s := hostKeychain(); s != nil {
+		return s, nil
+	}
+	return nil, fmt.Errorf("The OS keychain holding the secrets of %s is not available", d.MachineName)
+}
+
+// secretName names the machine's secret kind in the keychain, which is
+// shared by all machines of the user.
+func (d *Driver) secretName(kind string) string {
+	if d.SecretStore == "keychain" {
+		return d.MachineName + "/" + kind
+	}
+	return kind
+}
+
+func (d *Driver) saveSecret(kind string, secret []byte) error {
+	s, err := d.secrets()
+	if err != nil {
+		return err
+	}
+	return s.store(d.secretName(kind), secret)
+}
+
+func (d *Driver) loadSecret(kind string) ([]byte, error) {
+	s, err := d.secrets()
+	if err != nil {
+		return nil, err
+	}
+	return s.load(d.secretName(kind))
+}
+
+// secretFile makes the secret available as a file for QEMU and qemu-img,
+// which read it once when they start. Keychain secrets are written to a
+// file readable by the current user only, removed by cleanup.
+func (d *Driver) secretFile(kind string) (string, func(), error) {
+	if d.SecretStore != "keychain" {
+		return fileStore{d}.path(kind), func() {}, nil
+	}
+	secret, err := d.loadSecret(kind)
+	if err != nil {
+		return "", nil, err
+	}
+	return d.writeTmp(kind+".key", secret)
+}
+
+// removeSecrets deletes the machine's secrets from the keychain.
+func (d *Driver) removeSecrets() error {
+	if d.SecretStore != "keychain" || !d.DiskEncrypt {
+		return nil
+	}
+	s, err := d.secrets()
+	if err != nil {
+		return err
+	}
+	return s.remove(d.secretName("disk"))
+}
@@ -0,0 +1,8 @@
+package qemu
+
+// hostKeychain returns no keychain on macOS, whose security tool only takes
+// a password on its command line, visible to every user. The secrets are
+// kept in the store path.
+func hostKeychain() secretStore {
+	return nil
+}
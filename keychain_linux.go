@@ -0,0 +1,47 @@
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// secretTool keeps secrets in the Secret Service (GNOME Keyring, KWallet)
+// through libsecret's secret-tool.
+type secretTool struct{}
+
+// hostKeychain returns the Secret Service, when there is a session bus to
+// reach it.
+func hostKeychain() secretStore {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil
+	}
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil
+	}
+	return secretTool{}
+}
+
+func (secretTool) load(name string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keychainService, "name", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Secret %s not found in the keychain: %v", name, err)
+	}
+	return out, nil
+}
+
+func (secretTool) store(name string, secret []byte) error {
+	cmd := exec.Command("secret-tool", "store", "--label", keychainService+" "+name,
+		"service", keychainService, "name", name)
+	cmd.Stdin = bytes.NewReader(secret)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Could not store %s in the keychain: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (secretTool) remove(name string) error {
+	return exec.Command("secret-tool", "clear", "service", keychainService, "name", name).Run()
+}
@@ -0,0 +1,98 @@
+package qemu
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32        = windows.NewLazySystemDLL("advapi32.dll")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredDeleteW = advapi32.NewProc("CredDeleteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// credential is CREDENTIALW.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credentialManager keeps secrets as generic credentials of the Windows
+// Credential Manager.
+type credentialManager struct{}
+
+func hostKeychain() secretStore {
+	if procCredWriteW.Find() != nil {
+		return nil
+	}
+	return credentialManager{}
+}
+
+func credentialTarget(name string) (*uint16, error) {
+	return windows.UTF16PtrFromString(keychainService + "/" + name)
+}
+
+func (credentialManager) load(name string) ([]byte, error) {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return nil, fmt.Errorf("Secret %s not found in the Credential Manager: %v", name, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	return append([]byte(nil), blob...), nil
+}
+
+func (credentialManager) store(name string, secret []byte) error {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return err
+	}
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(secret)),
+		Persist:            credPersistLocalMachine,
+	}
+	if len(secret) > 0 {
+		cred.CredentialBlob = &secret[0]
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return fmt.Errorf("Could not store %s in the Credential Manager: %v", name, err)
+	}
+	return nil
+}
+
+func (credentialManager) remove(name string) error {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 && err != windows.ERROR_NOT_FOUND {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// When QEMU crashed half way or the QMP port in the config is stale, QEMU
+// cannot be asked to quit. kill then falls back to the PID QEMU wrote to
+// qemu.pid and to QEMU processes whose command line points at the machine
+// directory, and calls the machine stopped when none is left, so Remove is
+// not stranded by a dead monitor.
+
+// pidFile is where QEMU writes its PID.
+func (d *Driver) pidFile() string {
+	return d.ResolveStorePath("qemu.pid")
+}
+
+// nameArgs names the guest after the machine, in window titles and the
+// monitor, and the QEMU process dm-qemu-<machine> in ps and top. QEMU
+// renames its process only on Linux, on macOS it refuses to start instead.
+func (d *Driver) nameArgs() ([]string, error) {
+	opts := newQemuOpts(d.MachineName)
+	if runtime.GOOS == "linux" {
+		opts.Set("process", "dm-qemu-"+d.MachineName)
+	}
+	name, err := opts.Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-name", name}, nil
+}
+
+// qemuPids returns the QEMU processes of the machine.
+func (d *Driver) qemuPids() []int {
+	pids, err := findProcesses("qemu", qemuPath(d.ResolveStorePath("qemu.log")))
+	if err == nil {
+		return pids
+	}
+	//Without a process list only the PID file is left, trusted as it is
+	log.Debugf("Could not list the processes: %v", err)
+	if pid, err := d.readPid(); err == nil {
+		return []int{pid}
+	}
+	return nil
+}
+
+// readPid returns the PID in QEMU's PID file.
+func (d *Driver) readPid() (int, error) {
+	data, err := ioutil.ReadFile(d.pidFile())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// killProcesses kills the machine's QEMU processes after the monitor
+// failed with monitorErr, waiting for up to five seconds for them to exit.
+func (d *Driver) killProcesses(monitorErr error) error {
+	pids := d.qemuPids()
+	if len(pids) == 0 {
+		log.Infof("The monitor of %s does not answer and no QEMU process is left, taking it as stopped", d.MachineName)
+		os.Remove(d.pidFile())
+		return nil
+	}
+	log.Infof("The monitor of %s does not answer, killing QEMU (PID %v)", d.MachineName, pids)
+	for _, pid := range pids {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	}
+	//A killed QEMU leaves its PID file behind
+	os.Remove(d.pidFile())
+	for i := 0; i < 50; i++ {
+		if pids = d.qemuPids(); len(pids) == 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Could not kill QEMU of %s (PID %v) after its monitor failed: %v", d.MachineName, pids, monitorErr)
+}
@@ -0,0 +1,80 @@
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Labels tag a machine for the scripts managing it, for example with its
+// project, owner or time to live. They are kept in the driver config.
+
+var labelKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// parseLabels parses key=value pairs. A later pair overrides an earlier one
+// with the same key.
+func parseLabels(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || !labelKey.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Invalid label %q, must be key=value", spec)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// Metadata returns a copy of the machine's labels.
+func (d *Driver) Metadata() map[string]string {
+	labels := make(map[string]string, len(d.Labels))
+	for k, v := range d.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Label returns the value of the label key.
+func (d *Driver) Label(key string) (string, bool) {
+	value, ok := d.Labels[key]
+	return value, ok
+}
+
+// SetLabel sets or, with an empty value, removes a label and saves the
+// driver config.
+func (d *Driver) SetLabel(key, value string) error {
+	if !labelKey.MatchString(key) {
+		return fmt.Errorf("Invalid label key %q", key)
+	}
+	if value == "" {
+		delete(d.Labels, key)
+	} else {
+		if d.Labels == nil {
+			d.Labels = map[string]string{}
+		}
+		d.Labels[key] = value
+	}
+	return d.saveConfig()
+}
+
+// SetMachineLabels applies key=value pairs to the machine stored in
+// machineDir, an empty value removing the label.
+func SetMachineLabels(machineDir string, specs []string) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid label %q, must be key=value", spec)
+		}
+		if err := d.SetLabel(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
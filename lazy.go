@@ -0,0 +1,234 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// With --qemu-lazy-start the machine's SSH and engine ports are served by a
+// supervisor process instead of QEMU. The supervisor only boots QEMU when
+// the first connection comes in and then proxies to QEMU's own forwards on
+// the backend ports, so idle machines use no memory.
+
+// forwardedSSHPort is the host port QEMU forwards to the guest SSH server.
+func (d *Driver) forwardedSSHPort() int {
+	if d.LazyStart {
+		return d.BackendSSHPort
+	}
+	return d.SSHPort
+}
+
+// forwardedEnginePort is the host port QEMU forwards to the guest engine.
+func (d *Driver) forwardedEnginePort() int {
+	if d.LazyStart {
+		return d.BackendEnginePort
+	}
+	return d.EnginePort
+}
+
+// startSupervisor starts "docker-machine-driver-qemu supervise" for the
+// machine in the background and waits until it listens.
+func (d *Driver) startSupervisor() error {
+	if d.supervisorRunning() {
+		return nil
+	}
+	if err := d.spawnHelper("supervise", "supervisor"); err != nil {
+		return err
+	}
+	for i := 0; i < 50; i++ {
+		if d.supervisorRunning() {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("The supervisor of %s did not start, see %s", d.MachineName, d.ResolveStorePath("supervisor.log"))
+}
+
+func (d *Driver) supervisorRunning() bool {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(d.SSHPort), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// spawnHelper runs the plugin binary in mode for this machine in the
+// background, keeping its pid in name.pid and its output in name.log.
+func (d *Driver) spawnHelper(mode, name string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(d.ResolveStorePath(name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, mode, d.ResolveStorePath("."))
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	setProcAttr(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	return ioutil.WriteFile(d.ResolveStorePath(name+".pid"), []byte(pid), 0644)
+}
+
+// stopSupervisor ends the supervisor, if any.
+func (d *Driver) stopSupervisor() error {
+	return d.stopHelper("supervisor")
+}
+
+// stopHelper ends the helper process started as name, if any.
+func (d *Driver) stopHelper(name string) error {
+	pidFile := d.ResolveStorePath(name + ".pid")
+	data, err := ioutil.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	os.Remove(pidFile)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	p.Kill()
+	return nil
+}
+
+// qemuRunning reports whether QEMU answers on its control port.
+func (d *Driver) qemuRunning() bool {
+	port := d.QMPPort
+	if port == 0 {
+		port = d.MonitorPort
+	}
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Supervise serves the lazily started machine stored in machineDir until
+// the process is killed. It is run by the plugin binary's supervise mode.
+func Supervise(machineDir string) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	d.supervising = true
+	go d.reapSelf()
+	return d.serveLazy()
+}
+
+// loadDriver reads the driver of the machine stored in machineDir.
+func loadDriver(machineDir string) (*Driver, error) {
+	data, err := readHostConfig(machineDir)
+	if err != nil {
+		return nil, err
+	}
+	host := struct{ Driver *Driver }{&Driver{BaseDriver: &drivers.BaseDriver{}}}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return nil, err
+	}
+	return host.Driver, nil
+}
+
+func (d *Driver) serveLazy() error {
+	var mu sync.Mutex
+	ensureLaunched := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if d.qemuRunning() {
+			return nil
+		}
+		log.Infof("First connection to %s, starting QEMU...", d.MachineName)
+		if err := d.launch(); err != nil {
+			return err
+		}
+		for i := 0; i < 240; i++ {
+			if sshBanner(d.BackendSSHPort) {
+				return nil
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		return fmt.Errorf("%s did not come up", d.MachineName)
+	}
+
+	errs := make(chan error, 2)
+	forwards := map[int]int{
+		d.SSHPort:    d.BackendSSHPort,
+		d.EnginePort: d.BackendEnginePort,
+	}
+	for public, backend := range forwards {
+		ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(public))
+		if err != nil {
+			return err
+		}
+		go func(ln net.Listener, backend int) {
+			for {
+				client, err := ln.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go func() {
+					if err := ensureLaunched(); err != nil {
+						log.Errorf("Starting %s: %v", d.MachineName, err)
+						client.Close()
+						return
+					}
+					proxy(client, backend)
+				}()
+			}
+		}(ln, backend)
+	}
+	return <-errs
+}
+
+// proxy copies between client and the backend port until either side
+// closes.
+func proxy(client net.Conn, backend int) {
+	proxyTo(client, "127.0.0.1:"+strconv.Itoa(backend))
+}
+
+// proxyTo copies between client and addr until either side closes.
+func proxyTo(client net.Conn, addr string) {
+	defer client.Close()
+	server, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Debugf("Proxy to %s: %v", addr, err)
+		return
+	}
+	defer server.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, server)
+		done <- struct{}{}
+	}()
+	<-done
+}
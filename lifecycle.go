@@ -0,0 +1,138 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// Lifecycle operations run as guarded transitions. The operation in
+// progress is held in state.lock, so a second Start, Stop, Restart or
+// Remove fails with "already starting" style errors instead of racing the
+// first one. The outcome of the last operation is kept in state.json.
+
+// staleTransition is how long a transition lock without a PID is honored.
+// Other locks are honored as long as the driver process holding them runs,
+// one that died mid-operation must not block the machine.
+const staleTransition = 15 * time.Minute
+
+type machineState struct {
+	State string    `json:"state"`
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+// transition runs fn as the operation named by during, recording after as
+// the machine's last known state once it finishes. A failure is recorded as
+// "error" when it left the VM up or down differently, one refusing to run,
+// such as starting a running machine, keeps the last state.
+func (d *Driver) transition(during, after string, fn func() error) error {
+	if err := d.lockTransition(during); err != nil {
+		return err
+	}
+	defer os.Remove(d.ResolveStorePath("state.lock"))
+
+	up := d.vmUp()
+	err := fn()
+	d.cleanTmp()
+	if err != nil {
+		if d.vmUp() != up {
+			d.recordState("error")
+		}
+	} else {
+		d.recordState(after)
+		d.stateChanged(after)
+	}
+	return err
+}
+
+func (d *Driver) lockTransition(during string) error {
+	lock := d.ResolveStorePath("state.lock")
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			defer f.Close()
+			return json.NewEncoder(f).Encode(machineState{State: during, PID: os.Getpid(), Since: time.Now()})
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		current, ok := d.transitionInProgress()
+		if ok {
+			return fmt.Errorf("Machine %s is already %s since %s", d.MachineName, current.State, current.Since.Format(time.RFC3339))
+		}
+		log.Debugf("Removing stale transition lock of %s", d.MachineName)
+		os.Remove(lock)
+	}
+	return fmt.Errorf("Could not lock %s for %s", d.MachineName, during)
+}
+
+// transitionInProgress returns the operation holding the transition lock,
+// unless there is none or it is stale.
+func (d *Driver) transitionInProgress() (machineState, bool) {
+	var current machineState
+	data, err := ioutil.ReadFile(d.ResolveStorePath("state.lock"))
+	if err != nil {
+		return current, false
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return current, false
+	}
+	if current.PID != 0 {
+		return current, current.PID == os.Getpid() || pidRunning(current.PID)
+	}
+	return current, time.Since(current.Since) < staleTransition
+}
+
+// vmUp reports whether the process running the guest is there.
+func (d *Driver) vmUp() bool {
+	if d.isMicroVM() {
+		return d.helperAlive("microvm")
+	}
+	return !d.qemuExited()
+}
+
+func (d *Driver) recordState(s string) {
+	data, err := json.Marshal(machineState{State: s, PID: os.Getpid(), Since: time.Now()})
+	if err == nil {
+		err = ioutil.WriteFile(d.ResolveStorePath("state.json"), data, 0644)
+	}
+	if err != nil {
+		log.Debugf("Could not record state of %s: %v", d.MachineName, err)
+	}
+}
+
+// LastKnownState returns the outcome of the last lifecycle operation, or
+// the operation in progress.
+func (d *Driver) LastKnownState() (string, time.Time) {
+	if current, ok := d.transitionInProgress(); ok {
+		return current.State, current.Since
+	}
+	var last machineState
+	data, err := ioutil.ReadFile(d.ResolveStorePath("state.json"))
+	if err != nil || json.Unmarshal(data, &last) != nil {
+		return "", time.Time{}
+	}
+	return last.State, last.Since
+}
+
+// transientState maps an operation in progress to the state reported by
+// GetState.
+func (d *Driver) transientState() (state.State, bool) {
+	current, ok := d.transitionInProgress()
+	if !ok || current.PID == os.Getpid() {
+		return state.None, false
+	}
+	switch current.State {
+	case "starting":
+		return state.Starting, true
+	case "stopping":
+		return state.Stopping, true
+	}
+	return state.None, false
+}
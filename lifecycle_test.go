@@ -0,0 +1,301 @@
+package qemu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemutest"
+)
+
+// The lifecycle tests run the driver against the fake QEMU of qemutest,
+// with its qemu-img and ssh stubs first on the PATH, so they need no
+// virtualization.
+
+// testOptions are the create flags with their defaults, as docker-machine
+// passes them.
+type testOptions map[string]interface{}
+
+func (o testOptions) String(key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+func (o testOptions) StringSlice(key string) []string {
+	s, _ := o[key].([]string)
+	return s
+}
+
+func (o testOptions) Int(key string) int {
+	i, _ := o[key].(int)
+	return i
+}
+
+func (o testOptions) Bool(key string) bool {
+	b, _ := o[key].(bool)
+	return b
+}
+
+// fakeMachine is a machine of a temporary store booting the fake QEMU.
+type fakeMachine struct {
+	*Driver
+	commandLog string
+	script     qemutest.Script
+	scriptPath string
+}
+
+// newFakeMachine builds the fake tools, serves a guest image through a
+// catalog and configures a machine with flags on top of the defaults.
+func newFakeMachine(t *testing.T, script qemutest.Script, flags map[string]interface{}) *fakeMachine {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("The fake QEMU is built with the go tool")
+	}
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qemutest.BuildFake(bin); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	script.CommandLog = filepath.Join(tmp, "commands.log")
+	scriptPath := filepath.Join(tmp, "script.json")
+	if err := qemutest.WriteScript(scriptPath, script); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_QEMU_SCRIPT", scriptPath)
+
+	image := []byte("fake guest image")
+	sum := sha256.Sum256(image)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	t.Cleanup(server.Close)
+	catalog, err := json.Marshal(map[string]interface{}{"images": []map[string]string{{
+		"name": "fake", "version": "1", "url": server.URL + "/fake.img",
+		"sha256": hex.EncodeToString(sum[:]), "provisioner": "ignition",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogPath := filepath.Join(tmp, "catalog.json")
+	if err := ioutil.WriteFile(catalogPath, catalog, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := filepath.Join(tmp, "store")
+	d := &Driver{BaseDriver: &drivers.BaseDriver{MachineName: "fake", StorePath: store}}
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions{}
+	for _, f := range d.GetCreateFlags() {
+		opts[f.String()] = f.Default()
+	}
+	opts["qemu-location"] = bin
+	opts["qemu-cache-dir"] = filepath.Join(tmp, "cache")
+	opts["qemu-image"] = "fake"
+	opts["qemu-image-catalog"] = catalogPath
+	opts["qemu-accel"] = "tcg"
+	opts["qemu-disk-size"] = 64
+	opts["qemu-shutdown-timeout"] = "5s"
+	opts["qemu-kill-timeout"] = "2s"
+	for key, value := range flags {
+		opts[key] = value
+	}
+	if err := d.SetConfigFromFlags(opts); err != nil {
+		t.Fatal(err)
+	}
+	//docker-machine saves the host before it creates the machine
+	host, err := json.Marshal(map[string]interface{}{"ConfigVersion": 3, "Driver": d, "DriverName": "qemu", "Name": d.MachineName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.ResolveStorePath("config.json"), host, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMachine{d, script.CommandLog, script, scriptPath}
+	t.Cleanup(func() { m.Kill() })
+	return m
+}
+
+// commands returns the QMP and monitor commands QEMU received since the
+// last call.
+func (m *fakeMachine) commands(t *testing.T) []string {
+	data, err := ioutil.ReadFile(m.commandLog)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(m.commandLog)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// rescript changes the script of the fake QEMUs started from now on.
+func (m *fakeMachine) rescript(t *testing.T, change func(s *qemutest.Script)) {
+	change(&m.script)
+	if err := qemutest.WriteScript(m.scriptPath, m.script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (m *fakeMachine) expectState(t *testing.T, want state.State) {
+	t.Helper()
+	s, err := m.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Fatalf("%s is %s, want %s", m.MachineName, s, want)
+	}
+}
+
+func (m *fakeMachine) create(t *testing.T) {
+	t.Helper()
+	if err := m.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Create(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Running)
+	m.commands(t)
+}
+
+func TestLifecycle(t *testing.T) {
+	m := newFakeMachine(t, qemutest.Script{}, nil)
+	m.create(t)
+
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); !stringIn(cmds, "system_powerdown") || stringIn(cmds, "quit") {
+		t.Errorf("Stop sent %q, want a power-down without quit", cmds)
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Running)
+
+	m.commands(t)
+	if err := m.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); !stringIn(cmds, "quit") {
+		t.Errorf("Kill sent %q, want quit", cmds)
+	}
+
+	if err := m.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.Disk); !os.IsNotExist(err) {
+		t.Errorf("The disk %s is left after Remove: %v", m.Disk, err)
+	}
+}
+
+func TestStopKillsIgnoredPowerdown(t *testing.T) {
+	m := newFakeMachine(t, qemutest.Script{IgnorePowerdown: true}, map[string]interface{}{
+		"qemu-shutdown-timeout": "1s",
+	})
+	m.create(t)
+
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); !stringIn(cmds, "system_powerdown") || !stringIn(cmds, "quit") {
+		t.Errorf("Stop sent %q, want a power-down followed by quit", cmds)
+	}
+}
+
+func TestPanickedGuest(t *testing.T) {
+	argsLog := filepath.Join(t.TempDir(), "args")
+	m := newFakeMachine(t, qemutest.Script{ArgsLog: argsLog}, nil)
+	m.create(t)
+	args, err := ioutil.ReadFile(argsLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "\n-action\npanic=pause\n") {
+		t.Errorf("QEMU was started without -action panic=pause:\n%s", args)
+	}
+	if err := m.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	//The guest panics during boot, after its SSH forward came up
+	m.rescript(t, func(s *qemutest.Script) { s.Status = "guest-panicked" })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Error)
+	m.commands(t)
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); stringIn(cmds, "system_powerdown") || !stringIn(cmds, "quit") {
+		t.Errorf("Stop sent %q to a panicked guest, want quit without a power-down", cmds)
+	}
+}
+
+func TestMonitorOnlyMachine(t *testing.T) {
+	m := newFakeMachine(t, qemutest.Script{}, map[string]interface{}{
+		"qemu-monitor-port": freeTestPort(t),
+	})
+	m.create(t)
+	if err := m.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Machines of drivers before the QMP port are run through the monitor
+	m.QMPPort = 0
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Running)
+	m.commands(t)
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); !stringIn(cmds, "system_powerdown") {
+		t.Errorf("Stop sent %q to the monitor, want system_powerdown", cmds)
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.commands(t)
+	if err := m.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	m.expectState(t, state.Stopped)
+	if cmds := m.commands(t); !stringIn(cmds, "q") {
+		t.Errorf("Kill sent %q to the monitor, want q", cmds)
+	}
+}
+
+func freeTestPort(t *testing.T) int {
+	port, err := getTCPPort(&Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
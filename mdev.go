@@ -0,0 +1,107 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Mediated devices such as Intel GVT-g vGPUs are given to the guest through
+// VFIO. A --qemu-mdev value is either the UUID of an existing mdev, which
+// is only attached, or <parent>/<type> such as 0000:00:02.0/i915-GVTg_V5_4.
+// The driver creates the latter on start and removes it when the machine
+// stops, keeping its UUID so the guest sees the same device every boot.
+
+const mdevDevices = "/sys/bus/mdev/devices"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func validateMdevs(specs []string) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("Mediated devices are only supported on Linux hosts")
+	}
+	for _, spec := range specs {
+		if uuidPattern.MatchString(spec) {
+			continue
+		}
+		if parts := strings.Split(spec, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid mediated device %q, use an mdev UUID or <parent>/<type>", spec)
+		}
+	}
+	return nil
+}
+
+// isManagedMdev tells whether the driver creates and removes the device.
+func isManagedMdev(spec string) bool {
+	return !uuidPattern.MatchString(spec)
+}
+
+// createMdevs creates the managed devices that do not exist yet and returns
+// their -device options.
+func (d *Driver) createMdevs() ([]string, error) {
+	var args []string
+	for i, spec := range d.Mdevs {
+		uuid := spec
+		if isManagedMdev(spec) {
+			if i >= len(d.MdevUUIDs) {
+				id, err := ioutil.ReadFile("/proc/sys/kernel/random/uuid")
+				if err != nil {
+					return nil, err
+				}
+				d.MdevUUIDs = append(d.MdevUUIDs, strings.TrimSpace(string(id)))
+			}
+			uuid = d.MdevUUIDs[i]
+			if !fileExists(filepath.Join(mdevDevices, uuid)) {
+				parts := strings.Split(spec, "/")
+				create := filepath.Join("/sys/class/mdev_bus", parts[0], "mdev_supported_types", parts[1], "create")
+				log.Debugf("Creating mediated device %s of type %s", uuid, spec)
+				if err := ioutil.WriteFile(create, []byte(uuid), 0200); err != nil {
+					return nil, fmt.Errorf("Could not create mediated device %s: %v", spec, err)
+				}
+			}
+		} else if i >= len(d.MdevUUIDs) {
+			d.MdevUUIDs = append(d.MdevUUIDs, "")
+		}
+		device, err := newQemuOpts("vfio-pci").
+			Set("sysfsdev", filepath.Join(mdevDevices, uuid)).
+			Build()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-device", device)
+	}
+	return args, nil
+}
+
+// releaseMdevs removes the managed devices once QEMU has exited, as a
+// device still attached to it cannot be removed. Failures are only logged
+// since the machine is already down.
+func (d *Driver) releaseMdevs() {
+	if len(d.MdevUUIDs) == 0 {
+		return
+	}
+	if !d.qemuExited() {
+		log.Warnf("QEMU of %s is still running, keeping its mediated devices", d.MachineName)
+		return
+	}
+	for i, spec := range d.Mdevs {
+		if !isManagedMdev(spec) || i >= len(d.MdevUUIDs) {
+			continue
+		}
+		dev := filepath.Join(mdevDevices, d.MdevUUIDs[i])
+		if !fileExists(dev) {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dev, "remove"), []byte("1"), 0200); err != nil {
+			log.Debugf("Could not remove mediated device %s: %v", d.MdevUUIDs[i], err)
+		}
+	}
+}
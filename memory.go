@@ -0,0 +1,69 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// KSM merges identical pages of the guests on a Linux host, which helps
+// several machines running the same images. It cannot merge huge pages, so
+// --qemu-thp never is its companion: QEMU otherwise asks for transparent
+// huge pages for all guest memory.
+
+var memMergeModes = []string{"on", "off"}
+
+// thpPolicies are the transparent huge page policies besides QEMU's own,
+// which asks for huge pages for all guest memory.
+var thpPolicies = []string{"never"}
+
+func validateMemoryPolicy(merge, thp string) error {
+	if merge != "" && !stringIn(memMergeModes, merge) {
+		return fmt.Errorf("Invalid memory merge mode %q, must be one of %v", merge, memMergeModes)
+	}
+	if thp != "" && !stringIn(thpPolicies, thp) {
+		return fmt.Errorf("Invalid transparent huge page policy %q, must be one of %v or empty for QEMU's default", thp, thpPolicies)
+	}
+	if (merge != "" || thp != "") && runtime.GOOS != "linux" {
+		return fmt.Errorf("Memory merging and huge page policies are only supported on Linux hosts")
+	}
+	return nil
+}
+
+// memoryArgs returns the -machine option marking guest memory mergeable.
+func (d *Driver) memoryArgs() []string {
+	if d.MemMerge == "" {
+		return nil
+	}
+	if d.MemMerge == "on" {
+		checkKSM()
+	}
+	return []string{"-machine", "mem-merge=" + d.MemMerge}
+}
+
+func checkKSM() {
+	run, err := ioutil.ReadFile("/sys/kernel/mm/ksm/run")
+	if err != nil {
+		log.Debugf("Could not read the KSM state: %v", err)
+		return
+	}
+	if strings.TrimSpace(string(run)) != "1" {
+		log.Warnf("KSM is not running on this host, guest memory will not be merged until it is enabled with 'echo 1 > /sys/kernel/mm/ksm/run'")
+	}
+}
+
+// startQemu starts cmd under the machine's transparent huge page policy.
+func (d *Driver) startQemu(cmd *exec.Cmd) error {
+	if d.THP != "never" {
+		return cmd.Start()
+	}
+	if err := setTHPDisabled(true); err != nil {
+		return err
+	}
+	defer setTHPDisabled(false)
+	return cmd.Start()
+}
@@ -0,0 +1,372 @@
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The experimental cloud-hypervisor and firecracker backends boot the
+// boot2docker kernel and initrd straight from the machine directory, with
+// one virtio-blk disk and one virtio-net NIC on a tap device of the
+// host-only bridge. Neither has user mode networking, so a helper process
+// started as "docker-machine-driver-qemu microvm" runs the hypervisor and
+// forwards the SSH, engine and open ports on localhost to the guest's
+// host-only address, where QEMU would forward them itself.
+
+// microVM is what a lightweight backend boots.
+type microVM struct {
+	Kernel   string
+	Initrd   string
+	Cmdline  string
+	Disk     string
+	Tap      string
+	MAC      string
+	Cpus     int
+	MemoryMB int
+}
+
+// microVMBackend is a hypervisor that does not take QEMU's options. The
+// guest console is expected on the hypervisor's stdout.
+type microVMBackend interface {
+	hypervisorBackend
+	// vmCommand returns the process booting vm.
+	vmCommand(d *Driver, binary string, vm microVM) (*exec.Cmd, error)
+}
+
+func (d *Driver) isMicroVM() bool {
+	_, ok := d.backend().(microVMBackend)
+	return ok
+}
+
+func validateMicroVM(d *Driver) error {
+	if _, ok := backends[d.Backend].(microVMBackend); !ok {
+		return nil
+	}
+	switch {
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("The %s backend only runs on Linux", d.Backend)
+	case !d.HostOnly:
+		return fmt.Errorf("The %s backend needs --qemu-host-only, it has no user mode networking", d.Backend)
+	case d.Image != "" || (d.Provisioner != "" && d.Provisioner != "boot2docker"):
+		return fmt.Errorf("The %s backend only boots boot2docker", d.Backend)
+	case !d.isNativeArch() || d.isWindowsGuest():
+		return fmt.Errorf("The %s backend only runs Linux guests of the host architecture", d.Backend)
+	case d.Arch != "" && d.Arch != defaultArch:
+		return fmt.Errorf("The %s backend only boots x86_64 kernels", d.Backend)
+	case d.QemuBinary != "":
+		return fmt.Errorf("--qemu-binary cannot be combined with the %s backend", d.Backend)
+	case d.LazyStart || d.SleepGuard || d.Balloon:
+		return fmt.Errorf("--qemu-lazy-start, --qemu-sleep-guard and --qemu-balloon need QEMU's monitor, the %s backend has none", d.Backend)
+	case d.DiskEncrypt || d.DataDiskSize != 0:
+		return fmt.Errorf("The %s backend only takes a single unencrypted disk", d.Backend)
+	case len(d.OpenUDPPorts) > 0:
+		return fmt.Errorf("The %s backend only forwards TCP ports", d.Backend)
+	case d.isUEFI() || d.Console == "graphical":
+		return fmt.Errorf("The %s backend only boots a kernel directly, with a serial console", d.Backend)
+	}
+	return nil
+}
+
+// tapDevice is the machine's tap device on the host-only bridge.
+func (d *Driver) tapDevice() string {
+	sum := sha1.Sum([]byte(d.MachineName))
+	return fmt.Sprintf("dmq%02x%02x%02x", sum[0], sum[1], sum[2])
+}
+
+// microVMDisk switches a new machine to a raw disk file, the only format
+// both lightweight hypervisors read.
+func (d *Driver) microVMDisk() error {
+	if !d.isMicroVM() || d.DiskFormat == "raw" {
+		return nil
+	}
+	d.Disk, d.DiskFormat = strings.TrimSuffix(d.Disk, ".qcow2")+".raw", "raw"
+	f, err := os.OpenFile(d.Disk, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(d.DiskSize) * 1024 * 1024); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// launchMicroVM starts the helper running the lightweight hypervisor and
+// waits for the guest like launch does.
+func (d *Driver) launchMicroVM() error {
+	err := d.phase("start", "extract", func() error {
+		if err := extractKernel(d); err != nil {
+			return err
+		}
+		return extractVmlinux(d.ResolveStorePath("vmlinuz64"), d.ResolveStorePath("vmlinux"))
+	})
+	if err != nil {
+		return err
+	}
+	if err := createTap(d.tapDevice()); err != nil {
+		return err
+	}
+	d.IPAddress = "127.0.0.1"
+	d.SSHUser = d.provisioner().sshUser(d)
+	//The helper reads the machine from config.json
+	if err := d.saveConfig(); err != nil {
+		log.Debugf("Could not save the config of %s: %v", d.MachineName, err)
+	}
+	err = d.phase("start", "qemu-launch", func() error {
+		return d.spawnHelper("microvm", "microvm")
+	})
+	if err != nil {
+		return err
+	}
+	return d.awaitGuest()
+}
+
+// microVMCommands points the guest at the host's DNS servers. The host-only
+// DHCP does not hand any out, QEMU's user mode network did.
+func (d *Driver) microVMCommands() []string {
+	if !d.isMicroVM() || len(d.GuestDNS) > 0 {
+		return nil
+	}
+	servers := hostNameservers()
+	if len(servers) == 0 {
+		log.Warnf("No DNS server of the host is reachable from %s, set --qemu-guest-dns", d.MachineName)
+		return nil
+	}
+	return []string{resolvConfCommand(servers)}
+}
+
+// stopMicroVM ends the hypervisor and its helper and removes the tap device.
+func (d *Driver) stopMicroVM() error {
+	d.stopHelper("hypervisor")
+	d.stopHelper("microvm")
+	d.releaseOpenPorts()
+	return removeTap(d.tapDevice())
+}
+
+// RunMicroVM runs the lightweight hypervisor of the machine stored in
+// machineDir and forwards its ports until the guest powers off. It is run by
+// the plugin binary's microvm mode.
+func RunMicroVM(machineDir string) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	b, ok := d.backend().(microVMBackend)
+	if !ok {
+		return fmt.Errorf("%s does not use a lightweight backend", d.MachineName)
+	}
+	binary, err := b.binary(d)
+	if err != nil {
+		return err
+	}
+	cmd, err := b.vmCommand(d, binary, microVM{
+		Kernel:   d.ResolveStorePath("vmlinux"),
+		Initrd:   d.ResolveStorePath("initrd.img"),
+		Cmdline:  d.kernelCmdline(),
+		Disk:     d.Disk,
+		Tap:      d.tapDevice(),
+		MAC:      d.hostOnlyMAC(),
+		Cpus:     d.Cpus,
+		MemoryMB: d.Mem,
+	})
+	if err != nil {
+		return err
+	}
+	//Like QEMU's file chardev, kern.log only holds the last boot
+	kernLog, err := os.OpenFile(d.ResolveStorePath("kern.log"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer kernLog.Close()
+	cmd.Stdout, cmd.Stderr = kernLog, os.Stderr
+	log.Infof("Starting %s", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.ResolveStorePath("hypervisor.pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		return err
+	}
+
+	//Connections wait for the guest's address
+	var ip string
+	leased := make(chan struct{})
+	go func() {
+		for i := 0; i < 120; i++ {
+			if ip = leasedIP(hostOnlyLeases, d.hostOnlyMAC()); ip != "" {
+				close(leased)
+				return
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		log.Errorf("%s got no host-only address", d.MachineName)
+	}()
+
+	forwards := map[int]int{d.SSHPort: 22, d.EnginePort: 2376}
+	for _, port := range d.OpenPorts {
+		forwards[port] = port
+	}
+	for public, port := range forwards {
+		ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(public))
+		if err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+		defer ln.Close()
+		go func(ln net.Listener, port int) {
+			for {
+				client, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					select {
+					case <-leased:
+						proxyTo(client, net.JoinHostPort(ip, strconv.Itoa(port)))
+					case <-time.After(time.Minute):
+						client.Close()
+					}
+				}()
+			}
+		}(ln, port)
+	}
+
+	err = cmd.Wait()
+	log.Infof("%s exited: %v", binary, err)
+	os.Remove(d.ResolveStorePath("hypervisor.pid"))
+	if rerr := removeTap(d.tapDevice()); rerr != nil {
+		log.Warnf("Could not remove %s: %v", d.tapDevice(), rerr)
+	}
+	return err
+}
+
+// extractVmlinux writes the ELF kernel packed into the gzip compressed
+// bzImage to out. Neither lightweight hypervisor boots a bzImage.
+func extractVmlinux(bzImage, out string) error {
+	if in, err := os.Stat(bzImage); err == nil {
+		if extracted, err := os.Stat(out); err == nil && extracted.ModTime().After(in.ModTime()) {
+			return nil
+		}
+	}
+	data, err := ioutil.ReadFile(bzImage)
+	if err != nil {
+		return err
+	}
+	magic := []byte{0x1f, 0x8b, 0x08}
+	for i := bytes.Index(data, magic); i >= 0; {
+		if elf, err := gunzip(data[i:]); err == nil && bytes.HasPrefix(elf, []byte("\x7fELF")) {
+			return ioutil.WriteFile(out, elf, 0644)
+		}
+		next := bytes.Index(data[i+1:], magic)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return fmt.Errorf("No gzip compressed kernel found in %s, the lightweight backends need an uncompressed vmlinux", bzImage)
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	//The bzImage trails the payload, which is not an error
+	r.Multistream(false)
+	return ioutil.ReadAll(bufio.NewReader(r))
+}
+
+// cloudHypervisorBackend boots the machine with cloud-hypervisor.
+type cloudHypervisorBackend struct{}
+
+func (cloudHypervisorBackend) binary(d *Driver) (string, error) {
+	return exec.LookPath("cloud-hypervisor")
+}
+
+func (cloudHypervisorBackend) command(d *Driver, binary string, args []string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("cloud-hypervisor does not take QEMU options")
+}
+
+func (cloudHypervisorBackend) vmCommand(d *Driver, binary string, vm microVM) (*exec.Cmd, error) {
+	return exec.Command(binary,
+		"--kernel", vm.Kernel,
+		"--initramfs", vm.Initrd,
+		"--cmdline", vm.Cmdline,
+		"--cpus", fmt.Sprintf("boot=%d", vm.Cpus),
+		"--memory", fmt.Sprintf("size=%dM", vm.MemoryMB),
+		"--disk", "path="+vm.Disk,
+		"--net", fmt.Sprintf("tap=%s,mac=%s", vm.Tap, vm.MAC),
+		"--serial", "tty",
+		"--console", "off",
+	), nil
+}
+
+// firecrackerBackend boots the machine with firecracker, which has no PCI
+// bus and leaves the VM on a guest reboot.
+type firecrackerBackend struct{}
+
+func (firecrackerBackend) binary(d *Driver) (string, error) {
+	return exec.LookPath("firecracker")
+}
+
+func (firecrackerBackend) command(d *Driver, binary string, args []string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("firecracker does not take QEMU options")
+}
+
+func (firecrackerBackend) vmCommand(d *Driver, binary string, vm microVM) (*exec.Cmd, error) {
+	type drive struct {
+		DriveID      string `json:"drive_id"`
+		PathOnHost   string `json:"path_on_host"`
+		IsRootDevice bool   `json:"is_root_device"`
+		IsReadOnly   bool   `json:"is_read_only"`
+	}
+	type iface struct {
+		IfaceID     string `json:"iface_id"`
+		GuestMAC    string `json:"guest_mac"`
+		HostDevName string `json:"host_dev_name"`
+	}
+	config := struct {
+		BootSource struct {
+			KernelImagePath string `json:"kernel_image_path"`
+			InitrdPath      string `json:"initrd_path"`
+			BootArgs        string `json:"boot_args"`
+		} `json:"boot-source"`
+		Drives        []drive `json:"drives"`
+		MachineConfig struct {
+			VCPUCount  int `json:"vcpu_count"`
+			MemSizeMiB int `json:"mem_size_mib"`
+		} `json:"machine-config"`
+		NetworkInterfaces []iface `json:"network-interfaces"`
+	}{
+		Drives:            []drive{{DriveID: "disk0", PathOnHost: vm.Disk}},
+		NetworkInterfaces: []iface{{IfaceID: "eth0", GuestMAC: vm.MAC, HostDevName: vm.Tap}},
+	}
+	config.BootSource.KernelImagePath = vm.Kernel
+	config.BootSource.InitrdPath = vm.Initrd
+	config.BootSource.BootArgs = vm.Cmdline + " reboot=k panic=1 pci=off"
+	config.MachineConfig.VCPUCount = vm.Cpus
+	config.MachineConfig.MemSizeMiB = vm.MemoryMB
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	path := d.ResolveStorePath("firecracker.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	return exec.Command(binary, "--no-api", "--config-file", path), nil
+}
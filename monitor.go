@@ -0,0 +1,117 @@
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Machines created before the driver had a QMP port are only controlled
+// through the human monitor on their telnet port. It answers a command with
+// its output followed by the next prompt.
+
+const (
+	monitorPrompt  = "(qemu) "
+	monitorTimeout = 5 * time.Second
+)
+
+type monitorConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialMonitor connects to the telnet monitor and reads its greeting.
+func dialMonitor(port int) (*monitorConn, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	m := &monitorConn{conn, bufio.NewReader(conn)}
+	if _, err := m.readPrompt(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// readPrompt returns what the monitor printed before its next prompt.
+func (m *monitorConn) readPrompt() (string, error) {
+	m.SetReadDeadline(time.Now().Add(monitorTimeout))
+	var out []byte
+	for !bytes.HasSuffix(out, []byte(monitorPrompt)) {
+		b, err := m.r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("The monitor did not answer: %v", err)
+		}
+		out = append(out, b)
+	}
+	return string(out[:len(out)-len(monitorPrompt)]), nil
+}
+
+// run runs cmd and returns its output, with the echo of cmd.
+func (m *monitorConn) run(cmd string) (string, error) {
+	if _, err := fmt.Fprintf(m, "%s\n", cmd); err != nil {
+		return "", err
+	}
+	return m.readPrompt()
+}
+
+// status returns the run state named like by QMP's query-status, the
+// reason of "VM status: paused (io-error)" being the state.
+func (m *monitorConn) status() (string, error) {
+	out, err := m.run("info status")
+	if err != nil {
+		return "", err
+	}
+	i := strings.Index(out, "VM status: ")
+	if i < 0 {
+		return "", fmt.Errorf("Unexpected monitor answer to info status: %q", out)
+	}
+	status := out[i+len("VM status: "):]
+	if j := strings.IndexAny(status, "\r\n"); j >= 0 {
+		status = status[:j]
+	}
+	status = strings.TrimSpace(status)
+	if strings.HasPrefix(status, "paused (") {
+		return strings.TrimSuffix(strings.TrimPrefix(status, "paused ("), ")"), nil
+	}
+	return status, nil
+}
+
+// vmStatus returns the run state of QEMU, through the monitor for machines
+// without a QMP port.
+func (d *Driver) vmStatus() (string, error) {
+	if d.QMPPort == 0 {
+		m, err := dialMonitor(d.MonitorPort)
+		if err != nil {
+			return "", err
+		}
+		defer m.Close()
+		return m.status()
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return "", err
+	}
+	defer qmp.Close()
+	return qmp.status()
+}
+
+// controlCommand runs cmd, a command QMP and the monitor share like stop
+// and cont, through the monitor for machines without a QMP port.
+func (d *Driver) controlCommand(cmd string) error {
+	if d.QMPPort == 0 {
+		m, err := dialMonitor(d.MonitorPort)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		_, err = m.run(cmd)
+		return err
+	}
+	return d.qmpCommand(cmd)
+}
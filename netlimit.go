@@ -0,0 +1,44 @@
+package qemu
+
+import (
+	"fmt"
+)
+
+// QEMU's user network cannot throttle, so --qemu-net-rate-limit shapes the
+// guest interface with tc: uploads go through a token bucket, downloads are
+// policed, which makes TCP senders on the host side slow down as well.
+
+const guestInterface = "$(ip route show default | awk '{print $5}')"
+
+// netRateLimitCommands returns the guest commands limiting both directions
+// to the given Mbit/s.
+func (d *Driver) netRateLimitCommands() []string {
+	if d.NetRateLimit == 0 {
+		return nil
+	}
+	rate := fmt.Sprintf("%dmbit", d.NetRateLimit)
+	//A tenth of a second worth of traffic, enough for the timer resolution
+	burst := d.NetRateLimit * 12500
+	if burst < 16384 {
+		burst = 16384
+	}
+	return []string{
+		"if command -v tc >/dev/null; then",
+		"dev=" + guestInterface,
+		"tc qdisc replace dev $dev root tbf rate " + rate + fmt.Sprintf(" burst %d latency 400ms", burst),
+		"tc qdisc del dev $dev ingress 2>/dev/null",
+		"tc qdisc add dev $dev handle ffff: ingress",
+		"tc filter add dev $dev parent ffff: protocol all u32 match u32 0 0 police rate " + rate + fmt.Sprintf(" burst %d drop flowid :1", burst),
+		"else echo 'tc not found, --qemu-net-rate-limit has no effect' >&2; fi",
+	}
+}
+
+func validateNetRateLimit(d *Driver) error {
+	if d.NetRateLimit < 0 {
+		return fmt.Errorf("Invalid network rate limit %d Mbit/s", d.NetRateLimit)
+	}
+	if d.NetRateLimit != 0 && d.isWindowsGuest() {
+		return fmt.Errorf("--qemu-net-rate-limit shapes the guest with tc, which Windows guests do not have")
+	}
+	return nil
+}
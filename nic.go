@@ -0,0 +1,60 @@
+package qemu
+
+import (
+	"fmt"
+)
+
+// --qemu-network-device picks the NIC model of the user network interface
+// and, when given twice, of the host-only one. A single model applies to
+// both. Guests without virtio drivers, such as older kernels or Windows,
+// need e1000 or rtl8139.
+
+var nicModels = []string{"virtio-net", "e1000", "rtl8139"}
+
+func validateNICModels(d *Driver) error {
+	if len(d.NICModels) > 2 {
+		return fmt.Errorf("--qemu-network-device takes one model per interface, at most two")
+	}
+	for _, model := range d.NICModels {
+		if !stringIn(nicModels, model) {
+			return fmt.Errorf("Unknown network device %q, must be one of %v", model, nicModels)
+		}
+	}
+	if d.MTU != 0 && d.nicModel(0) != "virtio-net" {
+		return fmt.Errorf("--qemu-mtu needs the virtio-net network device, not %s", d.nicModel(0))
+	}
+	return nil
+}
+
+// nicModel returns the device model of interface i, 0 being the user
+// network and 1 the host-only network.
+func (d *Driver) nicModel(i int) string {
+	switch {
+	case i < len(d.NICModels):
+		return d.NICModels[i]
+	case len(d.NICModels) > 0:
+		return d.NICModels[0]
+	case d.isWindowsGuest():
+		return "e1000"
+	}
+	return "virtio-net"
+}
+
+// checkNICModels makes sure QEMU can emulate the chosen models.
+func (d *Driver) checkNICModels() error {
+	for _, model := range d.NICModels {
+		if !hasDevice(d, model) {
+			return fmt.Errorf("QEMU cannot emulate the %s network device, choose another --qemu-network-device", model)
+		}
+	}
+	return nil
+}
+
+// nicHint explains a guest that never came up on the network with the
+// missing NIC driver it most likely is.
+func (d *Driver) nicHint(err error) error {
+	if d.nicModel(0) != "virtio-net" {
+		return err
+	}
+	return fmt.Errorf("%v, if the guest kernel has no virtio-net driver it gets no address, try --qemu-network-device e1000", err)
+}
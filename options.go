@@ -0,0 +1,8 @@
+package qemu
+
+import "github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+
+// newQemuOpts starts an escaped QEMU option string, see qemucmd.Opts.
+func newQemuOpts(implied string) *qemucmd.Opts {
+	return qemucmd.NewOpts(implied)
+}
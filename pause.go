@@ -0,0 +1,88 @@
+package qemu
+
+import (
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// Pause freezes the guest CPUs, so the disk can be copied consistently from
+// the host. GetState reports the machine Paused until Unpause. Machines
+// without a QMP port are paused through their telnet monitor.
+func (d *Driver) Pause() error {
+	return d.transition("pausing", "paused", d.pause)
+}
+
+func (d *Driver) pause() error {
+	if err := d.checkPausable(); err != nil {
+		return err
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if s != state.Running {
+		return fmt.Errorf("%s is not running but %s", d.MachineName, s)
+	}
+	return d.controlCommand("stop")
+}
+
+// Unpause lets a paused guest run again.
+func (d *Driver) Unpause() error {
+	return d.transition("resuming", "running", d.unpause)
+}
+
+func (d *Driver) unpause() error {
+	if err := d.checkPausable(); err != nil {
+		return err
+	}
+	if !d.guestPaused() {
+		return fmt.Errorf("%s is not paused", d.MachineName)
+	}
+	return d.controlCommand("cont")
+}
+
+func (d *Driver) checkPausable() error {
+	if d.isMicroVM() {
+		return fmt.Errorf("The %s backend cannot pause machines", d.Backend)
+	}
+	if d.QMPPort == 0 && d.MonitorPort == 0 {
+		return fmt.Errorf("%s has neither a QMP nor a monitor port and cannot be paused, recreate it", d.MachineName)
+	}
+	return nil
+}
+
+// guestPaused reports whether the guest CPUs are stopped by Pause or the
+// sleep guard.
+func (d *Driver) guestPaused() bool {
+	if d.QMPPort == 0 && d.MonitorPort == 0 || d.isMicroVM() {
+		return false
+	}
+	status, err := d.vmStatus()
+	return err == nil && status == "paused"
+}
+
+// unpauseForStop resumes a paused guest, which cannot power itself off.
+func (d *Driver) unpauseForStop() {
+	if !d.guestPaused() {
+		return
+	}
+	log.Infof("Resuming %s to stop it", d.MachineName)
+	if err := d.controlCommand("cont"); err != nil {
+		log.Warnf("Could not resume %s: %v", d.MachineName, err)
+	}
+}
+
+// PauseMachine pauses or, with resume set, unpauses the machine stored in
+// machineDir. It is run by the plugin binary's pause and unpause modes.
+func PauseMachine(machineDir string, resume bool) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if resume {
+		return d.Unpause()
+	}
+	return d.Pause()
+}
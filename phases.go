@@ -0,0 +1,150 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// phaseHeartbeat is how often a phase that is still running says so, so
+// docker-machine create does not go silent for minutes.
+const phaseHeartbeat = 10 * time.Second
+
+// phasesKept is how many entries phases.log keeps, enough for the last
+// few creates and starts.
+const phasesKept = 500
+
+// phaseInfo is how a phase shows up in the docker-machine output: the stage
+// prefix and what it is doing, or nothing when it has nothing to do.
+type phaseInfo struct {
+	stage    string
+	describe func(d *Driver) string
+}
+
+func say(text string) func(d *Driver) string {
+	return func(d *Driver) string { return text }
+}
+
+var phaseInfos = map[string]phaseInfo{
+	"iso-copy":        {"image", say("Copying the boot image")},
+	"accel-benchmark": {"accel", say("Benchmarking accelerators")},
+	"firmware": {"firmware", func(d *Driver) string {
+		if !d.isUEFI() {
+			return ""
+		}
+		return "Creating the UEFI variable store"
+	}},
+	"keygen": {"ssh", say("Creating SSH key")},
+	"disk-key": {"disk", func(d *Driver) string {
+		if !d.DiskEncrypt {
+			return ""
+		}
+		return "Creating the disk encryption key"
+	}},
+	"disk-create": {"disk", func(d *Driver) string {
+		if d.DiskFormat == "raw" {
+			return "Writing the disk to " + d.Disk
+		}
+		return fmt.Sprintf("Creating %dMB %s disk", d.DiskSize, d.DiskFormat)
+	}},
+	"data-disk": {"disk", func(d *Driver) string {
+		if d.DataDiskSize == 0 {
+			return ""
+		}
+		return fmt.Sprintf("Creating %dMB data disk", d.DataDiskSize)
+	}},
+	"extract":     {"boot", say("Extracting the kernel")},
+	"qemu-launch": {"boot", say("Starting VM")},
+	"ssh-wait":    {"boot", say("Waiting for SSH")},
+	"host-only-lease": {"network", func(d *Driver) string {
+		if !d.HostOnly {
+			return ""
+		}
+		return "Waiting for a host-only address"
+	}},
+	"bridged-address": {"network", func(d *Driver) string {
+		if !d.isBridged() {
+			return ""
+		}
+		return "Waiting for an address on " + d.BridgeInterface
+	}},
+	"provision": {"provision", say("Configuring the guest")},
+}
+
+// progress logs a message of the running phase with its stage prefix.
+func (d *Driver) progress(format string, args ...interface{}) {
+	if d.phaseStage == "" {
+		log.Infof(format, args...)
+		return
+	}
+	log.Infof("["+d.phaseStage+"] "+format, args...)
+}
+
+// phase runs fn as the named phase of operation op. Progress is logged with
+// the phase's stage prefix, the duration is appended to phases.log in the
+// machine directory so slow or failing steps can be found after the fact.
+func (d *Driver) phase(op, name string, fn func() error) error {
+	info, known := phaseInfos[name]
+	description := ""
+	if known {
+		description = info.describe(d)
+	}
+	outer := d.phaseStage
+	d.phaseStage = info.stage
+	defer func() { d.phaseStage = outer }()
+
+	start := time.Now()
+	done := make(chan struct{})
+	if description != "" {
+		d.progress("%s...", description)
+		go func() {
+			ticker := time.NewTicker(phaseHeartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					log.Infof("[%s] %s (%s)", info.stage, description, time.Since(start).Round(time.Second))
+				}
+			}
+		}()
+	}
+	err := fn()
+	close(done)
+	elapsed := time.Since(start)
+
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	log.Debugf("%s %s finished in %s: %s", op, name, elapsed, result)
+
+	entry := fmt.Sprintf("%s\t%s\t%s\t%s\t%s", start.Format(time.RFC3339), op, name, elapsed, result)
+	if ferr := d.recordPhase(entry); ferr != nil {
+		log.Debugf("Could not record phase %s: %v", name, ferr)
+	}
+	return err
+}
+
+// recordPhase appends entry to phases.log, keeping the last phasesKept
+// entries.
+func (d *Driver) recordPhase(entry string) error {
+	path := d.ResolveStorePath("phases.log")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries := append(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), entry)
+	if entries[0] == "" {
+		entries = entries[1:]
+	}
+	if len(entries) > phasesKept {
+		entries = entries[len(entries)-phasesKept:]
+	}
+	return writeFileAtomic(path, []byte(strings.Join(entries, "\n")+"\n"), 0644)
+}
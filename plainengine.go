@@ -0,0 +1,146 @@
+package qemu
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// With --qemu-expose-plain-engine a helper process serves the engine API
+// without TLS on a localhost port, for tools that cannot do TLS, next to the
+// usual TLS endpoint. The helper connects to the TLS endpoint with the
+// machine's client certificate, so the guest engine keeps its docker-machine
+// configuration, which the provisioner rewrites during create anyway. Any
+// local user can control the engine through the port.
+
+// plainEnginePort is the conventional port of the plaintext engine API.
+const plainEnginePort = 2375
+
+// choosePlainEnginePort takes 2375 when it is free, else any free port.
+func (d *Driver) choosePlainEnginePort() error {
+	if ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(plainEnginePort)); err == nil {
+		ln.Close()
+		d.PlainEnginePort = plainEnginePort
+		return nil
+	}
+	port, err := getTCPPort(d)
+	if err != nil {
+		return err
+	}
+	d.PlainEnginePort = port
+	return nil
+}
+
+// startPlainEngine starts "docker-machine-driver-qemu plain-engine" for the
+// machine in the background.
+func (d *Driver) startPlainEngine() error {
+	if !d.PlainEngine {
+		return nil
+	}
+	d.stopHelper("plainengine")
+	if err := d.spawnHelper("plain-engine", "plainengine"); err != nil {
+		return err
+	}
+	log.Warnf("INSECURE: the engine of %s is served without TLS or authentication on tcp://127.0.0.1:%d, any local user can control it",
+		d.MachineName, d.PlainEnginePort)
+	return nil
+}
+
+// engineAddr is the TLS endpoint of the engine, as in the machine's URL.
+func (d *Driver) engineAddr() string {
+	if d.HostOnly && d.HostOnlyIP != "" {
+		return net.JoinHostPort(d.HostOnlyIP, "2376")
+	}
+	if d.isBridged() && d.BridgedIP != "" {
+		return net.JoinHostPort(d.BridgedIP, "2376")
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(d.EnginePort))
+}
+
+// engineTLSConfig authenticates to the engine with the client certificate
+// docker-machine copies into the machine directory when it provisions it.
+func (d *Driver) engineTLSConfig(host string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(d.ResolveStorePath("ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No CA certificate in %s", d.ResolveStorePath("ca.pem"))
+	}
+	cert, err := tls.LoadX509KeyPair(d.ResolveStorePath("cert.pem"), d.ResolveStorePath("key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, ServerName: host}, nil
+}
+
+// ServePlainEngine forwards the plaintext engine port of the machine stored
+// in machineDir to its TLS endpoint until the process is killed. It is run
+// by the plugin binary's plain-engine mode.
+func ServePlainEngine(machineDir string) error {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(d.PlainEnginePort))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go servePlainEngineConn(machineDir, client)
+	}
+}
+
+// servePlainEngineConn relays one client. The config and certificates are
+// read for every connection, they are written after the helper starts on
+// create and change with regenerate-certs.
+func servePlainEngineConn(machineDir string, client net.Conn) {
+	defer client.Close()
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		log.Errorf("Could not read the machine in %s: %v", machineDir, err)
+		return
+	}
+	addr := d.engineAddr()
+	host, _, _ := net.SplitHostPort(addr)
+	config, err := d.engineTLSConfig(host)
+	if err != nil {
+		log.Errorf("Could not load the client certificate of %s: %v", d.MachineName, err)
+		return
+	}
+	engine, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		log.Errorf("Could not connect to the engine of %s: %v", d.MachineName, err)
+		return
+	}
+	defer engine.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(engine, client)
+		engine.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, engine)
+		if c, ok := client.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
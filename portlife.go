@@ -0,0 +1,122 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The host ports of a machine are chosen free when it is created and kept
+// while it is stopped, so another program or machine may have taken them
+// by the next start. Every start checks them first and moves the taken
+// ones to free ports, saving the config before QEMU or a helper reads it.
+// Ports the user gave are not moved.
+
+// hostPort is a host port of the machine the driver listens on or forwards.
+type hostPort struct {
+	name   string
+	port   *int
+	pinned bool
+}
+
+// hostPorts lists the host ports of the machine that are set.
+func (d *Driver) hostPorts() []hostPort {
+	ports := []hostPort{
+		{"SSH", &d.SSHPort, false},
+		{"engine", &d.EnginePort, false},
+		{"QMP", &d.QMPPort, false},
+		{"monitor", &d.MonitorPort, true},
+		{"guest channel", &d.ChannelPort, false},
+		{"plaintext engine", &d.PlainEnginePort, false},
+	}
+	if d.LazyStart {
+		ports = append(ports,
+			hostPort{"backend SSH", &d.BackendSSHPort, false},
+			hostPort{"backend engine", &d.BackendEnginePort, false})
+	}
+	var set []hostPort
+	for _, p := range ports {
+		if *p.port != 0 {
+			set = append(set, p)
+		}
+	}
+	return set
+}
+
+// portFree reports whether port can be listened on at 127.0.0.1, where the
+// forwards and helpers listen.
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp4", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// reallocatePorts moves the host ports of the stopped machine that are in
+// use to free ones and saves the config when one moved.
+func (d *Driver) reallocatePorts() error {
+	if d.LazyStart && d.helperAlive("supervisor") {
+		return nil
+	}
+	//A plaintext engine helper left by a crash holds its port, it is
+	//started again anyway
+	d.stopHelper("plainengine")
+
+	used := map[int]bool{}
+	for _, p := range d.hostPorts() {
+		used[*p.port] = true
+	}
+	moved := false
+	for _, p := range d.hostPorts() {
+		if portFree(*p.port) {
+			continue
+		}
+		if p.pinned {
+			return fmt.Errorf("The %s port %d of %s is in use by another program", p.name, *p.port, d.MachineName)
+		}
+		port, err := d.freePort(used)
+		if err != nil {
+			return err
+		}
+		log.Infof("The %s port %d of %s is in use, moving it to %d", p.name, *p.port, d.MachineName, port)
+		*p.port = port
+		used[port] = true
+		moved = true
+	}
+	if !moved {
+		return nil
+	}
+	return d.saveConfig()
+}
+
+// freePort allocates a port none of the machine's ports use.
+func (d *Driver) freePort(used map[int]bool) (int, error) {
+	for i := 0; i < 10; i++ {
+		port, err := getTCPPort(d)
+		if err != nil {
+			return 0, err
+		}
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("Could not allocate a free port for %s", d.MachineName)
+}
+
+// helperAlive reports whether the helper process started as name runs. The
+// helpers run the plugin binary, whose name passes the check for QEMU of
+// processAlive on Linux.
+func (d *Driver) helperAlive(name string) bool {
+	data, err := ioutil.ReadFile(d.ResolveStorePath(name + ".pid"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && processAlive(pid)
+}
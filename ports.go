@@ -0,0 +1,207 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxOpenPorts caps the --qemu-open-ports forwards. QEMU's user network
+// opens a host socket per forward while starting, a range of thousands of
+// ports runs it out of descriptors or stalls it before the monitor answers.
+const maxOpenPorts = 1024
+
+// parseOpenPorts expands the --qemu-open-ports entries into sorted TCP and
+// UDP ports. An entry is a port or a start-end range, optionally followed
+// by /tcp or /udp, TCP when missing. Overlapping entries are merged.
+func parseOpenPorts(specs []string) ([]int, []int, error) {
+	tcp, udp := map[int]bool{}, map[int]bool{}
+	for _, v := range specs {
+		spec := strings.TrimSpace(v)
+		ports := tcp
+		if i := strings.LastIndex(spec, "/"); i >= 0 {
+			switch strings.ToLower(spec[i+1:]) {
+			case "tcp":
+			case "udp":
+				ports = udp
+			default:
+				return nil, nil, fmt.Errorf("defined port \"%s\" has an unknown protocol, must be tcp or udp", v)
+			}
+			spec = spec[:i]
+		}
+		s := strings.Split(spec, "-")
+		if len(s) > 2 {
+			return nil, nil, fmt.Errorf("defined port or range \"%s\" is not valid", v)
+		}
+		start, err := strconv.ParseUint(s[0], 10, 16)
+		if err != nil || start == 0 {
+			return nil, nil, fmt.Errorf("defined port \"%s\" is not valid", v)
+		}
+		stop := start
+		if len(s) == 2 {
+			if stop, err = strconv.ParseUint(s[1], 10, 16); err != nil || stop < start {
+				return nil, nil, fmt.Errorf("defined port range \"%s\" is not valid", v)
+			}
+		}
+		if stop-start >= maxOpenPorts {
+			return nil, nil, fmt.Errorf("defined port range \"%s\" has %d ports, QEMU cannot forward more than %d", v, stop-start+1, maxOpenPorts)
+		}
+		for i := start; i <= stop; i++ {
+			ports[int(i)] = true
+		}
+	}
+	if n := len(tcp) + len(udp); n > maxOpenPorts {
+		return nil, nil, fmt.Errorf("--qemu-open-ports forwards %d ports, QEMU cannot forward more than %d", n, maxOpenPorts)
+	}
+	return sortedPorts(tcp), sortedPorts(udp), nil
+}
+
+func sortedPorts(set map[int]bool) []int {
+	var ports []int
+	for p := range set {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// portClaim is the registry key of a forward, the port alone for TCP as
+// before UDP forwards existed.
+func portClaim(port int, protocol string) string {
+	if protocol == "udp" {
+		return strconv.Itoa(port) + "/udp"
+	}
+	return strconv.Itoa(port)
+}
+
+// claimKeys lists the registry keys of the machine's forwards.
+func (d *Driver) claimKeys() []string {
+	var keys []string
+	for _, port := range d.OpenPorts {
+		keys = append(keys, portClaim(port, "tcp"))
+	}
+	for _, port := range d.OpenUDPPorts {
+		keys = append(keys, portClaim(port, "udp"))
+	}
+	return keys
+}
+
+// The --qemu-open-ports forwards of all QEMU machines are claimed in
+// qemu-ports.json in the store, so a machine forwarding a port another
+// running machine already forwards fails to start with a clear error
+// instead of fighting over it. Claims of machines that are no longer
+// running are taken over.
+
+func (d *Driver) portClaimsPath() string {
+	return filepath.Join(d.StorePath, "qemu-ports.json")
+}
+
+// updatePortClaims runs fn on the claims, mapping ports to machine names,
+// under a lock and saves them.
+func (d *Driver) updatePortClaims(fn func(claims map[string]string) error) error {
+	path := d.portClaimsPath()
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	claims := map[string]string{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return fmt.Errorf("Invalid port registry %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fn(claims); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// claimOpenPorts records the machine's open ports, failing when a running
+// machine holds one of them.
+func (d *Driver) claimOpenPorts() error {
+	return d.updatePortClaims(func(claims map[string]string) error {
+		var conflicts []string
+		for _, key := range d.claimKeys() {
+			owner, ok := claims[key]
+			if ok && owner != d.MachineName && d.machineRunning(owner) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%s)", key, owner))
+			}
+		}
+		if len(conflicts) > 0 {
+			sort.Strings(conflicts)
+			return fmt.Errorf("Ports already forwarded by other machines: %v, stop them or change --qemu-open-ports of %s", conflicts, d.MachineName)
+		}
+		dropClaims(claims, d.MachineName)
+		for _, key := range d.claimKeys() {
+			claims[key] = d.MachineName
+		}
+		return nil
+	})
+}
+
+// releaseOpenPorts drops the machine's claims.
+func (d *Driver) releaseOpenPorts() error {
+	if _, err := os.Stat(d.portClaimsPath()); os.IsNotExist(err) {
+		return nil
+	}
+	return d.updatePortClaims(func(claims map[string]string) error {
+		dropClaims(claims, d.MachineName)
+		return nil
+	})
+}
+
+func dropClaims(claims map[string]string, machine string) {
+	for port, owner := range claims {
+		if owner == machine {
+			delete(claims, port)
+		}
+	}
+}
+
+// machineRunning reports whether the named machine of the store still
+// runs QEMU or its supervisor.
+func (d *Driver) machineRunning(name string) bool {
+	m, err := loadDriver(filepath.Join(d.StorePath, "machines", name))
+	if err != nil {
+		return false
+	}
+	if m.LazyStart && m.supervisorRunning() {
+		return true
+	}
+	return m.qemuRunning()
+}
+
+// lockFile takes the lock file at path, waiting for up to five seconds for
+// another process to release it. Locks older than a minute are stale.
+func lockFile(path string) (func(), error) {
+	for i := 0; i < 50; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > time.Minute {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("Could not lock %s", path)
+}
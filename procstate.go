@@ -0,0 +1,68 @@
+package qemu
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// GetState goes by the QEMU process named in qemu.pid rather than by
+// whether something listens on the SSH port, which another program may
+// have taken while the machine was stopped. The PID file is removed once
+// QEMU exited on Stop or Kill, so a PID file naming a dead process means
+// QEMU was killed or crashed behind the driver's back.
+
+// processState returns the machine state from QEMU's PID file. ok is false
+// when the ports have to be probed, for machines without a PID file that
+// QEMU still answers for, started before PID files were written, and for
+// the backends and lazy starts that have no QEMU process of their own.
+func (d *Driver) processState() (s state.State, ok bool) {
+	if d.isMicroVM() || d.LazyStart {
+		return state.None, false
+	}
+	pid, err := d.readPid()
+	if os.IsNotExist(err) {
+		if d.qemuAnswers() {
+			return state.None, false
+		}
+		return state.Stopped, true
+	}
+	if err != nil {
+		log.Debugf("Could not read %s: %v", d.pidFile(), err)
+		return state.None, false
+	}
+
+	if !processAlive(pid) {
+		if s, crashed := d.checkCrashed(); crashed {
+			return s, true
+		}
+		log.Warnf("QEMU of %s (PID %d) is gone but its PID file is left, it was killed or crashed, see %s",
+			d.MachineName, pid, d.ResolveStorePath("qemu.log"))
+		d.recordState("crashed")
+		return state.Error, true
+	}
+	sshconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.SSHPort))
+	if err == nil {
+		sshconn.Close()
+		return state.Running, true
+	}
+	if s, crashed := d.checkCrashed(); crashed {
+		return s, true
+	}
+	return state.Starting, true
+}
+
+// awaitExit waits for up to the kill timeout for QEMU to exit and removes
+// its PID file, which not every QEMU version does, so the stop is not taken
+// for a crash. It reports whether QEMU exited.
+func (d *Driver) awaitExit() bool {
+	if !waitUntil(d.killTimeout(), d.qemuExited) {
+		log.Debugf("QEMU of %s is still running", d.MachineName)
+		return false
+	}
+	os.Remove(d.pidFile())
+	return true
+}
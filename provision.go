@@ -0,0 +1,119 @@
+package qemu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/drivers"
+)
+
+// provision applies the driver specific guest configuration once the
+// machine is reachable over SSH. Anything that has to survive a reboot is
+// replayed by the guest provisioner on every boot.
+func (d *Driver) provision() error {
+	if err := drivers.WaitForSSH(d); err != nil {
+		if herr := checkForwardInterference(d); herr != nil {
+			return herr
+		}
+		return d.nicHint(err)
+	}
+
+	p := d.provisioner()
+	if err := p.ready(d); err != nil {
+		return err
+	}
+	boot, err := d.startGuestChannel(p)
+	if err != nil {
+		return err
+	}
+
+	//The data disk has to be mounted before anything is written to it
+	boot = append(boot, d.dataDiskCommands(p)...)
+	boot = append(boot, d.microVMCommands()...)
+	boot = append(boot, d.guestDNSCommands()...)
+	boot = append(boot, d.engineSSHCommands()...)
+
+	if d.MTU != 0 {
+		d.progress("Setting guest MTU to %d...", d.MTU)
+		boot = append(boot, fmt.Sprintf("ip link set dev %s mtu %d", guestInterface, d.MTU))
+	}
+	if d.NetRateLimit != 0 {
+		d.progress("Limiting the guest network to %d Mbit/s...", d.NetRateLimit)
+		boot = append(boot, d.netRateLimitCommands()...)
+	}
+
+	daemonJSON, err := d.daemonJSON()
+	if err != nil {
+		return err
+	}
+	if daemonJSON != nil {
+		d.progress("Configuring docker daemon.json...")
+		persisted := p.persistDir() + "/daemon.json"
+		if err := writeGuestFile(d, persisted, daemonJSON); err != nil {
+			return err
+		}
+		boot = append(boot,
+			"mkdir -p /etc/docker",
+			fmt.Sprintf("cp %s /etc/docker/daemon.json", persisted),
+			p.restartDocker())
+	}
+
+	if len(boot) == 0 {
+		return nil
+	}
+	return p.persist(d, boot)
+}
+
+// daemonJSON builds the guest daemon.json from --qemu-daemon-json,
+// --qemu-registry-mirror, --qemu-storage-driver and --qemu-mtu. It returns nil when none was
+// given.
+func (d *Driver) daemonJSON() ([]byte, error) {
+	if d.DaemonJSON == "" && len(d.RegistryMirrors) == 0 && d.MTU == 0 && d.StorageDriver == "" {
+		return nil, nil
+	}
+
+	config := map[string]interface{}{}
+	if d.DaemonJSON != "" {
+		data, err := ioutil.ReadFile(d.DaemonJSON)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("Invalid daemon.json %s: %v", d.DaemonJSON, err)
+		}
+	}
+	if len(d.RegistryMirrors) > 0 {
+		var mirrors []interface{}
+		if existing, ok := config["registry-mirrors"].([]interface{}); ok {
+			mirrors = existing
+		}
+		for _, m := range d.RegistryMirrors {
+			mirrors = append(mirrors, m)
+		}
+		config["registry-mirrors"] = mirrors
+	}
+	if d.StorageDriver != "" {
+		config["storage-driver"] = d.StorageDriver
+	}
+	if d.MTU != 0 {
+		//Containers have to use the same MTU as the guest interface
+		config["mtu"] = d.MTU
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// writeGuestFile copies data to path inside the guest, creating its
+// directory, over the guest channel when it is up. Over SSH the content is
+// sent base64 encoded so it does not need any shell quoting.
+func writeGuestFile(d *Driver, path string, data []byte) error {
+	if d.channelUp {
+		return d.PushGuestFile(path, 0644, data)
+	}
+	cmd := fmt.Sprintf("sudo mkdir -p %s && echo %s | base64 -d | sudo tee %s > /dev/null",
+		filepath.ToSlash(filepath.Dir(path)), base64.StdEncoding.EncodeToString(data), path)
+	_, err := drivers.RunSSHCommandFromDriver(d, cmd)
+	return err
+}
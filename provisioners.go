@@ -0,0 +1,376 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// guestProvisioner adapts the driver to one family of guest images. It
+// decides who docker-machine logs in as, how the SSH key gets into the
+// guest, how the guest boots and how settings survive a reboot.
+type guestProvisioner interface {
+	// imageFile is the name of the guest image in the machine directory.
+	imageFile() string
+	// sshUser is the account docker-machine logs into the guest as.
+	sshUser(d *Driver) string
+	// createDisk builds the root disk at d.Disk with the SSH key injected.
+	createDisk(d *Driver) error
+	// bootArgs returns the QEMU arguments booting the guest.
+	bootArgs(d *Driver) ([]string, error)
+	// ready waits for the guest's own first boot setup to finish.
+	ready(d *Driver) error
+	// persistDir is a guest directory that survives reboots.
+	persistDir() string
+	// restartDocker is the guest command restarting the engine.
+	restartDocker() string
+	// persist runs the shell commands now and on every later boot.
+	persist(d *Driver, commands []string) error
+}
+
+var provisioners = map[string]guestProvisioner{
+	"boot2docker": boot2dockerProvisioner{},
+	"cloud-init":  cloudInitProvisioner{},
+	"ignition":    ignitionProvisioner{},
+	"custom":      customProvisioner{},
+}
+
+func validateProvisioner(name string) error {
+	if _, ok := provisioners[name]; name != "" && !ok {
+		return fmt.Errorf("Unknown provisioner %q, must be one of boot2docker, cloud-init, ignition or custom", name)
+	}
+	return nil
+}
+
+// checkProvisionScript makes sure the custom provisioner has a script it
+// can run, before create copies images and writes disks.
+func (d *Driver) checkProvisionScript() error {
+	if d.Provisioner != "custom" {
+		return nil
+	}
+	if d.ProvisionScript == "" {
+		return fmt.Errorf("The custom provisioner needs --qemu-provision-script")
+	}
+	if _, err := exec.LookPath(d.ProvisionScript); err != nil {
+		return fmt.Errorf("Provision script %s cannot be run: %v", d.ProvisionScript, err)
+	}
+	return nil
+}
+
+// provisioner returns the machine's guest provisioner. Machines created
+// before provisioners were pluggable are boot2docker.
+func (d *Driver) provisioner() guestProvisioner {
+	if p, ok := provisioners[d.Provisioner]; ok {
+		return p
+	}
+	return provisioners["boot2docker"]
+}
+
+// detectProvisioner picks a provisioner from the image content: an ISO is
+// expected to be boot2docker, a disk image to use cloud-init.
+func detectProvisioner(image string) (string, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	if _, err := f.ReadAt(magic, 16*isoSector+1); err == nil && string(magic) == "CD001" {
+		return "boot2docker", nil
+	}
+	return "cloud-init", nil
+}
+
+type boot2dockerProvisioner struct{}
+
+func (boot2dockerProvisioner) imageFile() string { return "boot2docker.iso" }
+
+func (boot2dockerProvisioner) sshUser(d *Driver) string { return "docker" }
+
+func (boot2dockerProvisioner) createDisk(d *Driver) error {
+	gen, err := d.tmpPath("disk.raw")
+	if err != nil {
+		return err
+	}
+	if err := createRawDisk(gen, d.GetSSHKeyPath()+".pub"); err != nil {
+		return err
+	}
+	return d.phase("create", "convert", func() error {
+		return convertDisk(d, gen, d.Disk)
+	})
+}
+
+func (boot2dockerProvisioner) bootArgs(d *Driver) ([]string, error) {
+	err := d.phase("start", "extract", func() error {
+		return extractKernel(d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"-boot", "d",
+		"-kernel", qemuPath(d.ResolveStorePath("vmlinuz64")),
+		"-initrd", qemuPath(d.ResolveStorePath("initrd.img")),
+		"-append", d.kernelCmdline(),
+	}, nil
+}
+
+func (boot2dockerProvisioner) ready(d *Driver) error { return nil }
+
+func (boot2dockerProvisioner) persistDir() string { return "/var/lib/boot2docker" }
+
+func (boot2dockerProvisioner) restartDocker() string { return "/etc/init.d/docker restart" }
+
+// persist keeps the commands in bootlocal.sh, which boot2docker runs from
+// its data disk on every boot.
+func (p boot2dockerProvisioner) persist(d *Driver, commands []string) error {
+	bootlocal := p.persistDir() + "/bootlocal.sh"
+	script := "#!/bin/sh\n" + strings.Join(commands, "\n") + "\n"
+	if err := writeGuestFile(d, bootlocal, []byte(script)); err != nil {
+		return err
+	}
+	_, err := drivers.RunSSHCommandFromDriver(d, "sudo sh "+bootlocal)
+	return err
+}
+
+// Disk image based guests keep the driver's boot commands in a systemd unit
+// ordered before the engine.
+const (
+	systemdPersistDir = "/var/lib/docker-machine-qemu"
+	systemdUnit       = `[Unit]
+Description=docker-machine QEMU guest settings
+Before=docker.service
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh ` + systemdPersistDir + `/boot.sh
+
+[Install]
+WantedBy=multi-user.target
+`
+)
+
+type systemdPersistence struct{}
+
+func (systemdPersistence) persistDir() string { return systemdPersistDir }
+
+// restartDocker leaves guests alone that get the engine installed later by
+// the docker-machine provisioner.
+func (systemdPersistence) restartDocker() string {
+	return "if systemctl cat docker.service >/dev/null 2>&1; then systemctl try-restart docker; fi"
+}
+
+func (systemdPersistence) persist(d *Driver, commands []string) error {
+	script := "#!/bin/sh\n" + strings.Join(commands, "\n") + "\n"
+	if err := writeGuestFile(d, systemdPersistDir+"/boot.sh", []byte(script)); err != nil {
+		return err
+	}
+	if err := writeGuestFile(d, "/etc/systemd/system/docker-machine-qemu.service", []byte(systemdUnit)); err != nil {
+		return err
+	}
+	_, err := drivers.RunSSHCommandFromDriver(d, "sudo systemctl daemon-reload && sudo systemctl enable docker-machine-qemu && sudo systemctl start docker-machine-qemu")
+	return err
+}
+
+// createDiskFromImage copies the guest disk image into the machine disk and
+// grows it to the requested size.
+func createDiskFromImage(d *Driver, image string) error {
+	qemuImg, err := getQemuImgCommand(d)
+	if err != nil {
+		return err
+	}
+	secret, cleanup, err := d.diskSecretArgs()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args := append([]string{"convert"}, secret...)
+	args = append(args, "-O", d.DiskFormat)
+	args = append(args, d.encryptCreateArgs()...)
+	args = append(args, image, d.Disk)
+	if d.DiskFormat == "raw" {
+		args = []string{"convert", "-n", "-O", "raw", image, d.Disk}
+	}
+	if out, err := exec.Command(qemuImg, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-img convert failed: %v: %s", err, out)
+	}
+	if d.DiskFormat == "raw" {
+		return nil
+	}
+
+	opened, err := d.diskImageArgs()
+	if err != nil {
+		return err
+	}
+	infoArgs := append([]string{"info", "--output=json"}, secret...)
+	out, err := exec.Command(qemuImg, append(infoArgs, opened...)...).Output()
+	if err != nil {
+		return err
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return err
+	}
+	if int64(d.DiskSize)<<20 <= info.VirtualSize {
+		return nil
+	}
+	resizeArgs, err := d.resizeArgs(secret, fmt.Sprintf("%dM", d.DiskSize))
+	if err != nil {
+		return err
+	}
+	return exec.Command(qemuImg, resizeArgs...).Run()
+}
+
+func diskBootArgs(d *Driver) []string {
+	return []string{"-boot", "c"}
+}
+
+type cloudInitProvisioner struct{ systemdPersistence }
+
+func (cloudInitProvisioner) imageFile() string { return "base.img" }
+
+func (cloudInitProvisioner) sshUser(d *Driver) string { return "docker" }
+
+func (p cloudInitProvisioner) createDisk(d *Driver) error {
+	if err := createDiskFromImage(d, d.ResolveStorePath(p.imageFile())); err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return err
+	}
+	userData := fmt.Sprintf(`#cloud-config
+users:
+  - name: %s
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/sh
+    ssh_authorized_keys:
+      - %s
+`, p.sshUser(d), strings.TrimSpace(string(key)))
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", d.MachineName, d.guestHostname())
+	return writeSeedISO(d.ResolveStorePath("seed.iso"), "cidata", map[string][]byte{
+		"user-data": []byte(userData),
+		"meta-data": []byte(metaData),
+	})
+}
+
+func (cloudInitProvisioner) bootArgs(d *Driver) ([]string, error) {
+	seed, err := qemucmd.Drive{
+		File:     qemuPath(d.ResolveStorePath("seed.iso")),
+		Media:    "cdrom",
+		ReadOnly: true,
+	}.Build()
+	if err != nil {
+		return nil, err
+	}
+	return append(diskBootArgs(d), "-drive", seed), nil
+}
+
+// ready waits for cloud-init to finish, so the packages it installs do not
+// hold the package manager lock when docker-machine installs the engine.
+func (cloudInitProvisioner) ready(d *Driver) error {
+	out, err := drivers.RunSSHCommandFromDriver(d, "sudo cloud-init status --wait || true")
+	if strings.Contains(out, "error") {
+		log.Warnf("cloud-init reported errors in %s: %s", d.MachineName, strings.TrimSpace(out))
+	}
+	return err
+}
+
+type ignitionProvisioner struct{ systemdPersistence }
+
+func (ignitionProvisioner) imageFile() string { return "base.img" }
+
+func (ignitionProvisioner) sshUser(d *Driver) string { return "core" }
+
+func (p ignitionProvisioner) createDisk(d *Driver) error {
+	if err := createDiskFromImage(d, d.ResolveStorePath(p.imageFile())); err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return err
+	}
+	config := map[string]interface{}{
+		"ignition": map[string]string{"version": "3.3.0"},
+		"passwd": map[string]interface{}{
+			"users": []map[string]interface{}{{
+				"name":              p.sshUser(d),
+				"sshAuthorizedKeys": []string{strings.TrimSpace(string(key))},
+			}},
+		},
+		"storage": map[string]interface{}{
+			"files": []map[string]interface{}{{
+				"path":     "/etc/hostname",
+				"mode":     0644,
+				"contents": map[string]string{"source": "data:," + d.guestHostname()},
+			}},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ResolveStorePath("config.ign"), data, 0644)
+}
+
+// bootArgs hands the Ignition config to the guest through fw_cfg, where
+// Ignition looks for it on QEMU.
+func (ignitionProvisioner) bootArgs(d *Driver) ([]string, error) {
+	fwcfg, err := newQemuOpts("").
+		Set("name", "opt/com.coreos/config").
+		Set("file", qemuPath(d.ResolveStorePath("config.ign"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	return append(diskBootArgs(d), "-fw_cfg", fwcfg), nil
+}
+
+func (ignitionProvisioner) ready(d *Driver) error { return nil }
+
+// customProvisioner boots a disk image and leaves key injection to a host
+// script given with --qemu-provision-script.
+type customProvisioner struct{ systemdPersistence }
+
+func (customProvisioner) imageFile() string { return "base.img" }
+
+func (customProvisioner) sshUser(d *Driver) string {
+	if d.ProvisionUser != "" {
+		return d.ProvisionUser
+	}
+	return "docker"
+}
+
+func (p customProvisioner) createDisk(d *Driver) error {
+	if err := createDiskFromImage(d, d.ResolveStorePath(p.imageFile())); err != nil {
+		return err
+	}
+	cmd := exec.Command(d.ProvisionScript)
+	cmd.Env = append(os.Environ(),
+		"QEMU_MACHINE_NAME="+d.MachineName,
+		"QEMU_STORE_PATH="+d.ResolveStorePath("."),
+		"QEMU_DISK="+d.Disk,
+		"QEMU_DISK_FORMAT="+d.DiskFormat,
+		"QEMU_SSH_USER="+p.sshUser(d),
+		"QEMU_GUEST_HOSTNAME="+d.guestHostname(),
+		"QEMU_SSH_PUBLIC_KEY="+d.GetSSHKeyPath()+".pub")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Provision script %s failed: %v: %s", d.ProvisionScript, err, out)
+	}
+	return nil
+}
+
+func (customProvisioner) bootArgs(d *Driver) ([]string, error) {
+	return diskBootArgs(d), nil
+}
+
+func (customProvisioner) ready(d *Driver) error { return nil }
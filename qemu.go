@@ -1,13 +1,13 @@
 package qemu
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,14 +18,17 @@ import (
 	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
 	"github.com/qeedquan/iso9660"
 )
 
 //Driver driver struct
 type Driver struct {
 	*drivers.BaseDriver
+	ConfigVersion int
 
 	MonitorPort    int
+	QMPPort        int
 	Disk           string
 	DiskSize       int
 	Cpus           int
@@ -34,6 +37,102 @@ type Driver struct {
 	EnginePort     int
 	OpenPorts      []int
 	Boot2DockerURL string
+
+	RegistryMirrors []string
+	DaemonJSON      string
+	Arch            string
+	FastBoot        bool
+	GuestChannel    bool
+	ChannelPort     int
+	MaxCpus         int
+	MaxMem          int
+	Balloon         bool
+	BalloonMin      int
+	DiskWError      string
+	DiskRError      string
+	DiskPath        string
+	DiskFormat      string
+	KeepDisk        bool
+	Image           string
+	ImageCatalog    string
+	ImageName       string
+	ImageVersion    string
+	ImageURL        string
+	ImageSHA256     string
+	Provisioner     string
+	ProvisionScript string
+	ProvisionUser   string
+
+	QemuBinary        string
+	QemuBinaryVersion string
+	Accel             string
+	AccelBenchmark    bool
+	MTU               int
+	LazyStart         bool
+	BackendSSHPort    int
+	BackendEnginePort int
+	RTC               string
+	RTCDriftFix       string
+	Keyboard          string
+	MemMerge          string
+	THP               string
+	Firmware          string
+	OVMFCode          string
+	OVMFVars          string
+
+	Confidential       string
+	SEVPolicy          string
+	SEVCBitPos         int
+	SEVReducedPhysBits int
+	Mdevs              []string
+	MdevUUIDs          []string
+	Audio              string
+	SleepGuard         bool
+	CgroupScope        bool
+	CgroupMemory       int
+	CgroupCPU          int
+	CacheDir           string
+	SMBIOSUUID         string
+	SMBIOSSerial       string
+	SMBIOSAssetTag     string
+	GuestOS            string
+	Console            string
+	Labels             map[string]string
+	Expiry             time.Time
+	OnReady            string
+	OnStop             string
+	phaseStage         string
+	effectiveAccel     string
+	supervising        bool
+	removing           bool
+	channelUp          bool
+	DiskEncrypt        bool
+	SecretStore        string
+	NetRateLimit       int
+	HostOnly           bool
+	HostOnlyIP         string
+	NICModels          []string
+	DataDiskSize       int
+	DataDiskFS         string
+	StorageDriver      string
+	DNSName            bool
+	Hostname           string
+	SkipISOUpdate      bool
+	ISOMaxAge          time.Duration
+	Backend            string
+	EngineSSH          bool
+	GuestSubnet        string
+	GuestDNS           []string
+	RequireAccel       bool
+	OpenUDPPorts       []int
+	PlainEngine        bool
+	PlainEnginePort    int
+	ShutdownTimeout    time.Duration
+	KillTimeout        time.Duration
+	Network            string
+	BridgeInterface    string
+	BridgedIP          string
+	BridgedMAC         string
 }
 
 //DriverName name
@@ -43,7 +142,7 @@ func (d *Driver) DriverName() string {
 
 //GetCreateFlags Create flags
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
-	return []mcnflag.Flag{
+	flags := []mcnflag.Flag{
 		mcnflag.IntFlag{
 			Name:   "qemu-memory",
 			EnvVar: "QEMU_MEMORY_SIZE",
@@ -56,6 +155,28 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Size of disk in MB",
 			Value:  18000,
 		},
+		mcnflag.StringFlag{
+			Name:   "qemu-disk-path",
+			EnvVar: "QEMU_DISK_PATH",
+			Usage:  "Directory or raw block device to hold the disk instead of the machine store",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-keep-disk",
+			EnvVar: "QEMU_KEEP_DISK",
+			Usage:  "Keep a disk stored in --qemu-disk-path when the machine is removed",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-disk-werror",
+			EnvVar: "QEMU_DISK_WERROR",
+			Usage:  "Action on disk write errors: enospc, stop, report or ignore",
+			Value:  "enospc",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-disk-rerror",
+			EnvVar: "QEMU_DISK_RERROR",
+			Usage:  "Action on disk read errors: stop, report or ignore",
+			Value:  "report",
+		},
 		mcnflag.IntFlag{
 			Name:   "qemu-cpu-count",
 			EnvVar: "QEMU_CPU_COUNT",
@@ -63,36 +184,395 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Value:  2,
 		},
 		mcnflag.IntFlag{
-			Name:  "qemu-monitor-port",
-			Usage: "Port which Qemu monitor will be opened on.",
+			Name:   "qemu-max-cpus",
+			EnvVar: "QEMU_MAX_CPUS",
+			Usage:  "Number of CPUs the running machine can be grown to with hotplug",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-max-memory",
+			EnvVar: "QEMU_MAX_MEMORY",
+			Usage:  "Size of memory in MB the running machine can be grown to with hotplug",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-balloon",
+			EnvVar: "QEMU_BALLOON",
+			Usage:  "Add a memory balloon so unused guest memory can be returned to the host",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-balloon-min",
+			EnvVar: "QEMU_BALLOON_MIN",
+			Usage:  "Size of memory in MB the balloon never shrinks the guest below",
+			Value:  512,
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-monitor-port",
+			EnvVar: "QEMU_MONITOR_PORT",
+			Usage:  "Port of a telnet monitor for debugging, the driver controls QEMU over QMP",
 		},
 		mcnflag.StringFlag{
 			EnvVar: "QEMU_LOCATION",
 			Name:   "qemu-location",
 			Usage:  "The location of the qemu tools if not in Path",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_BINARY",
+			Name:   "qemu-binary",
+			Usage:  "Exact qemu-system binary to run this machine with",
+		},
 		mcnflag.StringSliceFlag{
-			Name:  "qemu-open-ports",
-			Usage: "Make the specified port number accessible from the host",
+			Name:   "qemu-open-ports",
+			EnvVar: "QEMU_OPEN_PORTS",
+			Usage:  "Make the specified port number accessible from the host, e.g. 8080, 6000-6010 or 53/udp",
 		},
 		mcnflag.StringFlag{
 			Name:   "qemu-boot2docker-url",
 			Usage:  "URL of the boot2docker ISO. Defaults to the latest available version.",
 			EnvVar: "QEMU_BOOT2DOCKER_URL",
 		},
+		mcnflag.StringFlag{
+			Name:   "qemu-cache-dir",
+			EnvVar: "QEMU_CACHE_DIR",
+			Usage:  "Directory caching the boot2docker ISO and catalog images, outside of the machine store",
+			Value:  defaultCacheDir(),
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-skip-iso-update",
+			EnvVar: "QEMU_SKIP_ISO_UPDATE",
+			Usage:  "Use the cached boot2docker ISO without checking for a newer release",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-iso-max-age",
+			EnvVar: "QEMU_ISO_MAX_AGE",
+			Usage:  "How long the cached boot2docker ISO is used before checking for a newer release, 0 to always check",
+			Value:  "24h",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "qemu-label",
+			EnvVar: "QEMU_LABEL",
+			Usage:  "Tag the machine with a key=value label, repeatable",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-on-ready",
+			EnvVar: "QEMU_ON_READY",
+			Usage:  "Host command run when the machine is running",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-on-stop",
+			EnvVar: "QEMU_ON_STOP",
+			Usage:  "Host command run when the machine stopped or was removed",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-disk-encrypt",
+			EnvVar: "QEMU_DISK_ENCRYPT",
+			Usage:  "Encrypt the qcow2 disk with LUKS",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-backend",
+			EnvVar: "QEMU_BACKEND",
+			Usage:  "The hypervisor running the machine, auto or one of " + backendNames(),
+			Value:  "auto",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-secret-store",
+			EnvVar: "QEMU_SECRET_STORE",
+			Usage:  "Where machine secrets are kept, auto, keychain (the OS keychain) or file (the store path)",
+			Value:  "auto",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-ttl",
+			EnvVar: "QEMU_TTL",
+			Usage:  "Remove the machine automatically once this duration such as 8h has passed",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-image",
+			EnvVar: "QEMU_IMAGE",
+			Usage:  "Guest image name[:version] from the image catalog, instead of boot2docker",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-image-catalog",
+			EnvVar: "QEMU_IMAGE_CATALOG",
+			Usage:  "URL (http, https or public s3) or path of the JSON image catalog",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-provisioner",
+			EnvVar: "QEMU_PROVISIONER",
+			Usage:  "Guest provisioner: boot2docker, cloud-init, ignition or custom. Detected from the image by default",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-provision-script",
+			EnvVar: "QEMU_PROVISION_SCRIPT",
+			Usage:  "Host script preparing the disk for the custom provisioner",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-ssh-user",
+			EnvVar: "QEMU_SSH_USER",
+			Usage:  "SSH user of the custom provisioner",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-lazy-start",
+			EnvVar: "QEMU_LAZY_START",
+			Usage:  "Only boot QEMU when the first connection to the machine comes in",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-mtu",
+			EnvVar: "QEMU_MTU",
+			Usage:  "MTU of the guest network interface and its containers, for jumbo frames",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-data-disk-size",
+			EnvVar: "QEMU_DATA_DISK_SIZE",
+			Usage:  "Size in MB of a second disk mounted at /var/lib/docker, none when 0",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-data-disk-fs",
+			EnvVar: "QEMU_DATA_DISK_FS",
+			Usage:  "Filesystem of the data disk, ext4 or xfs",
+			Value:  "ext4",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-storage-driver",
+			EnvVar: "QEMU_STORAGE_DRIVER",
+			Usage:  "Storage driver of the guest engine such as overlay2, the engine's choice when empty",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "qemu-network-device",
+			EnvVar: "QEMU_NETWORK_DEVICE",
+			Usage:  "NIC model, virtio-net, e1000 or rtl8139, given again for the host-only interface",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "qemu-guest-dns",
+			EnvVar: "QEMU_GUEST_DNS",
+			Usage:  "DNS servers the guest uses instead of the host's resolver, for hosts whose VPN changes it",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-engine-ssh",
+			EnvVar: "QEMU_ENGINE_SSH",
+			Usage:  "Let the SSH user reach the engine socket, for DOCKER_HOST=ssh://... over the SSH forward",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-expose-plain-engine",
+			EnvVar: "QEMU_EXPOSE_PLAIN_ENGINE",
+			Usage:  "INSECURE: also serve the engine API without TLS on localhost, port 2375 when free",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-shutdown-timeout",
+			EnvVar: "QEMU_SHUTDOWN_TIMEOUT",
+			Usage:  "How long docker-machine stop waits for the guest to power off before making QEMU quit",
+			Value:  "1m",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-kill-timeout",
+			EnvVar: "QEMU_KILL_TIMEOUT",
+			Usage:  "How long docker-machine stop and kill wait for QEMU to quit before killing its process",
+			Value:  "10s",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-host-only",
+			EnvVar: "QEMU_HOST_ONLY",
+			Usage:  "Add a NIC on a driver managed host-only bridge, giving the machine an IP reachable from the host (Linux hosts)",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-network",
+			EnvVar: "QEMU_NETWORK",
+			Usage:  "Guest network, user for localhost forwards only or bridge to add a NIC with a LAN address on --qemu-bridge-interface (Linux hosts)",
+			Value:  "user",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-bridge-interface",
+			EnvVar: "QEMU_BRIDGE_INTERFACE",
+			Usage:  "Host bridge holding the LAN interface, such as br0, for --qemu-network bridge",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-hostname",
+			EnvVar: "QEMU_HOSTNAME",
+			Usage:  "Hostname of the guest, the machine name when empty",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-dns-name",
+			EnvVar: "QEMU_DNS_NAME",
+			Usage:  "Register <machine>.qemu.local for the host-only address in the hosts file",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-net-rate-limit",
+			EnvVar: "QEMU_NET_RATE_LIMIT",
+			Usage:  "Limit the guest network to this many Mbit/s in each direction",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "qemu-registry-mirror",
+			EnvVar: "QEMU_REGISTRY_MIRROR",
+			Usage:  "Registry mirror to configure in the guest daemon.json",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-accel",
+			EnvVar: "QEMU_ACCEL",
+			Usage:  "Accelerator: kvm, hax, whpx, hvf or tcg. Defaults to kvm on Linux, hax on Windows and hvf on macOS",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-require-accel",
+			EnvVar: "QEMU_REQUIRE_ACCEL",
+			Usage:  "Fail instead of running the machine under TCG emulation",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-accel-benchmark",
+			EnvVar: "QEMU_ACCEL_BENCHMARK",
+			Usage:  "Boot under every available accelerator at create and keep the fastest",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-arch",
+			EnvVar: "QEMU_ARCH",
+			Usage:  "Guest architecture: x86_64, aarch64 or riscv64 (experimental, runs under TCG on other hosts)",
+			Value:  defaultArch,
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-fast-boot",
+			EnvVar: "QEMU_FAST_BOOT",
+			Usage:  "Skip the boot menu and legacy devices, and exit QEMU on guest reboot",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-mem-merge",
+			EnvVar: "QEMU_MEM_MERGE",
+			Usage:  "Mark guest memory mergeable by the host KSM, on or off (Linux hosts)",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-thp",
+			EnvVar: "QEMU_THP",
+			Usage:  "Set to never to keep transparent huge pages off guest memory (Linux hosts)",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-firmware",
+			EnvVar: "QEMU_FIRMWARE",
+			Usage:  "Guest firmware, bios, uefi or uefi-secureboot",
+			Value:  "bios",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-ovmf-code",
+			EnvVar: "QEMU_OVMF_CODE",
+			Usage:  "OVMF firmware code image, found in the usual locations when empty",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-ovmf-vars",
+			EnvVar: "QEMU_OVMF_VARS",
+			Usage:  "OVMF variable store template, with keys enrolled for secure boot",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-confidential",
+			EnvVar: "QEMU_CONFIDENTIAL",
+			Usage:  "Run a confidential guest with encrypted memory, sev, sev-es, sev-snp or tdx",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-sev-policy",
+			EnvVar: "QEMU_SEV_POLICY",
+			Usage:  "SEV guest policy such as 0x1, QEMU's default when empty",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "qemu-mdev",
+			EnvVar: "QEMU_MDEV",
+			Usage:  "Attach a mediated device such as a GVT-g vGPU, an mdev UUID or <parent>/<type> to create one",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-audio",
+			EnvVar: "QEMU_AUDIO",
+			Usage:  "Host audio backend of an HD audio device, none, pa, sdl or dsound",
+			Value:  "none",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-cgroup-scope",
+			EnvVar: "QEMU_CGROUP_SCOPE",
+			Usage:  "Run QEMU in its own systemd scope (Linux hosts)",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-cgroup-memory",
+			EnvVar: "QEMU_CGROUP_MEMORY",
+			Usage:  "Memory limit in MB of the QEMU scope, including QEMU's own overhead",
+		},
+		mcnflag.IntFlag{
+			Name:   "qemu-cgroup-cpu",
+			EnvVar: "QEMU_CGROUP_CPU",
+			Usage:  "CPU quota in percent of one CPU of the QEMU scope",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-smbios-uuid",
+			EnvVar: "QEMU_SMBIOS_UUID",
+			Usage:  "System UUID of the guest, derived from the machine name when empty",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-smbios-serial",
+			EnvVar: "QEMU_SMBIOS_SERIAL",
+			Usage:  "System and chassis serial number of the guest, derived from the UUID when empty",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-smbios-asset-tag",
+			EnvVar: "QEMU_SMBIOS_ASSET_TAG",
+			Usage:  "Chassis asset tag of the guest, docker-machine-<name> when empty",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-sleep-guard",
+			EnvVar: "QEMU_SLEEP_GUARD",
+			Usage:  "Pause the machine while the host sleeps and set its clock on resume",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-guest-os",
+			EnvVar: "QEMU_GUEST_OS",
+			Usage:  "Guest operating system, linux or windows for Hyper-V enlightenments and emulated devices",
+			Value:  "linux",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-console",
+			EnvVar: "QEMU_CONSOLE",
+			Usage:  "Guest kernel console, serial, virtio (hvc0) or graphical",
+			Value:  "serial",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-rtc",
+			EnvVar: "QEMU_RTC",
+			Usage:  "Guest clock base, utc or localtime for hosts dual-booting Windows",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-rtc-driftfix",
+			EnvVar: "QEMU_RTC_DRIFTFIX",
+			Usage:  "Catch up on lost guest clock ticks, slew or none",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-keyboard",
+			EnvVar: "QEMU_KEYBOARD",
+			Usage:  "Keyboard layout of graphical consoles such as en-us or de-ch",
+		},
+		mcnflag.BoolFlag{
+			Name:   "qemu-guest-channel",
+			EnvVar: "QEMU_GUEST_CHANNEL",
+			Usage:  "Add a virtio-serial channel for pushing files into the guest",
+		},
+		mcnflag.StringFlag{
+			Name:   "qemu-daemon-json",
+			EnvVar: "QEMU_DAEMON_JSON",
+			Usage:  "Path of a daemon.json file to install in the guest",
+		},
 	}
+	return append(flags, aliasFlags(flags)...)
 }
 
-// PreCreateCheck checks that the machine creation process can be started safely.
-func (d *Driver) PreCreateCheck() error {
+// checkAccel checks that the host can accelerate the guest. Guests of a
+// foreign architecture run under TCG and need none of it, and a benchmark
+// finds out by itself which accelerator works.
+func (d *Driver) checkAccel() error {
+	if d.AccelBenchmark && d.Accel == "" {
+		return nil
+	}
+	accel := d.requestedAccel()
+	if accel == "tcg" {
+		return d.allowTCG(d.tcgReason())
+	}
 	//CHECK FOR haxm
-	if isHAXMNotInstalled() {
+	if accel == "hax" && isHAXMNotInstalled() {
 		return fmt.Errorf("Intel HAXM not installed, please install it to use this driver")
 	}
 	//Check for VT instructions
 	if isVTXDisabled() {
 		return fmt.Errorf("VT-X instructions are disabled, please enabled them to use this driver")
 	}
+	if accel != "hax" {
+		return nil
+	}
 	//Check for Hyper-V
 	if isHyperVInstalled() {
 		return fmt.Errorf("Hyper-V is installed, please disable it to use this driver")
@@ -101,38 +581,142 @@ func (d *Driver) PreCreateCheck() error {
 	if isDeviceGuardEnabled() {
 		return fmt.Errorf("Windows Device Credential Guard is enabled, driver cannot run")
 	}
+	return nil
+}
 
-	// Downloading boot2docker to cache should be done here to make sure
-	// that a download failure will not leave a machine half created.
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.UpdateISOCache(d.Boot2DockerURL); err != nil {
+// PreCreateCheck checks that the machine creation process can be started safely.
+func (d *Driver) PreCreateCheck() error {
+	if err := d.chooseBackend(); err != nil {
+		return err
+	}
+	if err := d.checkAccel(); err != nil {
+		return err
+	}
+	if err := d.checkStorePath(); err != nil {
+		return err
+	}
+	if d.isUEFI() {
+		if _, err := d.findOVMF(); err != nil {
+			return err
+		}
+	}
+	if err := d.checkConfidential(); err != nil {
+		return err
+	}
+	if err := d.checkNICModels(); err != nil {
 		return err
 	}
+	if d.HostOnly {
+		if err := ensureHostOnlyNetwork(); err != nil {
+			return err
+		}
+	}
+	if d.isBridged() {
+		if err := ensureBridge(d.BridgeInterface); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	// Downloading boot2docker to cache should be done here to make sure
+	// that a download failure will not leave a machine half created.
+	if d.Image != "" {
+		if err := d.resolveImage(); err != nil {
+			return err
+		}
+		//The catalog may pick the custom provisioner
+		return d.checkProvisionScript()
+	}
+	return d.updateISOCache()
 }
 
 //Create the machiene
 func (d *Driver) Create() error {
+	return d.transition("creating", "running", d.create)
+}
+
+func (d *Driver) create() error {
+	if err := d.beginCreate(); err != nil {
+		return err
+	}
 
 	//Copy ISO into machine directory
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.CopyIsoToMachineDir("", d.GetMachineName()); err != nil {
+	err := d.createStep("iso-copy", func() error {
+		if d.Image != "" {
+			return d.copyImage()
+		}
+		return d.copyISO()
+	})
+	if err != nil {
+		return err
+	}
+	if d.AccelBenchmark {
+		if err := d.createStep("accel-benchmark", d.benchmarkAccels); err != nil {
+			return err
+		}
+	}
+	if err := d.createStep("firmware", d.createFirmwareVars); err != nil {
+		return err
+	}
+	err = d.createStep("keygen", func() error {
+		d.removeKeyLeftovers()
+		return ssh.GenerateSSHKey(d.GetSSHKeyPath())
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.chooseSecretStore(); err != nil {
+		return err
+	}
+	if err := d.createStep("disk-key", d.createDiskKey); err != nil {
+		return err
+	}
+
+	disk, format, err := d.diskLocation()
+	if err != nil {
+		return err
+	}
+	d.Disk, d.DiskFormat = disk, format
+	if err := d.microVMDisk(); err != nil {
+		return err
+	}
+	err = d.createStep("disk-create", func() error {
+		return d.provisioner().createDisk(d)
+	})
+	if err != nil {
 		return err
 	}
-	log.Infof("Creating SSH key...")
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+	if err := d.hardenArtifacts(); err != nil {
 		return err
 	}
+	if err := d.createStep("data-disk", d.createDataDisk); err != nil {
+		return err
+	}
+
+	if err := d.launchForCreate(); err != nil {
+		return err
+	}
+	if d.LazyStart {
+		if err := d.startSupervisor(); err != nil {
+			return err
+		}
+	}
+	if err := d.phase("create", "provision", d.provision); err != nil {
+		return err
+	}
+	d.finishCreate()
+	d.warnMissingCPUFeatures()
+	return nil
+}
 
-	log.Infof("Creating Disk...")
-	gen := d.ResolveStorePath("disk.raw")
-	disk := d.ResolveStorePath("disk.qcow2")
-	tarBuf, err := mcnutils.MakeDiskImage(d.GetSSHKeyPath() + ".pub")
+// createRawDisk writes the boot2docker userdata tar holding the public key
+// to path.
+func createRawDisk(path string, publicKey string) error {
+	tarBuf, err := mcnutils.MakeDiskImage(publicKey)
 	if err != nil {
 		return err
 	}
-	file, err := os.OpenFile(gen, os.O_WRONLY|os.O_CREATE, 0644)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
@@ -143,14 +727,34 @@ func (d *Driver) Create() error {
 	if err != nil {
 		return err
 	}
-	file.Close()
+	return file.Close()
+}
 
+// convertDisk turns the raw disk at gen into the qcow2 disk and grows it to
+// the requested size. A raw block device is written in place and keeps its
+// size.
+func convertDisk(d *Driver, gen string, disk string) error {
 	qemuImg, err := getQemuImgCommand(d)
 	if err != nil {
 		return err
 	}
 
-	convert := exec.Command(qemuImg, "convert", "-f", "raw", "-O", "qcow2", gen, disk)
+	if d.DiskFormat == "raw" {
+		convert := exec.Command(qemuImg, "convert", "-n", "-f", "raw", "-O", "raw", gen, disk)
+		err = convert.Run()
+		os.Remove(gen)
+		return err
+	}
+
+	secret, cleanup, err := d.diskSecretArgs()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args := append([]string{"convert"}, secret...)
+	args = append(args, "-f", "raw", "-O", "qcow2")
+	args = append(args, d.encryptCreateArgs()...)
+	convert := exec.Command(qemuImg, append(args, gen, disk)...)
 	err = convert.Run()
 	if err != nil {
 		return err
@@ -159,47 +763,120 @@ func (d *Driver) Create() error {
 
 	var resizeString string
 	resizeString = fmt.Sprintf("+%dM", d.DiskSize)
-	resize := exec.Command(qemuImg, "resize", disk, resizeString)
-	err = resize.Run()
+	resizeArgs, err := d.resizeArgs(secret, resizeString)
 	if err != nil {
 		return err
 	}
-	d.Disk = disk
+	resize := exec.Command(qemuImg, resizeArgs...)
+	return resize.Run()
+}
 
-	return d.Start()
+// nicDevice returns the -device of the guest network interface. The
+// MTU is advertised to guests supporting it through host_mtu.
+func (d *Driver) nicDevice() qemucmd.Device {
+	nic := qemucmd.Device{Driver: d.nicModel(0), Props: []qemucmd.Option{{Key: "netdev", Value: "mynet0"}}}
+	if d.MTU != 0 {
+		nic.Props = append(nic.Props, qemucmd.Option{Key: "host_mtu", Value: strconv.Itoa(d.MTU)})
+	}
+	return nic
 }
 
 // Kill  machine
-func (d *Driver) Kill() (err error) {
-	monconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.MonitorPort))
+func (d *Driver) Kill() error {
+	//Kill is the way out of a stuck operation, so it ignores the lock
+	err := d.kill()
+	if err == nil {
+		os.Remove(d.ResolveStorePath("state.lock"))
+		d.recordState("stopped")
+		d.stateChanged("stopped")
+	}
+	return err
+}
+
+func (d *Driver) kill() (err error) {
+	defer func() {
+		if err == nil {
+			d.releaseName()
+		}
+	}()
+	d.stopHelper("plainengine")
+	if d.LazyStart {
+		//The supervisor reaping its machine must outlive the cleanup
+		if !d.supervising {
+			if err := d.stopSupervisor(); err != nil {
+				return err
+			}
+		}
+		if !d.qemuRunning() {
+			d.releaseMdevs()
+			d.releaseOpenPorts()
+			return nil
+		}
+	}
+	if d.isMicroVM() {
+		return d.stopMicroVM()
+	}
+	err = d.quitQEMU()
+	if err == nil && !d.awaitExit() {
+		err = fmt.Errorf("QEMU did not exit within %s of quit", d.killTimeout())
+	}
 	if err != nil {
-		return err
+		if err := d.killProcesses(err); err != nil {
+			return err
+		}
+	}
+	d.releaseMdevs()
+	d.stopHelper("sleepguard")
+	d.stopHelper("balloon")
+	d.releaseOpenPorts()
+	return nil
+}
+
+// quitQEMU makes QEMU exit through QMP. Machines created before the driver
+// had a QMP port are sent q on their telnet monitor.
+func (d *Driver) quitQEMU() error {
+	if d.QMPPort == 0 {
+		monconn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(d.MonitorPort), time.Second)
+		if err != nil {
+			return err
+		}
+		defer monconn.Close()
+		fmt.Fprint(monconn, "\nq\n")
+		return nil
 	}
-	defer monconn.Close()
-	w := bufio.NewWriter(monconn)
-	fmt.Fprint(w, "\nq\n")
-	w.Flush()
-	time.Sleep(500 * time.Millisecond)
-	err = monconn.Close()
+	qmp, err := dialQMP(d.QMPPort)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer qmp.Close()
+	return qmp.quit()
 }
 
 //Remove the machine
 func (d *Driver) Remove() error {
+	return d.transition("removing", "removed", d.remove)
+}
+
+func (d *Driver) remove() error {
+	d.removing = true
 	s, err := d.GetState()
 	if err != nil {
 		return err
 	}
 	if s != state.Stopped && s != state.Saved {
-		if err := d.Kill(); err != nil {
+		if err := d.kill(); err != nil {
 			return err
 		}
 
 	}
-	return nil
+	d.releaseOpenPorts()
+	d.dropStatus()
+	d.releaseName()
+	if err := d.removeSecrets(); err != nil {
+		log.Warnf("Could not remove the secrets of %s: %v", d.MachineName, err)
+	}
+	d.removeArtifacts()
+	return d.removeExternalDisk()
 }
 
 func getFileOutofFS(iso *iso9660.FileSystem, file string, output string) error {
@@ -221,167 +898,580 @@ func getFileOutofFS(iso *iso9660.FileSystem, file string, output string) error {
 		return errors.New("bytes read does not equal length of file")
 	}
 
-	err = ioutil.WriteFile(output, fileBytes, 0644)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// This function tries to extract the kernel and initrd from the ISO
-func extractKernel(d *Driver) error {
-	//Windows
-	//Remove Kernel and initrd. //Failing is ok!
-	os.Remove(d.ResolveStorePath("vmlinuz64"))
-	os.Remove(d.ResolveStorePath("initrd.img"))
-
-	isofs, err := iso9660.Open(d.ResolveStorePath("boot2docker.iso"))
-	if err != nil {
-		return err
+	//Keep the executable bits from Rock Ridge, the file stays writable
+	mode := fileStat.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
 	}
-	getFileOutofFS(isofs, "BOOT/VMLINUZ64.;1", d.ResolveStorePath("vmlinuz64"))
+	mode |= 0200
+	err = ioutil.WriteFile(output, fileBytes, mode)
 	if err != nil {
 		return err
 	}
-	getFileOutofFS(isofs, "BOOT/INITRD.IMG;1", d.ResolveStorePath("initrd.img"))
-	if err != nil {
+	if err := os.Chmod(output, mode); err != nil {
 		return err
 	}
-
-	return nil
-
+	return os.Chtimes(output, fileStat.ModTime(), fileStat.ModTime())
 }
 
 //Start the machine
 func (d *Driver) Start() error {
-	log.Debugf("Starting VM %s", d.MachineName)
-	//CHECK FOR haxm
-	if isHAXMNotInstalled() {
-		return fmt.Errorf("Intel HAXM not installed, please install it to use this driver")
+	if d.createStarted() {
+		return d.transition("creating", "running", d.create)
 	}
-	//Check for VT instructions
-	if isVTXDisabled() {
-		return fmt.Errorf("VT-X instructions are disabled, please enabled them to use this driver")
+	return d.transition("starting", "running", d.start)
+}
+
+func (d *Driver) start() error {
+	if err := d.reallocatePorts(); err != nil {
+		return err
 	}
-	//Check for Hyper-V
-	if isHyperVInstalled() {
-		return fmt.Errorf("Hyper-V is installed, please disable it to use this driver")
+	if d.LazyStart {
+		if err := d.claimOpenPorts(); err != nil {
+			return err
+		}
+		if err := d.startPlainEngine(); err != nil {
+			log.Warnf("Could not serve the plaintext engine port of %s: %v", d.MachineName, err)
+		}
+		return d.startSupervisor()
 	}
-	//Check for Windows DeviceGuard
-	if isDeviceGuardEnabled() {
-		return fmt.Errorf("Windows Device Credential Guard is enabled, driver cannot run")
+	if err := d.launch(); err != nil {
+		return err
+	}
+	d.checkForwards()
+	if err := d.startPlainEngine(); err != nil {
+		log.Warnf("Could not serve the plaintext engine port of %s: %v", d.MachineName, err)
+	}
+	return nil
+}
+
+// launch boots QEMU and waits for the SSH forward to come up.
+func (d *Driver) launch() error {
+	log.Debugf("Starting VM %s", d.MachineName)
+	if err := d.checkAccel(); err != nil {
+		return err
+	}
+	if err := d.checkQemuBinary(); err != nil {
+		return err
+	}
+	if err := d.checkDiskGrowth(); err != nil {
+		return err
+	}
+	if err := d.claimOpenPorts(); err != nil {
+		return err
+	}
+	//The bridge does not survive a host reboot
+	if d.HostOnly {
+		if err := ensureHostOnlyNetwork(); err != nil {
+			return err
+		}
+	}
+	if d.isBridged() {
+		if err := ensureBridge(d.BridgeInterface); err != nil {
+			return err
+		}
+	}
+	if d.isMicroVM() {
+		return d.launchMicroVM()
+	}
+	if err := d.chooseGuestSubnet(); err != nil {
+		return err
 	}
-	err := extractKernel(d)
+	bootArgs, err := d.provisioner().bootArgs(d)
 	if err != nil {
 		return err
 	}
 
-	var netString string
-	netString = fmt.Sprintf("user,id=mynet0,net=192.168.76.0/24,dhcpstart=192.168.76.9,hostfwd=tcp:127.0.0.1:%d-:22,hostfwd=tcp:127.0.0.1:%d-:2376",
-		d.SSHPort,
-		d.EnginePort)
+	netdev := qemucmd.NetDev{
+		Backend:   "user",
+		ID:        "mynet0",
+		Net:       d.guestSubnet(),
+		DHCPStart: d.guestDHCPStart(),
+		HostForwards: []qemucmd.HostForward{
+			{HostAddr: "127.0.0.1", HostPort: d.forwardedSSHPort(), GuestPort: 22},
+			{HostAddr: "127.0.0.1", HostPort: d.forwardedEnginePort(), GuestPort: 2376},
+		},
+	}
 	for _, port := range d.OpenPorts {
-		netString = fmt.Sprintf("%s,hostfwd=tcp:127.0.0.1:%d-:%d", netString, port, port)
+		netdev.HostForwards = append(netdev.HostForwards, qemucmd.HostForward{HostAddr: "127.0.0.1", HostPort: port, GuestPort: port})
+	}
+	for _, port := range d.OpenUDPPorts {
+		netdev.HostForwards = append(netdev.HostForwards, qemucmd.HostForward{Protocol: "udp", HostAddr: "127.0.0.1", HostPort: port, GuestPort: port})
 	}
 
-	var monString string
-	monString = fmt.Sprintf("telnet:127.0.0.1:%d,server,nowait", d.MonitorPort)
+	drive := qemucmd.Drive{
+		File:      qemuPath(d.Disk),
+		Interface: d.diskInterface(),
+		Format:    d.DiskFormat,
+		WError:    d.DiskWError,
+		RError:    d.DiskRError,
+	}
+	if d.DiskEncrypt {
+		drive.Extra = append(drive.Extra, qemucmd.Option{Key: "encrypt.key-secret", Value: diskSecretID})
+	}
 
-	var diskString string
-	diskString = fmt.Sprintf("file=%s,if=virtio", d.Disk)
+	consoleArgs, err := d.consoleArgs()
+	if err != nil {
+		return err
+	}
 
 	qemuCmd, err := getQemuCommand(d)
 	if err != nil {
-		return nil
+		return err
+	}
+
+	var builder qemucmd.Command
+	builder.Option("-netdev", netdev).
+		Option("-device", d.nicDevice()).
+		Add("-m", d.memArg(), "-smp", d.smpArg()).
+		Option("-drive", drive).
+		Add("-D", qemuPath(d.ResolveStorePath("qemu.log"))).
+		Add("-pidfile", qemuPath(d.pidFile()))
+	if d.QMPPort != 0 {
+		builder.Option("-qmp", qemucmd.Socket{Protocol: "tcp", Host: "127.0.0.1", Port: d.QMPPort})
+	}
+	//The driver only talks QMP, --qemu-monitor-port adds a monitor for people
+	if d.MonitorPort != 0 {
+		builder.Option("-monitor", qemucmd.Socket{Protocol: "telnet", Host: "127.0.0.1", Port: d.MonitorPort})
+	}
+	baseArgs, err := builder.Args()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(qemuCmd, baseArgs...)
+
+	nameArgs, err := d.nameArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, nameArgs...)
+	cmd.Args = append(cmd.Args, consoleArgs...)
+	cmd.Args = append(cmd.Args, bootArgs...)
+	cmd.Args = append(cmd.Args, d.archArgs()...)
+	cmd.Args = append(cmd.Args, d.accelArgs()...)
+	cmd.Args = append(cmd.Args, d.fastBootArgs()...)
+	cmd.Args = append(cmd.Args, d.balloonArgs()...)
+	cmd.Args = append(cmd.Args, d.memoryArgs()...)
+	cmd.Args = append(cmd.Args, d.panicArgs()...)
+	cmd.Args = append(cmd.Args, d.cpuArgs()...)
+	firmwareArgs, err := d.firmwareArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, firmwareArgs...)
+	audioArgs, err := d.audioArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, audioArgs...)
+	mdevArgs, err := d.createMdevs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, mdevArgs...)
+	confidentialArgs, err := d.confidentialArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, confidentialArgs...)
+	smbiosArgs, err := d.smbiosArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, smbiosArgs...)
+	dataDiskArgs, err := d.dataDiskArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, dataDiskArgs...)
+	hostOnlyArgs, err := d.hostOnlyArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, hostOnlyArgs...)
+	bridgedArgs, err := d.bridgedArgs()
+	if err != nil {
+		return err
 	}
+	cmd.Args = append(cmd.Args, bridgedArgs...)
+	//QEMU has read the key once the SSH forward is up
+	diskSecretArgs, removeDiskKey, err := d.diskSecretArgs()
+	if err != nil {
+		return err
+	}
+	defer removeDiskKey()
+	cmd.Args = append(cmd.Args, diskSecretArgs...)
+	rtcArgs, err := d.rtcArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, rtcArgs...)
+	channelArgs, err := d.channelArgs()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, channelArgs...)
 
-	cmd := exec.Command(qemuCmd,
-		"-netdev", netString,
-		"-device", "virtio-net,netdev=mynet0",
-		"-boot", "d",
-		"-kernel", d.ResolveStorePath("vmlinuz64"),
-		"-initrd", d.ResolveStorePath("initrd.img"),
-		"-append", `loglevel=3 user=docker console=ttyS0 noembed nomodeset norestore base`,
-		"-m", strconv.Itoa(d.Mem),
-		"-smp", strconv.Itoa(d.Cpus),
-		"-drive", diskString,
-		"-monitor", monString, getQemuAccel(d), "-nographic",
-		"-D", d.ResolveStorePath("qemu.log"),
-		"-serial", fmt.Sprintf("file:%s", d.ResolveStorePath("kern.log")))
+	cmd, err = d.backend().command(d, qemuCmd, cmd.Args[1:])
+	if err != nil {
+		return err
+	}
+	if !d.CgroupScope {
+		if err := d.checkCgroupLimits(); err != nil {
+			return err
+		}
+	}
+	cmd, err = d.scopeCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	//Kept for troubleshooting, see SupportBundle
+	if err := ioutil.WriteFile(d.ResolveStorePath("qemu.cmdline"), []byte(strings.Join(cmd.Args, " ")+"\n"), 0644); err != nil {
+		log.Debugf("Could not save the QEMU command line: %v", err)
+	}
 
 	//Set CMD process flags
 	setProcAttr(cmd)
-	log.Infof("Starting VM...")
-	cmd.Start()
+	err = d.phase("start", "qemu-launch", func() error {
+		return d.startQemu(cmd)
+	})
+	if err != nil {
+		return err
+	}
 
 	d.IPAddress = "127.0.0.1"
-	d.SSHUser = "docker"
+	d.SSHUser = d.provisioner().sshUser(d)
+	return d.awaitGuest()
+}
 
+// awaitGuest waits for the SSH forward of the booting machine and the
+// services following it.
+func (d *Driver) awaitGuest() error {
 	//Give Qemu a few changes to get started!
-	for i := 0; i < 50; i++ {
-		time.Sleep(200 * time.Millisecond)
-		sshconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.SSHPort))
-		defer sshconn.Close()
-		if err == nil {
-			return nil
+	err := d.phase("start", "ssh-wait", func() error {
+		for i := 0; i < 50; i++ {
+			time.Sleep(200 * time.Millisecond)
+			sshconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.forwardedSSHPort()))
+			if err == nil {
+				sshconn.Close()
+				return nil
+			}
+		}
+		if err := checkForwardInterference(d); err != nil {
+			return err
 		}
+		return fmt.Errorf("Failed to startup QEMU")
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.phase("start", "host-only-lease", d.waitHostOnlyIP); err != nil {
+		return err
+	}
+	if err := d.phase("start", "bridged-address", d.waitBridgedIP); err != nil {
+		return err
 	}
-	return fmt.Errorf("Failed to startup QEMU")
+	if err := d.registerName(); err != nil {
+		log.Warnf("Could not register %s: %v", d.dnsName(), err)
+	}
+	if err := d.reportFeatures(); err != nil {
+		log.Debugf("Could not query QEMU feature usage: %v", err)
+	}
+	if d.effectiveAccel == "tcg" && d.requestedAccel() != "tcg" {
+		if err := d.allowTCG("QEMU could not use " + d.requestedAccel()); err != nil {
+			d.kill()
+			return err
+		}
+	}
+	if err := d.startSleepGuard(); err != nil {
+		log.Warnf("Could not start the sleep guard of %s: %v", d.MachineName, err)
+	}
+	if err := d.startBalloonController(); err != nil {
+		log.Warnf("Could not start the balloon controller of %s: %v", d.MachineName, err)
+	}
+	return nil
 }
 
 //Stop the machine
 func (d *Driver) Stop() error {
-	_, err := drivers.RunSSHCommandFromDriver(d, "sudo poweroff")
-	if err != nil {
-		return err
+	return d.transition("stopping", "stopped", d.stop)
+}
+
+func (d *Driver) stop() (err error) {
+	defer func() {
+		if err == nil {
+			d.releaseName()
+		}
+	}()
+	d.stopHelper("plainengine")
+	if d.LazyStart && !d.qemuRunning() {
+		d.IPAddress = ""
+		d.releaseOpenPorts()
+		return d.stopSupervisor()
+	}
+	if d.guestPanicked() {
+		//A panicked guest cannot power itself off
+		return d.kill()
+	}
+	d.unpauseForStop()
+	if d.isMicroVM() {
+		if _, err := drivers.RunSSHCommandFromDriver(d, "sudo poweroff"); err != nil {
+			return err
+		}
+		//The microvm helper exits with the hypervisor
+		if !waitUntil(d.shutdownTimeout(), func() bool { return !d.helperAlive("microvm") }) {
+			log.Warnf("%s did not power off within %s, killing it", d.MachineName, d.shutdownTimeout())
+		}
+		d.IPAddress = ""
+		return d.stopMicroVM()
+	}
+	if !d.powerDown() {
+		log.Warnf("%s did not power off within %s, making QEMU quit", d.MachineName, d.shutdownTimeout())
+		d.IPAddress = ""
+		return d.kill()
 	}
-	time.Sleep(2 * time.Second)
 	d.IPAddress = ""
+	if !d.awaitExit() {
+		return d.kill()
+	}
+	d.releaseMdevs()
+	d.stopHelper("sleepguard")
+	d.stopHelper("balloon")
+	d.releaseOpenPorts()
+	if d.LazyStart {
+		return d.stopSupervisor()
+	}
 	return nil
 }
 
 //SetConfigFromFlags Set the config from the flags
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	flags, err := d.resolveFlagAliases(flags)
+	if err != nil {
+		return err
+	}
 	d.QemuLocation = flags.String("qemu-location")
+	if err := d.pinQemuBinary(flags.String("qemu-binary")); err != nil {
+		return err
+	}
 	d.MonitorPort = flags.Int("qemu-monitor-port")
 	d.DiskSize = flags.Int("qemu-disk-size")
+	d.DiskPath = flags.String("qemu-disk-path")
+	d.KeepDisk = flags.Bool("qemu-keep-disk")
+	if err := validateDiskPath(d.DiskPath); err != nil {
+		return err
+	}
+	d.DiskWError = flags.String("qemu-disk-werror")
+	d.DiskRError = flags.String("qemu-disk-rerror")
+	if err := validateDiskErrorPolicy("werror", d.DiskWError); err != nil {
+		return err
+	}
+	if err := validateDiskErrorPolicy("rerror", d.DiskRError); err != nil {
+		return err
+	}
 	d.Cpus = flags.Int("qemu-cpu-count")
 	d.Mem = flags.Int("qemu-memory")
+	d.MaxCpus = flags.Int("qemu-max-cpus")
+	d.MaxMem = flags.Int("qemu-max-memory")
+	d.Balloon = flags.Bool("qemu-balloon")
+	d.BalloonMin = flags.Int("qemu-balloon-min")
+	d.CgroupScope = flags.Bool("qemu-cgroup-scope")
+	d.CgroupMemory = flags.Int("qemu-cgroup-memory")
+	d.CgroupCPU = flags.Int("qemu-cgroup-cpu")
+	if err := validateCgroup(d); err != nil {
+		return err
+	}
+	d.MemMerge = flags.String("qemu-mem-merge")
+	d.THP = flags.String("qemu-thp")
+	if err := validateMemoryPolicy(d.MemMerge, d.THP); err != nil {
+		return err
+	}
+	if err := validateHotplug(d); err != nil {
+		return err
+	}
 	d.Boot2DockerURL = flags.String("qemu-boot2docker-url")
-
-	for _, v := range flags.StringSlice("qemu-open-ports") {
-		s := strings.Split(v, "-")
-		if l := len(s); l == 0 || l > 2 {
-			log.Errorf("defined port or range \"%s\" is not valid", v)
-			break
+	labels, err := parseLabels(flags.StringSlice("qemu-label"))
+	if err != nil {
+		return err
+	}
+	d.Labels = labels
+	d.OnReady = flags.String("qemu-on-ready")
+	d.OnStop = flags.String("qemu-on-stop")
+	d.DiskEncrypt = flags.Bool("qemu-disk-encrypt")
+	if err := validateDiskEncrypt(d); err != nil {
+		return err
+	}
+	d.Backend = flags.String("qemu-backend")
+	if err := validateBackend(d.Backend); err != nil {
+		return err
+	}
+	d.SecretStore = flags.String("qemu-secret-store")
+	if err := validateSecretStore(d.SecretStore); err != nil {
+		return err
+	}
+	if ttl := flags.String("qemu-ttl"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid TTL %q, use a duration such as 30m or 8h", ttl)
 		}
-		if len(s) == 1 {
-			port, err := strconv.ParseUint(v, 10, 16)
-			if err != nil {
-				log.Errorf("defined port \"%s\" is not valid", v)
-			}
-			d.OpenPorts = append(d.OpenPorts, int(port))
+		d.Expiry = time.Now().Add(duration)
+	}
+	d.SkipISOUpdate = flags.Bool("qemu-skip-iso-update")
+	if d.ISOMaxAge, err = time.ParseDuration(flags.String("qemu-iso-max-age")); err != nil || d.ISOMaxAge < 0 {
+		return fmt.Errorf("Invalid ISO max age %q, use a duration such as 24h", flags.String("qemu-iso-max-age"))
+	}
+	d.CacheDir = flags.String("qemu-cache-dir")
+	if d.CacheDir != "" {
+		cacheDir, err := filepath.Abs(d.CacheDir)
+		if err != nil {
+			return err
 		}
-		if len(s) == 2 {
-			start, err := strconv.ParseUint(s[0], 10, 16)
-			if err != nil {
-				log.Errorf("defined start port range \"%s\" is not valid", s[0])
-				break
-			}
-			stop, err := strconv.ParseUint(s[1], 10, 16)
-			if err != nil {
-				log.Errorf("defined start port range \"%s\" is not valid", s[1])
-				break
-			}
-			if start >= stop {
-				log.Errorf("defined port range \"%s\" is not valid", v)
-				break
-			}
-			for i := start; i <= stop; i++ {
-				d.OpenPorts = append(d.OpenPorts, int(i))
-			}
+		d.CacheDir = cacheDir
+	}
+	d.Image = flags.String("qemu-image")
+	d.ImageCatalog = flags.String("qemu-image-catalog")
+	if d.Image != "" && d.ImageCatalog == "" {
+		return fmt.Errorf("--qemu-image needs an image catalog, set --qemu-image-catalog")
+	}
+	d.Provisioner = flags.String("qemu-provisioner")
+	d.ProvisionScript = flags.String("qemu-provision-script")
+	d.ProvisionUser = flags.String("qemu-ssh-user")
+	if err := validateProvisioner(d.Provisioner); err != nil {
+		return err
+	}
+	if err := d.checkProvisionScript(); err != nil {
+		return err
+	}
+	if d.Provisioner != "" && d.Provisioner != "boot2docker" && d.Image == "" {
+		return fmt.Errorf("The %s provisioner needs a disk image, set --qemu-image", d.Provisioner)
+	}
+	d.MTU = flags.Int("qemu-mtu")
+	if d.MTU != 0 && (d.MTU < 576 || d.MTU > 65535) {
+		return fmt.Errorf("MTU %d is out of range", d.MTU)
+	}
+	d.RegistryMirrors = flags.StringSlice("qemu-registry-mirror")
+	d.DaemonJSON = flags.String("qemu-daemon-json")
+	d.Arch = flags.String("qemu-arch")
+	d.Accel = flags.String("qemu-accel")
+	d.AccelBenchmark = flags.Bool("qemu-accel-benchmark")
+	d.RequireAccel = flags.Bool("qemu-require-accel")
+	if err := validateAccel(d.Accel); err != nil {
+		return err
+	}
+	d.LazyStart = flags.Bool("qemu-lazy-start")
+	d.FastBoot = flags.Bool("qemu-fast-boot")
+	d.GuestChannel = flags.Bool("qemu-guest-channel")
+	d.SMBIOSUUID = flags.String("qemu-smbios-uuid")
+	d.SMBIOSSerial = flags.String("qemu-smbios-serial")
+	d.SMBIOSAssetTag = flags.String("qemu-smbios-asset-tag")
+	if err := d.setSMBIOSDefaults(); err != nil {
+		return err
+	}
+	d.SleepGuard = flags.Bool("qemu-sleep-guard")
+	if err := validateSleepGuard(d); err != nil {
+		return err
+	}
+	d.GuestOS = flags.String("qemu-guest-os")
+	if err := validateGuestOS(d); err != nil {
+		return err
+	}
+	d.DataDiskSize = flags.Int("qemu-data-disk-size")
+	d.DataDiskFS = flags.String("qemu-data-disk-fs")
+	if err := validateDataDisk(d); err != nil {
+		return err
+	}
+	d.StorageDriver = flags.String("qemu-storage-driver")
+	d.NICModels = flags.StringSlice("qemu-network-device")
+	if err := validateNICModels(d); err != nil {
+		return err
+	}
+	d.GuestDNS = flags.StringSlice("qemu-guest-dns")
+	if err := validateGuestDNS(d.GuestDNS); err != nil {
+		return err
+	}
+	d.EngineSSH = flags.Bool("qemu-engine-ssh")
+	d.PlainEngine = flags.Bool("qemu-expose-plain-engine")
+	if err := validateEngineSSH(d); err != nil {
+		return err
+	}
+	if d.ShutdownTimeout, err = time.ParseDuration(flags.String("qemu-shutdown-timeout")); err != nil || d.ShutdownTimeout <= 0 {
+		return fmt.Errorf("Invalid shutdown timeout %q, use a duration such as 1m", flags.String("qemu-shutdown-timeout"))
+	}
+	if d.KillTimeout, err = time.ParseDuration(flags.String("qemu-kill-timeout")); err != nil || d.KillTimeout <= 0 {
+		return fmt.Errorf("Invalid kill timeout %q, use a duration such as 10s", flags.String("qemu-kill-timeout"))
+	}
+	d.HostOnly = flags.Bool("qemu-host-only")
+	if err := validateHostOnly(d); err != nil {
+		return err
+	}
+	d.Network = flags.String("qemu-network")
+	d.BridgeInterface = flags.String("qemu-bridge-interface")
+	if err := validateNetwork(d); err != nil {
+		return err
+	}
+	if d.isBridged() {
+		if d.BridgedMAC, err = randomMAC(); err != nil {
+			return err
 		}
 	}
+	d.Hostname = flags.String("qemu-hostname")
+	if err := validateHostname(d.Hostname); err != nil {
+		return err
+	}
+	d.DNSName = flags.Bool("qemu-dns-name")
+	if err := validateDNSName(d); err != nil {
+		return err
+	}
+	d.NetRateLimit = flags.Int("qemu-net-rate-limit")
+	if err := validateNetRateLimit(d); err != nil {
+		return err
+	}
+	d.Console = flags.String("qemu-console")
+	if err := validateConsole(d.Console); err != nil {
+		return err
+	}
+	d.RTC = flags.String("qemu-rtc")
+	d.RTCDriftFix = flags.String("qemu-rtc-driftfix")
+	d.Keyboard = flags.String("qemu-keyboard")
+	if err := validateRTC(d.RTC, d.RTCDriftFix, d.Keyboard); err != nil {
+		return err
+	}
+	if err := validateArch(d.Arch); err != nil {
+		return err
+	}
+	d.Firmware = flags.String("qemu-firmware")
+	d.OVMFCode = flags.String("qemu-ovmf-code")
+	d.OVMFVars = flags.String("qemu-ovmf-vars")
+	if err := validateFirmware(d); err != nil {
+		return err
+	}
+	d.Audio = flags.String("qemu-audio")
+	if err := validateAudio(d.Audio); err != nil {
+		return err
+	}
+	d.Mdevs = flags.StringSlice("qemu-mdev")
+	if err := validateMdevs(d.Mdevs); err != nil {
+		return err
+	}
+	d.Confidential = flags.String("qemu-confidential")
+	d.SEVPolicy = flags.String("qemu-sev-policy")
+	if err := validateConfidential(d); err != nil {
+		return err
+	}
+	if _, err := d.daemonJSON(); err != nil {
+		return err
+	}
+
+	ports, udpPorts, err := parseOpenPorts(flags.StringSlice("qemu-open-ports"))
+	if err != nil {
+		return err
+	}
+	d.OpenPorts = append(d.OpenPorts, ports...)
+	d.OpenUDPPorts = append(d.OpenUDPPorts, udpPorts...)
+	if err := validateMicroVM(d); err != nil {
+		return err
+	}
 	//Get Some ports for use to use for SSH and the QEMU MonitorPort
 	sshP, err := getTCPPort(d)
 	if err != nil {
@@ -393,20 +1483,51 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	//		return err
 	//	}
 	d.EnginePort = 2376
-	monP, err := getTCPPort(d)
+	qmpP, err := getTCPPort(d)
 	if err != nil {
 		return err
 	}
-	d.MonitorPort = monP
+	d.QMPPort = qmpP
+	if d.PlainEngine {
+		if err := d.choosePlainEnginePort(); err != nil {
+			return err
+		}
+	}
+	if d.LazyStart {
+		if d.BackendSSHPort, err = getTCPPort(d); err != nil {
+			return err
+		}
+		if d.BackendEnginePort, err = getTCPPort(d); err != nil {
+			return err
+		}
+	}
+	if d.GuestChannel {
+		channelP, err := getTCPPort(d)
+		if err != nil {
+			return err
+		}
+		d.ChannelPort = channelP
+	}
 	return nil
 }
 
 // Restart this docker-machine
 func (d *Driver) Restart() error {
+	return d.transition("restarting", "running", d.restart)
+}
+
+func (d *Driver) restart() error {
 	_, err := drivers.RunSSHCommandFromDriver(d, "sudo shutdown -r now")
 	if err != nil {
 		return err
 	}
+	if d.FastBoot {
+		//QEMU runs with -no-reboot, so it exits instead of rebooting
+		if err := mcnutils.WaitFor(drivers.MachineInState(d, state.Stopped)); err != nil {
+			return err
+		}
+		return d.start()
+	}
 	return nil
 }
 
@@ -417,20 +1538,67 @@ func (d *Driver) GetSSHHostname() (string, error) {
 
 // GetState return instance status
 func (d *Driver) GetState() (state.State, error) {
+	s, err := d.currentState()
+	if err == nil {
+		d.refreshStatus(s)
+	}
+	return s, err
+}
+
+func (d *Driver) currentState() (state.State, error) {
+	if d.reapExpired() {
+		return state.None, fmt.Errorf("%s expired at %s and was removed", d.MachineName, d.Expiry.Format(time.RFC3339))
+	}
+	if s, ok := d.transientState(); ok {
+		return s, nil
+	}
+	if d.guestPanicked() {
+		//QEMU's user network still accepts connections to the SSH forward
+		s, _ := d.checkCrashed()
+		return s, nil
+	}
+	if s, paused := d.checkDiskPaused(); paused {
+		return s, nil
+	}
+	if s, ok := d.processState(); ok {
+		return s, nil
+	}
 	sshconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.SSHPort))
 	if err == nil {
 		sshconn.Close()
 		return state.Running, nil
 	}
-	monconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.MonitorPort))
-	if err == nil {
-		monconn.Close()
+	if s, crashed := d.checkCrashed(); crashed {
+		return s, nil
+	}
+	if d.qemuAnswers() {
 		return state.Starting, nil
 	}
 	d.IPAddress = ""
 	return state.Stopped, nil
 }
 
+// qemuAnswers reports whether QEMU answers a status query on its QMP port,
+// which a program that took over a stale port does not. Machines created
+// before the driver had a QMP port only have the monitor to connect to.
+func (d *Driver) qemuAnswers() bool {
+	if d.QMPPort == 0 {
+		monconn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(d.MonitorPort))
+		if err != nil {
+			return false
+		}
+		monconn.Close()
+		return true
+	}
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return false
+	}
+	defer qmp.Close()
+	_, err = qmp.status()
+	return err == nil
+}
+
 // GetURL returns docker daemon URL on this machine
 func (d *Driver) GetURL() (string, error) {
 	if d.IPAddress == "" {
@@ -443,9 +1611,26 @@ func (d *Driver) GetURL() (string, error) {
 	if s != state.Running {
 		return "", drivers.ErrHostIsNotRunning
 	}
+	if d.HostOnly {
+		return fmt.Sprintf("tcp://%s:2376", d.HostOnlyIP), nil
+	}
+	if d.isBridged() {
+		return fmt.Sprintf("tcp://%s:2376", d.BridgedIP), nil
+	}
 	return fmt.Sprintf("tcp://%s:%d", d.IPAddress, d.EnginePort), nil
 }
 
+// GetIP returns the host-only or bridged address of machines having one.
+func (d *Driver) GetIP() (string, error) {
+	if d.HostOnly && d.HostOnlyIP != "" {
+		return d.HostOnlyIP, nil
+	}
+	if d.isBridged() && d.BridgedIP != "" {
+		return d.BridgedIP, nil
+	}
+	return d.BaseDriver.GetIP()
+}
+
 func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
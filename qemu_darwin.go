@@ -0,0 +1,345 @@
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func isHyperVInstalled() bool {
+	return false
+}
+
+// isVTXDisabled reports whether the Mac lacks the Hypervisor.framework,
+// which needs VT-x with EPT.
+func isVTXDisabled() bool {
+	return !hvfSupported()
+}
+
+func isHAXMNotInstalled() bool {
+	return false
+}
+
+func isDeviceGuardEnabled() bool {
+	return false
+}
+
+func checkForwardInterference(d *Driver) error {
+	return nil
+}
+
+func hvfSupported() bool {
+	out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "1"
+}
+
+func getQemuImgCommand(d *Driver) (string, error) {
+	return qemuToolPath(d, "qemu-img")
+}
+
+// homebrewBins are where Homebrew on Apple silicon and Intel Macs and
+// MacPorts install QEMU, which are not on the PATH of docker-machine
+// started from a desktop session.
+var homebrewBins = []string{"/opt/homebrew/bin", "/usr/local/bin", "/opt/local/bin"}
+
+func qemuSystemBinary(d *Driver) (string, error) {
+	return qemuToolPath(d, d.arch().binary)
+}
+
+// qemuToolPath locates the QEMU executable name in QemuLocation, or else
+// on the PATH or in the Homebrew and MacPorts bin directories.
+func qemuToolPath(d *Driver, name string) (string, error) {
+	if d.QemuLocation != "" {
+		return exec.LookPath(filepath.Join(d.QemuLocation, name))
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	for _, dir := range homebrewBins {
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH or %s, install QEMU with brew install qemu", name, strings.Join(homebrewBins, ", "))
+}
+
+func qemuPath(path string) string {
+	return path
+}
+
+func hostAccels() []string {
+	return []string{"hvf", "tcg"}
+}
+
+func hostAudioDrivers() []string {
+	return []string{"coreaudio", "sdl"}
+}
+
+func hostNetworkModes() []string {
+	return []string{"user"}
+}
+
+// accelUsable reports whether this user can use the accelerator, HVF
+// needing a Mac whose CPU supports the Hypervisor.framework.
+func accelUsable(accel string) bool {
+	if accel != "hvf" {
+		return true
+	}
+	return hvfSupported()
+}
+
+func getQemuAccel(d *Driver) string {
+	return "-accel hvf"
+}
+
+func freeDiskSpace(path string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+func setTHPDisabled(disabled bool) error {
+	return nil
+}
+
+func watchHostSleep(onSuspend, onResume func()) error {
+	return fmt.Errorf("Host sleep notifications are not supported on macOS")
+}
+
+// restrictToOwner makes path readable and writable by its owner only.
+func restrictToOwner(path string) error {
+	return os.Chmod(path, 0600)
+}
+
+func shellCommand(cmdline string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", cmdline)
+}
+
+// filesystemType names the filesystem holding path when it is one the
+// driver cares about.
+func filesystemType(path string) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return "", err
+	}
+	var name []byte
+	for _, c := range fs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if string(name) == "msdos" {
+		return "FAT", nil
+	}
+	return "", nil
+}
+
+func ensureHostOnlyNetwork() error {
+	return fmt.Errorf("Host-only networking needs a Linux host")
+}
+
+func ensureBridge(name string) error {
+	return fmt.Errorf("Bridged networking needs a Linux host")
+}
+
+func hostsFilePath() string {
+	return "/etc/hosts"
+}
+
+// writeHostsFile replaces the hosts file by renaming a temporary file next
+// to it over it, so no resolver reads it half written, through sudo unless
+// its directory is writable.
+func writeHostsFile(path string, data []byte) error {
+	if err := writeFileAtomic(path, data, 0644); err == nil || !os.IsPermission(err) {
+		return err
+	}
+	tmp := path + ".tmp"
+	cmd := exec.Command("sudo", "-n", "/bin/sh", "-c", fmt.Sprintf("cat > '%[1]s' && chmod 644 '%[1]s' && mv -f '%[1]s' '%[2]s'", tmp, path))
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Could not update %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func setProcAttr(cmd *exec.Cmd) {
+
+}
+
+func reflink(src, dst *os.File) error {
+	return fmt.Errorf("Block cloning is not supported on macOS")
+}
+
+// darwinCPUFlags maps the feature names of the macOS kernel to Linux's.
+var darwinCPUFlags = map[string]string{
+	"sse4.1": "sse4_1",
+	"sse4.2": "sse4_2",
+	"avx1.0": "avx",
+	"sha":    "sha_ni",
+}
+
+// hostCPUFlags returns the CPU features of the host, all of them known.
+func hostCPUFlags() map[string]bool {
+	out, err := exec.Command("sysctl", "-n", "machdep.cpu.features", "machdep.cpu.leaf7_features").Output()
+	if err != nil {
+		return nil
+	}
+	flags := map[string]bool{}
+	for _, f := range strings.Fields(strings.ToLower(string(out))) {
+		if name, ok := darwinCPUFlags[f]; ok {
+			f = name
+		}
+		flags[f] = true
+	}
+	known := map[string]bool{}
+	for _, name := range watchedCPUFeatures {
+		known[name] = flags[name]
+	}
+	return known
+}
+
+func createTap(name string) error {
+	return fmt.Errorf("Tap devices are not supported on macOS")
+}
+
+func removeTap(name string) error {
+	return nil
+}
+
+// hostNameservers returns the DNS servers of the host a guest can reach,
+// from the resolv.conf macOS keeps up to date for its primary resolver.
+func hostNameservers() []string {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "nameserver" && !strings.HasPrefix(fields[1], "127.") && fields[1] != "::1" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// hostRoutes returns the IPv4 routes of the host, which VPNs add for
+// networks that have no local address.
+func hostRoutes() []*net.IPNet {
+	out, err := exec.Command("netstat", "-rn", "-f", "inet").Output()
+	if err != nil {
+		return nil
+	}
+	var routes []*net.IPNet
+	for _, line := range strings.Split(string(out), "\n") {
+		//Host routes (H) and the ones cloned for a peer (W) are no networks
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == "default" || strings.ContainsAny(fields[2], "HW") {
+			continue
+		}
+		if route := parseBSDRoute(fields[0]); route != nil {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// parseBSDRoute parses a netstat destination, which leaves out trailing
+// zero octets: 10/8 is 10.0.0.0/8 and 172.16 is 172.16.0.0/16.
+func parseBSDRoute(dest string) *net.IPNet {
+	prefix := -1
+	if i := strings.Index(dest, "/"); i >= 0 {
+		bits, err := strconv.Atoi(dest[i+1:])
+		if err != nil {
+			return nil
+		}
+		prefix, dest = bits, dest[:i]
+	}
+	octets := strings.Split(dest, ".")
+	if len(octets) > 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	if prefix < 0 {
+		prefix = 8 * len(octets)
+	}
+	if prefix > 32 {
+		return nil
+	}
+	mask := net.CIDRMask(prefix, 32)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// allocatedSize returns the bytes path takes up on disk, less than its size
+// when it is sparse.
+func allocatedSize(path string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Blocks * 512, nil
+}
+
+// findProcesses returns the processes whose executable name contains name
+// and whose command line contains arg.
+func findProcesses(name, arg string) ([]int, error) {
+	out, err := exec.Command("ps", "-axww", "-o", "pid=,args=").Output()
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(filepath.Base(fields[1]), name) || !strings.Contains(line, arg) {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// processAlive reports whether pid still runs.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// pidRunning reports whether any process has pid.
+func pidRunning(pid int) bool {
+	return processAlive(pid)
+}
+
+// mountPoint returns where the filesystem holding path is mounted.
+func mountPoint(path string) string {
+	var st syscall.Stat_t
+	if syscall.Stat(path, &st) != nil {
+		return path
+	}
+	for {
+		parent := filepath.Dir(path)
+		var pst syscall.Stat_t
+		if parent == path || syscall.Stat(parent, &pst) != nil || pst.Dev != st.Dev {
+			return path
+		}
+		path = parent
+	}
+}
@@ -1,6 +1,22 @@
 package qemu
 
-import "os/exec"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/sys/cpu"
+)
 
 func isHyperVInstalled() bool {
 	return false
@@ -18,14 +34,61 @@ func isDeviceGuardEnabled() bool {
 	return false
 }
 
+func checkForwardInterference(d *Driver) error {
+	return nil
+}
+
 func getQemuImgCommand(d *Driver) (string, error) {
 	//TODO checks for Qemu-Img existing!
 	return "qemu-img", nil
 }
 
-func getQemuCommand(d *Driver) (string, error) {
-	//TODO checks for Qemu Process
-	return "qemu-system-x86_64", nil
+// linuxbrewBin is where Homebrew on Linux installs QEMU, which is not on the
+// PATH of docker-machine started from a desktop session.
+const linuxbrewBin = "/home/linuxbrew/.linuxbrew/bin"
+
+func qemuSystemBinary(d *Driver) (string, error) {
+	name := d.arch().binary
+	if d.QemuLocation != "" {
+		return exec.LookPath(filepath.Join(d.QemuLocation, name))
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	if path, err := exec.LookPath(filepath.Join(linuxbrewBin, name)); err == nil {
+		return path, nil
+	}
+	return "", fmt.Errorf("%s not found in PATH", name)
+}
+
+func qemuPath(path string) string {
+	return path
+}
+
+func hostAccels() []string {
+	return []string{"kvm", "tcg"}
+}
+
+func hostAudioDrivers() []string {
+	return []string{"pa", "sdl"}
+}
+
+func hostNetworkModes() []string {
+	return []string{"user", "host-only", "bridge"}
+}
+
+// accelUsable reports whether this user can use the accelerator, KVM
+// needing read and write access to /dev/kvm.
+func accelUsable(accel string) bool {
+	if accel != "kvm" {
+		return true
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
 }
 
 func getQemuAccel(d *Driver) string {
@@ -33,6 +96,360 @@ func getQemuAccel(d *Driver) string {
 	return "-enable-kvm"
 }
 
+func freeDiskSpace(path string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// setTHPDisabled sets the transparent huge page flag of this process, which
+// children such as QEMU inherit.
+func setTHPDisabled(disabled bool) error {
+	const prSetTHPDisable = 41
+	arg := uintptr(0)
+	if disabled {
+		arg = 1
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetTHPDisable, arg, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// watchHostSleep calls onSuspend before the host sleeps and onResume after
+// it woke up. A logind delay inhibitor holds off the suspend until
+// onSuspend returned.
+func watchHostSleep(onSuspend, onResume func()) error {
+	inhibit := func() *exec.Cmd {
+		lock := exec.Command("systemd-inhibit", "--what=sleep", "--mode=delay",
+			"--who=docker-machine-driver-qemu", "--why=Pausing the docker machine", "sleep", "infinity")
+		//The children die with the guard, which stopHelper kills
+		lock.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+		if err := lock.Start(); err != nil {
+			log.Warnf("Could not delay host sleep, the guest may not be paused in time: %v", err)
+			return nil
+		}
+		return lock
+	}
+	lock := inhibit()
+
+	monitor := exec.Command("dbus-monitor", "--system",
+		"type='signal',interface='org.freedesktop.login1.Manager',member='PrepareForSleep'")
+	monitor.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	out, err := monitor.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := monitor.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		switch strings.TrimSpace(scanner.Text()) {
+		case "boolean true":
+			onSuspend()
+			if lock != nil {
+				lock.Process.Kill()
+				lock.Wait()
+				lock = nil
+			}
+		case "boolean false":
+			onResume()
+			if lock == nil {
+				lock = inhibit()
+			}
+		}
+	}
+	return monitor.Wait()
+}
+
+// restrictToOwner makes path readable and writable by its owner only.
+func restrictToOwner(path string) error {
+	return os.Chmod(path, 0600)
+}
+
+func shellCommand(cmdline string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", cmdline)
+}
+
+// filesystemType names the filesystem holding path when it is one the
+// driver cares about.
+func filesystemType(path string) (string, error) {
+	const msdosMagic = 0x4d44
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return "", err
+	}
+	if fs.Type == msdosMagic {
+		return "FAT", nil
+	}
+	return "", nil
+}
+
+// ensureHostOnlyNetwork creates the host-only bridge and its dnsmasq
+// unless they exist, through sudo when not running as root.
+func ensureHostOnlyNetwork() error {
+	if exec.Command("ip", "link", "show", hostOnlyBridge).Run() != nil {
+		log.Infof("Creating the host-only bridge %s...", hostOnlyBridge)
+		setup := fmt.Sprintf("ip link add %[1]s type bridge && ip addr add %[2]s dev %[1]s && ip link set %[1]s up",
+			hostOnlyBridge, hostOnlyHostCIDR)
+		if err := runAsRoot(setup); err != nil {
+			return err
+		}
+	}
+	//qemu-bridge-helper only attaches to bridges it is allowed to
+	allow := fmt.Sprintf("mkdir -p /etc/qemu && (grep -qx 'allow %[1]s' /etc/qemu/bridge.conf 2>/dev/null || echo 'allow %[1]s' >> /etc/qemu/bridge.conf)",
+		hostOnlyBridge)
+	if err := runAsRoot(allow); err != nil {
+		return err
+	}
+
+	pidFile := hostOnlyRunDir + "/" + hostOnlyBridge + ".pid"
+	if data, err := ioutil.ReadFile(pidFile); err == nil {
+		//dnsmasq runs as root, signalling it is not permitted but it is alive
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+				return nil
+			}
+		}
+	}
+	if _, err := exec.LookPath("dnsmasq"); err != nil {
+		return fmt.Errorf("Host-only networking needs dnsmasq")
+	}
+	log.Infof("Starting DHCP on %s...", hostOnlyBridge)
+	dnsmasq := fmt.Sprintf("mkdir -p %s && dnsmasq --port=0 --interface=%s --bind-interfaces --except-interface=lo "+
+		"--dhcp-range=%s --dhcp-leasefile=%s --pid-file=%s",
+		hostOnlyRunDir, hostOnlyBridge, hostOnlyDHCP, hostOnlyLeases, pidFile)
+	return runAsRoot(dnsmasq)
+}
+
+// ensureBridge checks that the host bridge name exists, which the driver
+// leaves to the user as it holds the host's LAN connection, and allows it
+// for qemu-bridge-helper.
+func ensureBridge(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name)); err != nil {
+		return fmt.Errorf("No network interface %s, create a bridge holding the LAN interface first", name)
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name, "bridge")); err != nil {
+		return fmt.Errorf("%s is not a bridge, create a bridge holding it and give that instead", name)
+	}
+	allow := fmt.Sprintf("mkdir -p /etc/qemu && (grep -qx 'allow %[1]s' /etc/qemu/bridge.conf 2>/dev/null || echo 'allow %[1]s' >> /etc/qemu/bridge.conf)",
+		name)
+	return runAsRoot(allow)
+}
+
+// runAsRoot runs the shell command as root, through sudo when needed. The
+// plugin cannot prompt for a password, so sudo has to allow it without.
+func runAsRoot(command string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if os.Geteuid() != 0 {
+		cmd = exec.Command("sudo", "-n", "/bin/sh", "-c", command)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func hostsFilePath() string {
+	return "/etc/hosts"
+}
+
+// writeHostsFile replaces the hosts file by renaming a temporary file next
+// to it over it, so no resolver reads it half written, through sudo unless
+// its directory is writable.
+func writeHostsFile(path string, data []byte) error {
+	if err := writeFileAtomic(path, data, 0644); err == nil || !os.IsPermission(err) {
+		return err
+	}
+	tmp := path + ".tmp"
+	cmd := exec.Command("sudo", "-n", "/bin/sh", "-c", fmt.Sprintf("cat > '%[1]s' && chmod 644 '%[1]s' && mv -f '%[1]s' '%[2]s'", tmp, path))
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Could not update %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func setProcAttr(cmd *exec.Cmd) {
 
 }
+
+//FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+// reflink makes dst share the blocks of src, on filesystems like XFS and
+// btrfs.
+func reflink(src, dst *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// hostCPUFlags returns the CPU features of the host, all of them known.
+func hostCPUFlags() map[string]bool {
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "flags") {
+			flags := cpuFlags(line)
+			known := map[string]bool{}
+			for _, name := range watchedCPUFeatures {
+				known[name] = flags[name]
+			}
+			return known
+		}
+	}
+	return nil
+}
+
+// createTap adds a tap device the current user can open to the host-only
+// bridge, and lets the bridge reach other networks through NAT.
+func createTap(name string) error {
+	tap := fmt.Sprintf("(ip link show %[1]s >/dev/null 2>&1 || ip tuntap add dev %[1]s mode tap user %[2]d) && ip link set %[1]s master %[3]s up",
+		name, os.Getuid(), hostOnlyBridge)
+	nat := fmt.Sprintf("sysctl -qw net.ipv4.ip_forward=1 && (iptables -t nat -C POSTROUTING -s %[1]s ! -o %[2]s -j MASQUERADE 2>/dev/null || "+
+		"iptables -t nat -A POSTROUTING -s %[1]s ! -o %[2]s -j MASQUERADE)", hostOnlySubnet, hostOnlyBridge)
+	return runAsRoot(tap + " && " + nat)
+}
+
+func removeTap(name string) error {
+	return runAsRoot(fmt.Sprintf("! ip link show %[1]s >/dev/null 2>&1 || ip link del %[1]s", name))
+}
+
+// hostNameservers returns the DNS servers of the host a guest can reach,
+// looking past the local stub of systemd-resolved.
+func hostNameservers() []string {
+	for _, path := range []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var servers []string
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "nameserver" && !strings.HasPrefix(fields[1], "127.") && fields[1] != "::1" {
+				servers = append(servers, fields[1])
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// hostRoutes returns the IPv4 routes of the host, which VPNs add for
+// networks that have no local address.
+func hostRoutes() []*net.IPNet {
+	data, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	var routes []*net.IPNet
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		dest, err1 := strconv.ParseUint(fields[1], 16, 32)
+		mask, err2 := strconv.ParseUint(fields[7], 16, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		routes = append(routes, &net.IPNet{
+			IP:   net.IP(routeBytes(dest)),
+			Mask: net.IPMask(routeBytes(mask)),
+		})
+	}
+	return routes
+}
+
+// routeBytes returns the address bytes of a /proc/net/route field. The
+// kernel prints the network order address as a native integer.
+func routeBytes(field uint64) []byte {
+	b := make([]byte, 4)
+	if cpu.IsBigEndian {
+		binary.BigEndian.PutUint32(b, uint32(field))
+	} else {
+		binary.LittleEndian.PutUint32(b, uint32(field))
+	}
+	return b
+}
+
+// allocatedSize returns the bytes path takes up on disk, less than its size
+// when it is sparse.
+func allocatedSize(path string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Blocks * 512, nil
+}
+
+// findProcesses returns the processes whose executable name contains name
+// and one of whose arguments is arg.
+func findProcesses(name, arg string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if !strings.Contains(filepath.Base(args[0]), name) {
+			continue
+		}
+		for _, a := range args[1:] {
+			if a == arg {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+// processAlive reports whether pid runs QEMU, not a process that got the
+// PID of one that exited.
+func processAlive(pid int) bool {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	return err == nil && strings.Contains(string(data), "qemu")
+}
+
+// pidRunning reports whether any process has pid, unlike processAlive which
+// only counts QEMU.
+func pidRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// mountPoint returns where the filesystem holding path is mounted.
+func mountPoint(path string) string {
+	var st syscall.Stat_t
+	if syscall.Stat(path, &st) != nil {
+		return path
+	}
+	for {
+		parent := filepath.Dir(path)
+		var pst syscall.Stat_t
+		if parent == path || syscall.Stat(parent, &pst) != nil || pst.Dev != st.Dev {
+			return path
+		}
+		path = parent
+	}
+}
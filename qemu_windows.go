@@ -1,11 +1,20 @@
 package qemu
 
 import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -70,14 +79,167 @@ func isDeviceGuardEnabled() bool {
 	return false
 }
 
+// checkForwardInterference explains an unreachable machine when the cause
+// is on the host: an antivirus removing or killing QEMU, or the firewall
+// or an antivirus resetting the loopback connections to the SSH forward.
+func checkForwardInterference(d *Driver) error {
+	qemuCmd, err := getQemuCommand(d)
+	if err != nil {
+		return nil
+	}
+	if !d.qemuRunning() {
+		if _, err := os.Stat(qemuCmd); os.IsNotExist(err) {
+			return fmt.Errorf("%s has disappeared, it may have been quarantined by an antivirus%s", qemuCmd, antivirusHint())
+		}
+		return nil
+	}
+	if !isForwardReset(d.forwardedSSHPort()) {
+		return nil
+	}
+	if isFirewallBlocking(qemuCmd) {
+		return fmt.Errorf("Connections to the SSH forward 127.0.0.1:%d of %s are reset, a Windows Defender Firewall rule blocks %s", d.forwardedSSHPort(), d.MachineName, qemuCmd)
+	}
+	return fmt.Errorf("Connections to the SSH forward 127.0.0.1:%d of %s are reset, add a firewall and antivirus exception for %s%s", d.forwardedSSHPort(), d.MachineName, qemuCmd, antivirusHint())
+}
+
+// isForwardReset tells whether connections to a forward QEMU is listening
+// on are reset instead of reaching the guest. A refused connection only
+// means nothing listens, such as a QEMU that exited, so only a reset after
+// the connection was accepted counts.
+func isForwardReset(port int) bool {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), 2*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	return err != nil && isResetError(err)
+}
+
+func isResetError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			err = sysErr.Err
+		}
+	}
+	return err == windows.WSAECONNRESET || err == windows.WSAECONNABORTED
+}
+
+// isFirewallBlocking looks for an enabled inbound firewall rule blocking
+// program.
+func isFirewallBlocking(program string) bool {
+	output, err := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=all", "dir=in", "verbose").Output()
+	if err != nil {
+		log.Debugf("Could not list the firewall rules: %v", err)
+		return false
+	}
+	for _, rule := range strings.Split(strings.Replace(string(output), "\r", "", -1), "\n\n") {
+		var enabled, block, matches bool
+		for _, line := range strings.Split(rule, "\n") {
+			fields := strings.SplitN(line, ":", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(fields[1])
+			switch strings.TrimSpace(fields[0]) {
+			case "Enabled":
+				enabled = value == "Yes"
+			case "Action":
+				block = value == "Block"
+			case "Program":
+				matches = strings.EqualFold(value, program)
+			}
+		}
+		if enabled && block && matches {
+			return true
+		}
+	}
+	return false
+}
+
+// antivirusHint names the antivirus products registered with the Windows
+// Security Center.
+func antivirusHint() string {
+	output, err := exec.Command("wmic", `/namespace:\\root\SecurityCenter2`, "path", "AntiVirusProduct", "get", "displayName").Output()
+	if err != nil {
+		return ""
+	}
+	var products []string
+	for _, line := range strings.Split(string(output), "\n")[1:] {
+		if line = strings.TrimSpace(line); line != "" {
+			products = append(products, line)
+		}
+	}
+	if len(products) == 0 {
+		return ""
+	}
+	return " (installed: " + strings.Join(products, ", ") + ")"
+}
+
 func getQemuImgCommand(d *Driver) (string, error) {
-	//TODO checks for Qemu-Img Exe existing!
-	return d.QemuLocation + "\\qemu-img.exe", nil
+	return qemuToolPath(d, "qemu-img.exe")
 }
 
-func getQemuCommand(d *Driver) (string, error) {
-	//TODO checks for Qemu Exe existing!
-	return d.QemuLocation + "\\qemu-system-x86_64.exe", nil
+func qemuSystemBinary(d *Driver) (string, error) {
+	return qemuToolPath(d, d.arch().binary+".exe")
+}
+
+// qemuToolPath locates the QEMU executable name inside QemuLocation, which
+// may be quoted, use forward slashes, have a trailing separator, be drive
+// relative or be a UNC share. Without a location the PATH is searched.
+func qemuToolPath(d *Driver, name string) (string, error) {
+	location := strings.Trim(strings.TrimSpace(d.QemuLocation), `"'`)
+	if location == "" {
+		return exec.LookPath(name)
+	}
+	location, err := filepath.Abs(filepath.FromSlash(location))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(location, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s not found in QEMU location %s", name, d.QemuLocation)
+	}
+	return longPath(path), nil
+}
+
+// qemuPath makes a store path safe to hand to QEMU.
+func qemuPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return longPath(path)
+}
+
+// longPath adds the extended-length prefix to paths that would otherwise hit
+// the MAX_PATH limit of the Win32 API.
+func longPath(path string) string {
+	if len(path) < 248 || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+func hostAccels() []string {
+	return []string{"whpx", "hax", "tcg"}
+}
+
+func hostAudioDrivers() []string {
+	return []string{"dsound", "sdl"}
+}
+
+func hostNetworkModes() []string {
+	return []string{"user"}
+}
+
+// accelUsable reports whether this user can use the accelerator. WHPX and
+// HAXM are only known to fail once QEMU starts.
+func accelUsable(accel string) bool {
+	return true
 }
 
 func getQemuAccel(d *Driver) string {
@@ -85,6 +247,136 @@ func getQemuAccel(d *Driver) string {
 	return "-enable-hax"
 }
 
+func freeDiskSpace(path string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
+
+func setTHPDisabled(disabled bool) error {
+	return nil
+}
+
+var procPowerRegisterSuspendResumeNotification = windows.NewLazySystemDLL("powrprof.dll").NewProc("PowerRegisterSuspendResumeNotification")
+
+const (
+	deviceNotifyCallback  = 2
+	pbtAPMSuspend         = 0x4
+	pbtAPMResumeAutomatic = 0x12
+)
+
+type deviceNotifySubscribeParameters struct {
+	callback uintptr
+	context  uintptr
+}
+
+// sleepSubscription is kept for the lifetime of the process since Windows
+// holds on to it.
+var sleepSubscription deviceNotifySubscribeParameters
+
+// watchHostSleep calls onSuspend before the host sleeps and onResume after
+// it woke up. Windows waits for the callback before suspending.
+func watchHostSleep(onSuspend, onResume func()) error {
+	sleepSubscription.callback = windows.NewCallback(func(context uintptr, event uint32, setting uintptr) uintptr {
+		switch event {
+		case pbtAPMSuspend:
+			onSuspend()
+		case pbtAPMResumeAutomatic:
+			go onResume()
+		}
+		return 0
+	})
+	var handle uintptr
+	r, _, _ := procPowerRegisterSuspendResumeNotification.Call(deviceNotifyCallback,
+		uintptr(unsafe.Pointer(&sleepSubscription)), uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	for {
+		time.Sleep(time.Hour)
+	}
+}
+
+// restrictToOwner replaces the inherited ACL of path with one granting
+// access to the current user, SYSTEM and the Administrators only. Mode bits
+// mean nothing on Windows.
+func restrictToOwner(path string) error {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return err
+	}
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return err
+	}
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return err
+	}
+	var entries []windows.EXPLICIT_ACCESS
+	for _, sid := range []*windows.SID{user.User.Sid, system, admins} {
+		entries = append(entries, windows.EXPLICIT_ACCESS{
+			AccessPermissions: windows.GENERIC_ALL,
+			AccessMode:        windows.GRANT_ACCESS,
+			Inheritance:       windows.NO_INHERITANCE,
+			Trustee: windows.TRUSTEE{
+				TrusteeForm:  windows.TRUSTEE_IS_SID,
+				TrusteeValue: windows.TrusteeValueFromSID(sid),
+			},
+		})
+	}
+	acl, err := windows.ACLFromEntries(entries, nil)
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, acl, nil)
+}
+
+func ensureHostOnlyNetwork() error {
+	return fmt.Errorf("Host-only networking needs a Linux host")
+}
+
+func ensureBridge(name string) error {
+	return fmt.Errorf("Bridged networking needs a Linux host")
+}
+
+func hostsFilePath() string {
+	return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+}
+
+// writeHostsFile replaces the hosts file by renaming a temporary file next
+// to it over it, which needs an elevated prompt.
+func writeHostsFile(path string, data []byte) error {
+	return writeFileAtomic(path, data, 0644)
+}
+
+func shellCommand(cmdline string) *exec.Cmd {
+	cmd := exec.Command("cmd.exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: "/C " + cmdline}
+	return cmd
+}
+
+// filesystemType names the filesystem of the volume holding path.
+func filesystemType(path string) (string, error) {
+	root := filepath.VolumeName(path) + `\`
+	rootPtr, err := windows.UTF16PtrFromString(root)
+	if err != nil {
+		return "", err
+	}
+	name := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumeInformation(rootPtr, nil, 0, nil, nil, nil, &name[0], uint32(len(name))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(name), nil
+}
+
 func setProcAttr(cmd *exec.Cmd) {
 	//Windows Specific Section!
 	const CreateNewProcessGroup = 0x00000200
@@ -94,3 +386,113 @@ func setProcAttr(cmd *exec.Cmd) {
 		CreationFlags: CreateNewProcessGroup | DetachedProcess,
 	}
 }
+
+func reflink(src, dst *os.File) error {
+	return fmt.Errorf("Block cloning is not supported on Windows")
+}
+
+var procIsProcessorFeaturePresent = windows.NewLazySystemDLL("kernel32.dll").NewProc("IsProcessorFeaturePresent")
+
+// processorFeatures maps CPU features to their PF_ constants. Windows has
+// none for the other features, they are reported as unknown.
+var processorFeatures = map[string]uintptr{
+	"ssse3":   36,
+	"sse4_1":  37,
+	"sse4_2":  38,
+	"avx":     39,
+	"avx2":    40,
+	"avx512f": 41,
+}
+
+func hostCPUFlags() map[string]bool {
+	if procIsProcessorFeaturePresent.Find() != nil {
+		return nil
+	}
+	flags := map[string]bool{}
+	for name, feature := range processorFeatures {
+		present, _, _ := procIsProcessorFeaturePresent.Call(feature)
+		flags[name] = present != 0
+	}
+	return flags
+}
+
+func createTap(name string) error {
+	return fmt.Errorf("Tap devices are not supported on Windows")
+}
+
+func removeTap(name string) error {
+	return nil
+}
+
+func hostNameservers() []string {
+	return nil
+}
+
+// hostRoutes is not implemented on Windows, where VPN adapters show up
+// with their own addresses instead.
+func hostRoutes() []*net.IPNet {
+	return nil
+}
+
+var procGetCompressedFileSizeW = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetCompressedFileSizeW")
+
+// allocatedSize returns the bytes path takes up on disk, less than its size
+// when it is sparse or compressed.
+func allocatedSize(path string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var high uint32
+	low, _, err := procGetCompressedFileSizeW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&high)))
+	if uint32(low) == 0xffffffff && err != windows.ERROR_SUCCESS {
+		return 0, err
+	}
+	return int64(high)<<32 | int64(uint32(low)), nil
+}
+
+// findProcesses returns the processes whose executable name contains name
+// and whose command line contains arg.
+func findProcesses(name, arg string) ([]int, error) {
+	output, err := exec.Command("wmic", "process", "where", fmt.Sprintf("name like '%%%s%%'", name), "get", "CommandLine,ProcessId", "/format:csv").Output()
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.LastIndex(line, ",")
+		if i < 0 || !strings.Contains(line, arg) {
+			continue
+		}
+		if pid, err := strconv.Atoi(line[i+1:]); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// processAlive reports whether pid still runs, through its process handle.
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	const stillActive = 259
+	return windows.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
+
+// pidRunning reports whether any process has pid.
+func pidRunning(pid int) bool {
+	return processAlive(pid)
+}
+
+// mountPoint returns the volume holding path.
+func mountPoint(path string) string {
+	if volume := filepath.VolumeName(path); volume != "" {
+		return volume + `\`
+	}
+	return path
+}
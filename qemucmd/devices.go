@@ -0,0 +1,166 @@
+package qemucmd
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Option is an extra key=value of a typed option, for properties the
+// types do not name.
+type Option struct {
+	Key, Value string
+}
+
+func setAll(o *Opts, extra []Option) *Opts {
+	for _, e := range extra {
+		o.Set(e.Key, e.Value)
+	}
+	return o
+}
+
+// HostForward forwards a host TCP or UDP port to a guest port on the user
+// network.
+type HostForward struct {
+	// Protocol is tcp or udp, tcp when empty.
+	Protocol  string
+	HostAddr  string
+	HostPort  int
+	GuestPort int
+}
+
+func (f HostForward) String() string {
+	protocol := f.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return fmt.Sprintf("%s:%s:%d-:%d", protocol, f.HostAddr, f.HostPort, f.GuestPort)
+}
+
+// NetDev is a -netdev network backend.
+type NetDev struct {
+	Backend      string
+	ID           string
+	Net          string
+	DHCPStart    string
+	HostForwards []HostForward
+	Extra        []Option
+}
+
+// Build returns the -netdev value.
+func (n NetDev) Build() (string, error) {
+	o := NewOpts(n.Backend).
+		Set("id", n.ID).
+		SetIf("net", n.Net).
+		SetIf("dhcpstart", n.DHCPStart)
+	for _, f := range n.HostForwards {
+		o.Set("hostfwd", f.String())
+	}
+	return setAll(o, n.Extra).Build()
+}
+
+// Drive is a -drive block device.
+type Drive struct {
+	File      string
+	Interface string
+	Format    string
+	Media     string
+	ReadOnly  bool
+	WError    string
+	RError    string
+	Extra     []Option
+}
+
+// Build returns the -drive value.
+func (d Drive) Build() (string, error) {
+	o := NewOpts("").
+		Set("file", d.File).
+		SetIf("if", d.Interface).
+		SetIf("format", d.Format).
+		SetIf("media", d.Media)
+	if d.ReadOnly {
+		o.Set("readonly", "on")
+	}
+	o.SetIf("werror", d.WError).SetIf("rerror", d.RError)
+	return setAll(o, d.Extra).Build()
+}
+
+// Socket is a character device listening on a local TCP port, in the
+// legacy "telnet:host:port,server,nowait" form -monitor and -qmp take.
+type Socket struct {
+	Protocol string
+	Host     string
+	Port     int
+}
+
+// Build returns the socket spec.
+func (s Socket) Build() (string, error) {
+	return NewOpts(s.Protocol + ":" + s.Host + ":" + strconv.Itoa(s.Port)).
+		Flag("server").
+		Flag("nowait").
+		Build()
+}
+
+// Chardev is a -chardev character device.
+type Chardev struct {
+	Backend string
+	ID      string
+	Path    string
+	Extra   []Option
+}
+
+// Build returns the -chardev value.
+func (c Chardev) Build() (string, error) {
+	o := NewOpts(c.Backend).
+		Set("id", c.ID).
+		SetIf("path", c.Path)
+	return setAll(o, c.Extra).Build()
+}
+
+// Device is a -device frontend.
+type Device struct {
+	Driver string
+	Props  []Option
+}
+
+// Build returns the -device value.
+func (d Device) Build() (string, error) {
+	return setAll(NewOpts(d.Driver), d.Props).Build()
+}
+
+// Builder is any typed option.
+type Builder interface {
+	Build() (string, error)
+}
+
+// Command collects QEMU arguments, keeping the first error of a typed
+// option so callers check once.
+type Command struct {
+	args []string
+	err  error
+}
+
+// Add appends literal arguments.
+func (c *Command) Add(args ...string) *Command {
+	c.args = append(c.args, args...)
+	return c
+}
+
+// Option appends flag followed by the built value of b.
+func (c *Command) Option(flag string, b Builder) *Command {
+	value, err := b.Build()
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		return c
+	}
+	return c.Add(flag, value)
+}
+
+// Args returns the arguments, or the first error.
+func (c *Command) Args() ([]string, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.args, nil
+}
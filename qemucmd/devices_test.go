@@ -0,0 +1,91 @@
+package qemucmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetDevHostForwards(t *testing.T) {
+	got, err := NetDev{
+		Backend:   "user",
+		ID:        "mynet0",
+		Net:       "10.0.2.0/24",
+		DHCPStart: "10.0.2.15",
+		HostForwards: []HostForward{
+			{HostAddr: "127.0.0.1", HostPort: 2222, GuestPort: 22},
+			{Protocol: "udp", HostPort: 5353, GuestPort: 53},
+		},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "user,id=mynet0,net=10.0.2.0/24,dhcpstart=10.0.2.15," +
+		"hostfwd=tcp:127.0.0.1:2222-:22,hostfwd=udp::5353-:53"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDriveBuild(t *testing.T) {
+	got, err := Drive{
+		File:      "/machines/a,b/disk.qcow2",
+		Interface: "virtio",
+		Format:    "qcow2",
+		ReadOnly:  true,
+		WError:    "stop",
+		RError:    "report",
+		Extra:     []Option{{Key: "serial", Value: "dm-data"}},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file=/machines/a,,b/disk.qcow2,if=virtio,format=qcow2,readonly=on,werror=stop,rerror=report,serial=dm-data"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	for name, b := range map[string]Builder{
+		"drive file with newline": Drive{File: "disk\n.img"},
+		"drive extra key with =":  Drive{File: "disk.img", Extra: []Option{{Key: "a=b", Value: "c"}}},
+		"device driver with =":    Device{Driver: "virtio-net-pci,netdev=x"},
+		"device empty prop key":   Device{Driver: "virtio-rng-pci", Props: []Option{{Value: "x"}}},
+		"netdev id with newline":  NetDev{Backend: "user", ID: "a\rb"},
+	} {
+		if got, err := b.Build(); err == nil {
+			t.Errorf("%s: Build returned %q", name, got)
+		}
+	}
+}
+
+func TestDeviceBuild(t *testing.T) {
+	got, err := Device{Driver: "virtio-net-pci", Props: []Option{
+		{Key: "netdev", Value: "bridged0"},
+		{Key: "mac", Value: "52:54:00:12:34:56"},
+	}}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "virtio-net-pci,netdev=bridged0,mac=52:54:00:12:34:56"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCommandKeepsFirstError(t *testing.T) {
+	c := &Command{}
+	c.Add("-m", "1024").
+		Option("-device", Device{Driver: "bad=driver"}).
+		Option("-drive", Drive{File: "a\nb"})
+	if _, err := c.Args(); err == nil || err.Error() != `Invalid QEMU option: value "bad=driver" cannot contain '='` {
+		t.Errorf("got error %v, want the one of the device", err)
+	}
+
+	args, err := (&Command{}).Add("-m", "1024").Option("-netdev", NetDev{Backend: "user", ID: "n0"}).Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-m", "1024", "-netdev", "user,id=n0"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,107 @@
+// Package qemucmd builds QEMU command lines. Options are assembled from
+// typed values instead of format strings, and every value is escaped, so
+// new devices cannot get the option syntax wrong.
+package qemucmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Opts builds a comma separated QEMU option string such as
+// "user,id=mynet0,hostfwd=...". Values are escaped following QEMU's rule
+// that a literal comma is written as two, so a path or name containing a
+// comma cannot inject further options.
+type Opts struct {
+	parts []string
+	err   error
+}
+
+// NewOpts starts an option string with the implied first value, usually
+// the backend or driver name. An empty string starts without one.
+func NewOpts(implied string) *Opts {
+	o := &Opts{}
+	if implied != "" {
+		if strings.Contains(implied, "=") {
+			o.fail("value %q cannot contain '='", implied)
+		}
+		o.parts = append(o.parts, Escape(implied))
+	}
+	return o
+}
+
+// Set appends key=value.
+func (o *Opts) Set(key, value string) *Opts {
+	o.checkKey(key)
+	if strings.ContainsAny(value, "\x00\n\r") {
+		o.fail("value for %s contains control characters", key)
+	}
+	o.parts = append(o.parts, key+"="+Escape(value))
+	return o
+}
+
+// Setf appends key=value with the value built from format.
+func (o *Opts) Setf(key, format string, args ...interface{}) *Opts {
+	return o.Set(key, fmt.Sprintf(format, args...))
+}
+
+// SetIf appends key=value unless value is empty.
+func (o *Opts) SetIf(key, value string) *Opts {
+	if value == "" {
+		return o
+	}
+	return o.Set(key, value)
+}
+
+// Flag appends a bare boolean option such as "server".
+func (o *Opts) Flag(name string) *Opts {
+	o.checkKey(name)
+	o.parts = append(o.parts, name)
+	return o
+}
+
+// Build returns the option string, or the first validation error.
+func (o *Opts) Build() (string, error) {
+	if o.err != nil {
+		return "", o.err
+	}
+	return strings.Join(o.parts, ","), nil
+}
+
+func (o *Opts) checkKey(key string) {
+	if key == "" || strings.ContainsAny(key, ",=") {
+		o.fail("invalid option name %q", key)
+	}
+}
+
+func (o *Opts) fail(format string, args ...interface{}) {
+	if o.err == nil {
+		o.err = fmt.Errorf("Invalid QEMU option: "+format, args...)
+	}
+}
+
+// Escape escapes a value for use inside a comma separated QEMU option
+// string, where a literal comma is written as two.
+func Escape(value string) string {
+	return strings.Replace(value, ",", ",,", -1)
+}
+
+// Split splits an option string into its unescaped parts, reversing Opts.
+func Split(opts string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(opts); i++ {
+		if opts[i] == ',' {
+			if i+1 < len(opts) && opts[i+1] == ',' {
+				part.WriteByte(',')
+				i++
+				continue
+			}
+			parts = append(parts, part.String())
+			part.Reset()
+			continue
+		}
+		part.WriteByte(opts[i])
+	}
+	return append(parts, part.String())
+}
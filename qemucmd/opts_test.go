@@ -0,0 +1,63 @@
+package qemucmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptsEscapesCommas(t *testing.T) {
+	got, err := NewOpts("file").
+		Set("path", "/tmp/a,b").
+		Setf("size", "%dM", 64).
+		SetIf("skipped", "").
+		Flag("server").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file,path=/tmp/a,,b,size=64M,server"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOptsInjectedOption(t *testing.T) {
+	got, err := NewOpts("").Set("file", "disk.img,format=raw").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := Split(got)
+	if len(parts) != 1 || parts[0] != "file=disk.img,format=raw" {
+		t.Errorf("%q splits into %q, want a single file option", got, parts)
+	}
+}
+
+func TestOptsErrors(t *testing.T) {
+	for name, o := range map[string]*Opts{
+		"implied value with =": NewOpts("user=x"),
+		"empty key":            NewOpts("user").Set("", "x"),
+		"key with comma":       NewOpts("user").Set("a,b", "x"),
+		"key with =":           NewOpts("user").Flag("a=b"),
+		"newline in value":     NewOpts("user").Set("id", "a\nb"),
+		"NUL in value":         NewOpts("user").Set("id", "a\x00b"),
+	} {
+		if _, err := o.Build(); err == nil {
+			t.Errorf("%s: Build succeeded", name)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for opts, want := range map[string][]string{
+		"":             {""},
+		"user":         {"user"},
+		"a,b=c":        {"a", "b=c"},
+		"file=a,,b,c":  {"file=a,b", "c"},
+		"x=,,,,":       {"x=,,"},
+		"file=a,,,b=c": {"file=a,", "b=c"},
+	} {
+		if got := Split(opts); !reflect.DeepEqual(got, want) {
+			t.Errorf("Split(%q) = %q, want %q", opts, got, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package qemutest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// Script configures a fake QEMU through the file named by
+// FAKE_QEMU_SCRIPT.
+type Script struct {
+	// Status is what query-status reports, such as "guest-panicked".
+	Status string `json:"status"`
+	// Responses are returned for QMP commands without a built in behavior.
+	Responses map[string]interface{} `json:"responses"`
+	// NoSSH leaves the forwarded SSH port closed, as for a guest that
+	// never boots.
+	NoSSH bool `json:"nossh"`
+	// ArgsLog receives the command line, one argument per line.
+	ArgsLog string `json:"args_log"`
+	// CommandLog receives the QMP and monitor commands, one per line.
+	CommandLog string `json:"command_log"`
+	// IgnorePowerdown keeps the guest running on system_powerdown, as a
+	// guest without ACPI support does.
+	IgnorePowerdown bool `json:"ignore_powerdown"`
+}
+
+// probeOutput answers "<option> help" probes.
+var probeOutput = map[string]string{
+	"-accel":   "Accelerators supported in QEMU binary:\ntcg",
+	"-device":  "name \"virtio-net-pci\", bus PCI, alias \"virtio-net\"\nname \"pvpanic\", bus ISA\nname \"e1000\", bus PCI",
+	"-machine": "Supported machines are:\npc                   Standard PC (i440FX + PIIX, 1996) (default)\nq35                  Standard PC (Q35 + ICH9, 2009)",
+	"-cpu":     "x86 qemu64               QEMU Virtual CPU version 2.5+",
+}
+
+// helpOutput answers -help probes with the options probed for.
+const helpOutput = "usage: qemu-system-x86_64 [options] [disk_image]\n\n" +
+	"-action reboot=reboot|shutdown\n" +
+	"                   action when guest reboots [default=reset]\n" +
+	"-no-shutdown    stop before shutdown"
+
+// BuildFake compiles the stub qemu-system binary into dir and returns its
+// path, for --qemu-binary. Copies named qemu-img and ssh stand in for the
+// disk tool and the SSH client of a guest that accepts every command, for
+// dir on the PATH.
+func BuildFake(dir string) (string, error) {
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	path := filepath.Join(dir, "qemu-system-x86_64"+exe)
+	out, err := exec.Command("go", "build", "-o", path,
+		"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemutest/fakeqemu").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Building the fake QEMU failed: %v: %s", err, out)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, tool := range []string{"qemu-img", "ssh"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, tool+exe), data, 0755); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// WriteScript saves script for fake QEMUs started with
+// FAKE_QEMU_SCRIPT=path.
+func WriteScript(path string, script Script) error {
+	data, err := json.Marshal(script)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// RunFake is the main function of the stub binary. It answers the probes
+// the driver runs, then serves the monitor, QMP and the SSH and engine
+// forwards given on the command line until told to quit.
+func RunFake(args []string) error {
+	for i, arg := range args {
+		switch {
+		case arg == "--version" || arg == "-version":
+			fmt.Println("QEMU emulator version 8.0.0 (fake)")
+			return nil
+		case arg == "-help" || arg == "--help":
+			fmt.Println(helpOutput)
+			return nil
+		case i+1 < len(args) && args[i+1] == "help":
+			fmt.Println(probeOutput[arg])
+			return nil
+		}
+	}
+
+	var script Script
+	if path := os.Getenv("FAKE_QEMU_SCRIPT"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &script); err != nil {
+			return err
+		}
+	}
+	if script.ArgsLog != "" {
+		if err := ioutil.WriteFile(script.ArgsLog, []byte(strings.Join(args, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	var once sync.Once
+	quit := make(chan struct{})
+	onQuit := func() { once.Do(func() { close(quit) }) }
+	var logMu sync.Mutex
+	logCommand := func(cmd string) {
+		if script.CommandLog == "" {
+			return
+		}
+		logMu.Lock()
+		defer logMu.Unlock()
+		f, err := os.OpenFile(script.CommandLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		fmt.Fprintln(f, cmd)
+	}
+	qmp := &QMPServer{Responses: script.Responses, Status: script.Status, OnQuit: onQuit,
+		IgnorePowerdown: script.IgnorePowerdown, OnCommand: logCommand}
+	monitor := &MonitorServer{OnQuit: onQuit, IgnorePowerdown: script.IgnorePowerdown, OnCommand: logCommand}
+
+	for i := 0; i+1 < len(args); i++ {
+		value := args[i+1]
+		switch args[i] {
+		case "-monitor":
+			if err := listen(socketAddr(value), monitor.Serve); err != nil {
+				return err
+			}
+		case "-qmp":
+			if err := listen(socketAddr(value), qmp.Serve); err != nil {
+				return err
+			}
+		case "-netdev":
+			for _, fwd := range hostForwards(value) {
+				if fwd.GuestPort == 22 && script.NoSSH {
+					continue
+				}
+				addr := net.JoinHostPort(fwd.HostAddr, strconv.Itoa(fwd.HostPort))
+				if err := listen(addr, serveBanner(fwd.GuestPort)); err != nil {
+					return err
+				}
+			}
+		case "-D":
+			ioutil.WriteFile(value, nil, 0644)
+		case "-pidfile":
+			if err := ioutil.WriteFile(value, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+				return err
+			}
+			//QEMU removes its PID file as it exits
+			defer os.Remove(value)
+		}
+	}
+	<-quit
+	return nil
+}
+
+func listen(addr string, serve func(net.Listener) error) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go serve(ln)
+	return nil
+}
+
+// socketAddr returns host:port of a "telnet:host:port,server,nowait" spec.
+func socketAddr(spec string) string {
+	fields := strings.SplitN(qemucmd.Split(spec)[0], ":", 2)
+	if len(fields) != 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// hostForwards parses the hostfwd options of a user -netdev.
+func hostForwards(netdev string) []qemucmd.HostForward {
+	var fwds []qemucmd.HostForward
+	for _, part := range qemucmd.Split(netdev) {
+		var fwd qemucmd.HostForward
+		spec := strings.TrimPrefix(part, "hostfwd=")
+		if spec == part {
+			continue
+		}
+		//tcp:127.0.0.1:2222-:22
+		host := strings.SplitN(strings.TrimPrefix(spec, "tcp:"), "-", 2)
+		if len(host) != 2 {
+			continue
+		}
+		h, p, err := net.SplitHostPort(host[0])
+		if err != nil {
+			continue
+		}
+		fwd.HostAddr = h
+		fwd.HostPort, _ = strconv.Atoi(p)
+		fwd.GuestPort, _ = strconv.Atoi(strings.TrimPrefix(host[1], ":"))
+		fwds = append(fwds, fwd)
+	}
+	return fwds
+}
+
+// serveBanner answers like the guest service behind the forward: an SSH
+// banner on 22, nothing on other ports.
+func serveBanner(guestPort int) func(net.Listener) error {
+	return func(ln net.Listener) error {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			if guestPort == 22 {
+				fmt.Fprint(conn, "SSH-2.0-FakeQEMU\r\n")
+			}
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Command fakeqemu is a stub qemu-system binary, see qemutest.RunFake. Run
+// as qemu-img or ssh it stubs those, see qemutest.RunFakeImg and
+// qemutest.RunFakeSSH.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemutest"
+)
+
+func main() {
+	var err error
+	switch strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") {
+	case "qemu-img":
+		err = qemutest.RunFakeImg(os.Args[1:])
+	case "ssh":
+		err = qemutest.RunFakeSSH(os.Args[1:])
+	default:
+		err = qemutest.RunFake(os.Args[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,213 @@
+// Package qemutest fakes QEMU for exercising the driver's lifecycle on
+// machines without virtualization: a stub qemu-system binary and scripted
+// QMP and HMP monitor servers it runs.
+package qemutest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// defaultResponses describe a TCG guest without extra devices.
+var defaultResponses = map[string]interface{}{
+	"query-kvm":   map[string]bool{"enabled": false, "present": false},
+	"query-block": []interface{}{},
+	"query-pci":   []interface{}{},
+}
+
+// QMPServer is a scripted QMP server. Commands without a built in
+// behavior return the value in Responses, or CommandNotFound.
+type QMPServer struct {
+	// Responses maps command names to their return values.
+	Responses map[string]interface{}
+	// Status is what query-status reports, "running" by default.
+	Status string
+	// OnQuit is called when a client sends quit, or system_powerdown
+	// unless IgnorePowerdown is set.
+	OnQuit func()
+	// IgnorePowerdown keeps the guest running on system_powerdown.
+	IgnorePowerdown bool
+	// OnCommand is called with every command received.
+	OnCommand func(cmd string)
+
+	mu       sync.Mutex
+	commands []string
+	clients  []net.Conn
+}
+
+// Commands returns the commands received so far.
+func (s *QMPServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Emit sends an asynchronous event to all connected clients.
+func (s *QMPServer) Emit(event string, data interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		json.NewEncoder(c).Encode(map[string]interface{}{"event": event, "data": data})
+	}
+}
+
+// Serve accepts QMP clients on ln until it is closed.
+func (s *QMPServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *QMPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.clients = append(s.clients, conn)
+	s.mu.Unlock()
+	enc := json.NewEncoder(conn)
+	enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{
+		"version":      map[string]interface{}{"qemu": map[string]int{"major": 8, "minor": 0, "micro": 0}},
+		"capabilities": []string{},
+	}})
+	dec := json.NewDecoder(conn)
+	for {
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, req.Execute)
+		s.mu.Unlock()
+		if s.OnCommand != nil {
+			s.OnCommand(req.Execute)
+		}
+		ret, err := s.handle(req.Execute)
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": map[string]string{"class": "CommandNotFound", "desc": err.Error()}})
+			continue
+		}
+		enc.Encode(map[string]interface{}{"return": ret})
+		//QEMU closes the connection as it exits, the fake guest powers
+		//off right away
+		if req.Execute == "quit" || req.Execute == "system_powerdown" && !s.IgnorePowerdown {
+			if s.OnQuit != nil {
+				s.OnQuit()
+			}
+			return
+		}
+	}
+}
+
+func (s *QMPServer) handle(cmd string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "qmp_capabilities", "quit", "system_powerdown":
+		return map[string]interface{}{}, nil
+	case "stop":
+		s.Status = "paused"
+		return map[string]interface{}{}, nil
+	case "cont":
+		s.Status = "running"
+		return map[string]interface{}{}, nil
+	case "query-status":
+		status := s.Status
+		if status == "" {
+			status = "running"
+		}
+		return map[string]interface{}{"status": status, "running": status == "running"}, nil
+	case "human-monitor-command":
+		return "", nil
+	}
+	if ret, ok := s.Responses[cmd]; ok {
+		return ret, nil
+	}
+	if ret, ok := defaultResponses[cmd]; ok {
+		return ret, nil
+	}
+	return nil, fmt.Errorf("The command %s has not been found", cmd)
+}
+
+// MonitorServer is a human monitor on a telnet port, as --qemu-monitor-port
+// adds and machines created without a QMP port are controlled through.
+type MonitorServer struct {
+	// OnQuit is called when a client sends q or quit, or system_powerdown
+	// unless IgnorePowerdown is set.
+	OnQuit func()
+	// IgnorePowerdown keeps the guest running on system_powerdown.
+	IgnorePowerdown bool
+	// OnCommand is called with every command received.
+	OnCommand func(cmd string)
+
+	mu       sync.Mutex
+	commands []string
+	paused   bool
+}
+
+// Commands returns the commands received so far.
+func (s *MonitorServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Serve accepts monitor clients on ln until it is closed.
+func (s *MonitorServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *MonitorServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, "QEMU 8.0.0 monitor - type 'help' for more information\r\n(qemu) ")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if s.OnCommand != nil {
+			s.OnCommand(cmd)
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		switch cmd {
+		case "stop":
+			s.paused = true
+		case "cont":
+			s.paused = false
+		case "info status":
+			status := "running"
+			if s.paused {
+				status = "paused"
+			}
+			fmt.Fprintf(conn, "VM status: %s\r\n", status)
+		}
+		s.mu.Unlock()
+		powerdown := cmd == "system_powerdown" && !s.IgnorePowerdown
+		if powerdown {
+			//The guest powers off after the command returned
+			fmt.Fprint(conn, "(qemu) ")
+		}
+		if (cmd == "q" || cmd == "quit" || powerdown) && s.OnQuit != nil {
+			s.OnQuit()
+			return
+		}
+		fmt.Fprint(conn, "(qemu) ")
+	}
+}
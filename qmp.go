@@ -0,0 +1,130 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const qmpTimeout = 5 * time.Second
+
+// qmpClient is a minimal client for the QEMU Machine Protocol. Commands are
+// executed synchronously, asynchronous events received in between are
+// skipped.
+type qmpClient struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("QMP %s: %s", e.Class, e.Desc)
+}
+
+type qmpResponse struct {
+	Greeting json.RawMessage `json:"QMP"`
+	Event    string          `json:"event"`
+	Return   json.RawMessage `json:"return"`
+	Error    *qmpError       `json:"error"`
+}
+
+// dialQMP connects to the QMP server on port and negotiates capabilities.
+func dialQMP(port int) (*qmpClient, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), qmpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &qmpClient{conn: conn, dec: json.NewDecoder(conn)}
+
+	var greeting qmpResponse
+	conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if greeting.Greeting == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+	if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// execute runs cmd with the optional args and decodes the return value into
+// result when it is not nil.
+func (c *qmpClient) execute(cmd string, args interface{}, result interface{}) error {
+	req := map[string]interface{}{"execute": cmd}
+	if args != nil {
+		req["arguments"] = args
+	}
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return err
+	}
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return err
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || resp.Return == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Return, result)
+	}
+}
+
+// hmp runs a human monitor command through QMP and returns its output.
+func (c *qmpClient) hmp(cmd string) (string, error) {
+	var out string
+	err := c.execute("human-monitor-command", map[string]string{"command-line": cmd}, &out)
+	return out, err
+}
+
+// status returns the run state of the guest, such as running, paused or
+// io-error.
+func (c *qmpClient) status() (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	err := c.execute("query-status", nil, &status)
+	return status.Status, err
+}
+
+// quit makes QEMU exit and waits until it closed the connection, which it
+// does once the guest is torn down.
+func (c *qmpClient) quit() error {
+	if err := c.execute("quit", nil, nil); err != nil && err != io.EOF {
+		return err
+	}
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	for {
+		var resp qmpResponse
+		err := c.dec.Decode(&resp)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("QEMU did not exit within %v of quit", qmpTimeout)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,167 @@
+package qemu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/intel-iot-devkit/docker-machine-driver-qemu/qemucmd"
+)
+
+// ResourceConfig holds the settings that can be changed after create. Zero
+// values leave a setting as it is.
+type ResourceConfig struct {
+	Cpus      int
+	Mem       int
+	OpenPorts []string
+}
+
+// Reconfigure validates and stores new resource settings. On a running
+// machine what can be applied live is (CPU and memory hotplug within the
+// maximums, the balloon, port forwards), the names of the settings that
+// only apply on the next Start are returned.
+func (d *Driver) Reconfigure(c ResourceConfig) ([]string, error) {
+	var ports, udpPorts []int
+	if c.OpenPorts != nil {
+		var err error
+		if ports, udpPorts, err = parseOpenPorts(c.OpenPorts); err != nil {
+			return nil, err
+		}
+	}
+	if c.Cpus < 0 || c.Mem < 0 {
+		return nil, fmt.Errorf("CPU count and memory size cannot be negative")
+	}
+	if c.Mem != 0 && c.Mem < 128 {
+		return nil, fmt.Errorf("Memory size %dMB is too small", c.Mem)
+	}
+
+	s, err := d.GetState()
+	if err != nil {
+		return nil, err
+	}
+	running := s == state.Running
+	if running && c.OpenPorts != nil {
+		//Fail before changing anything when another machine has the ports
+		claimed, claimedUDP := d.OpenPorts, d.OpenUDPPorts
+		d.OpenPorts, d.OpenUDPPorts = ports, udpPorts
+		err := d.claimOpenPorts()
+		d.OpenPorts, d.OpenUDPPorts = claimed, claimedUDP
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var restart []string
+	if c.Cpus != 0 && c.Cpus != d.Cpus {
+		switch {
+		case running && c.Cpus > d.Cpus && c.Cpus <= d.MaxCpus:
+			if err := d.AddCPUs(c.Cpus - d.Cpus); err != nil {
+				return nil, err
+			}
+		case running:
+			d.Cpus = c.Cpus
+			restart = append(restart, "cpus")
+		default:
+			d.Cpus = c.Cpus
+		}
+		if d.MaxCpus != 0 && d.MaxCpus < d.Cpus {
+			d.MaxCpus = d.Cpus
+		}
+	}
+
+	if c.Mem != 0 && c.Mem != d.Mem {
+		grow := c.Mem - d.Mem
+		switch {
+		case running && grow > 0 && c.Mem <= d.MaxMem && grow%memoryBlockSize == 0:
+			if err := d.AddMemory(grow); err != nil {
+				return nil, err
+			}
+		case running && grow < 0 && d.Balloon:
+			//The balloon gives the memory back now, the guest still sees the old size
+			d.Mem = c.Mem
+			if err := d.AdjustBalloon(); err != nil {
+				log.Warnf("Could not resize the balloon: %v", err)
+			}
+			restart = append(restart, "memory")
+		case running:
+			d.Mem = c.Mem
+			restart = append(restart, "memory")
+		default:
+			d.Mem = c.Mem
+		}
+		if d.MaxMem != 0 && d.MaxMem < d.Mem {
+			d.MaxMem = d.Mem
+		}
+	}
+
+	if c.OpenPorts != nil {
+		if running {
+			err := d.updateForwards("tcp", d.OpenPorts, ports)
+			if err == nil {
+				err = d.updateForwards("udp", d.OpenUDPPorts, udpPorts)
+			}
+			if err != nil {
+				log.Warnf("Could not update the port forwards live: %v", err)
+				restart = append(restart, "open ports")
+			}
+		}
+		d.OpenPorts, d.OpenUDPPorts = ports, udpPorts
+	}
+
+	return restart, d.saveConfig()
+}
+
+// ReconfigureMachine applies c to the machine stored in machineDir, see
+// Reconfigure.
+func ReconfigureMachine(machineDir string, c ResourceConfig) ([]string, error) {
+	d, err := loadDriver(machineDir)
+	if err != nil {
+		return nil, err
+	}
+	return d.Reconfigure(c)
+}
+
+// updateForwards changes the user network forwards of the protocol of the
+// running machine from old to ports.
+func (d *Driver) updateForwards(protocol string, old, ports []int) error {
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	keep := map[int]bool{}
+	for _, p := range ports {
+		keep[p] = true
+	}
+	current := map[int]bool{}
+	for _, p := range old {
+		current[p] = true
+		if !keep[p] {
+			if err := hmpSilent(qmp, fmt.Sprintf("hostfwd_remove mynet0 %s:127.0.0.1:%d", protocol, p)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range ports {
+		if !current[p] {
+			if err := hmpSilent(qmp, fmt.Sprintf("hostfwd_add mynet0 %s", qemucmd.HostForward{Protocol: protocol, HostAddr: "127.0.0.1", HostPort: p, GuestPort: p})); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hmpSilent runs a human monitor command that prints nothing on success.
+func hmpSilent(qmp *qmpClient, cmd string) error {
+	out, err := qmp.hmp(cmd)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%s: %s", cmd, out)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package qemu
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// createSteps lists the create steps that finished, one per line. It only
+// exists while a create is incomplete, so a failed create can be resumed by
+// docker-machine start instead of starting over.
+const createSteps = "create.steps"
+
+// createStarted reports whether an earlier create of the machine stopped
+// before it was done.
+func (d *Driver) createStarted() bool {
+	_, err := os.Stat(d.ResolveStorePath(createSteps))
+	return err == nil
+}
+
+func (d *Driver) stepDone(name string) bool {
+	f, err := os.Open(d.ResolveStorePath(createSteps))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Driver) markStep(name string) error {
+	f, err := os.OpenFile(d.ResolveStorePath(createSteps), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, name); err != nil {
+		return err
+	}
+	//Start reloads the driver from config.json, keep it up to date
+	return d.saveConfig()
+}
+
+// createStep runs the named create phase unless an earlier, interrupted
+// create already finished it, and records it once it succeeds.
+func (d *Driver) createStep(name string, fn func() error) error {
+	if d.stepDone(name) {
+		if info, ok := phaseInfos[name]; ok {
+			log.Infof("[%s] Reusing the result of the interrupted create", info.stage)
+		}
+		return nil
+	}
+	if err := d.phase("create", name, fn); err != nil {
+		return d.explainNoSpace(err)
+	}
+	return d.markStep(name)
+}
+
+// beginCreate starts tracking the steps of a create, keeping those of an
+// earlier create that did not finish.
+func (d *Driver) beginCreate() error {
+	if d.createStarted() {
+		log.Infof("Resuming the interrupted create of %s", d.MachineName)
+		return nil
+	}
+	return d.markStep("started")
+}
+
+// finishCreate drops the step markers, the machine is complete.
+func (d *Driver) finishCreate() {
+	if err := os.Remove(d.ResolveStorePath(createSteps)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Could not remove the create markers of %s: %v", d.MachineName, err)
+	}
+}
+
+// launchForCreate boots the machine, unless the interrupted create already
+// got it running and failed later on.
+func (d *Driver) launchForCreate() error {
+	if d.stepDone("launch") {
+		if s, err := d.GetState(); err == nil && s == state.Running {
+			return nil
+		}
+	}
+	if err := d.launch(); err != nil {
+		return err
+	}
+	return d.markStep("launch")
+}
+
+// removeKeyLeftovers removes a half-written SSH key pair, which the key
+// generation would otherwise keep.
+func (d *Driver) removeKeyLeftovers() {
+	key := d.GetSSHKeyPath()
+	os.Remove(key)
+	os.Remove(key + ".pub")
+}
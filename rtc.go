@@ -0,0 +1,63 @@
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var rtcBases = []string{"utc", "localtime"}
+
+var rtcDriftFixes = []string{"none", "slew"}
+
+var keyboardLayout = regexp.MustCompile(`^[a-z]{2,4}(-[a-z]{2,3})?$`)
+
+func validateRTC(base, driftFix, keyboard string) error {
+	if base != "" && !stringIn(rtcBases, base) {
+		return fmt.Errorf("Invalid RTC base %q, must be one of %v", base, rtcBases)
+	}
+	if driftFix != "" && !stringIn(rtcDriftFixes, driftFix) {
+		return fmt.Errorf("Invalid RTC drift fix %q, must be one of %v", driftFix, rtcDriftFixes)
+	}
+	if keyboard != "" && !keyboardLayout.MatchString(keyboard) {
+		return fmt.Errorf("Invalid keyboard layout %q, use a QEMU keymap name such as en-us or de-ch", keyboard)
+	}
+	return nil
+}
+
+func stringIn(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rtcArgs returns the -rtc and -k options for the stored clock and keyboard
+// configuration. QEMU's defaults apply to anything left unset, except that
+// Windows guests expect the clock in local time.
+func (d *Driver) rtcArgs() ([]string, error) {
+	var args []string
+	base := d.RTC
+	if base == "" && d.isWindowsGuest() {
+		base = "localtime"
+	}
+	if base != "" || d.RTCDriftFix != "" {
+		opts := newQemuOpts("")
+		if base != "" {
+			opts.Set("base", base)
+		}
+		if d.RTCDriftFix != "" {
+			opts.Set("driftfix", d.RTCDriftFix)
+		}
+		rtc, err := opts.Build()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-rtc", rtc)
+	}
+	if d.Keyboard != "" {
+		args = append(args, "-k", d.Keyboard)
+	}
+	return args, nil
+}
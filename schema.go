@@ -0,0 +1,78 @@
+package qemu
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The driver is persisted as the Driver object of the machine's
+// config.json. ConfigVersion records the schema it was written with, and
+// configs of older drivers are upgraded on load by the migrations below,
+// so fields can be renamed or restructured without orphaning machines.
+
+// configVersion is the schema this driver writes.
+const configVersion = 1
+
+// migrations[n] upgrades a raw config of schema n to n+1.
+var migrations = []func(config map[string]interface{}){
+	// Settings left empty by the first drivers get their implied values
+	func(config map[string]interface{}) {
+		setDefault(config, "Provisioner", "boot2docker")
+		if disk, _ := config["Disk"].(string); disk != "" {
+			setDefault(config, "DiskFormat", "qcow2")
+		}
+		//Disk keys written before the keychain existed are files
+		setDefault(config, "SecretStore", "file")
+	},
+}
+
+func setDefault(config map[string]interface{}, key string, value interface{}) {
+	if v, ok := config[key]; !ok || v == nil || v == "" {
+		config[key] = value
+	}
+}
+
+// driverConfig has Driver's fields without its JSON methods.
+type driverConfig Driver
+
+// UnmarshalJSON loads a config of any schema, migrating it to the current
+// one.
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	var config map[string]interface{}
+	//Numbers are kept as written, durations do not fit a float64
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&config); err != nil {
+		return err
+	}
+	version := 0
+	if v, ok := config["ConfigVersion"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return err
+		}
+		version = int(n)
+	}
+	if version > configVersion {
+		log.Warnf("The config of %v was written by a newer driver (schema %d, this driver knows %d)", config["MachineName"], version, configVersion)
+	}
+	for ; version < configVersion; version++ {
+		migrations[version](config)
+	}
+	config["ConfigVersion"] = version
+	migrated, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(migrated, (*driverConfig)(d))
+}
+
+// MarshalJSON saves the config in the current schema.
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	if d.ConfigVersion < configVersion {
+		d.ConfigVersion = configVersion
+	}
+	return json.Marshal((*driverConfig)(d))
+}
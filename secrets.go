@@ -0,0 +1,22 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+)
+
+// hardenArtifacts restricts the machine's secrets to the current user: the
+// SSH private key and the disk, which holds a copy of the key and all the
+// guest data. OpenSSH refuses keys other users can read.
+func (d *Driver) hardenArtifacts() error {
+	paths := []string{d.GetSSHKeyPath()}
+	if info, err := os.Stat(d.Disk); err == nil && info.Mode().IsRegular() {
+		paths = append(paths, d.Disk)
+	}
+	for _, path := range paths {
+		if err := restrictToOwner(path); err != nil {
+			return fmt.Errorf("Could not restrict access to %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package qemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// writeSeedISO writes a small ISO9660 image with a Joliet tree holding files
+// in its root directory. It is used for cloud-init NoCloud seeds, which are
+// found by their volume label and need the lower case Joliet names.
+//
+// Layout: system area, primary and Joliet descriptors, terminator, the four
+// path tables, the two root directories and then the file data.
+func writeSeedISO(path string, label string, files map[string][]byte) error {
+	const (
+		pvdLBA      = 16
+		jolietLBA   = 17
+		pathLBA     = 19
+		pvdRootLBA  = 23
+		joRootLBA   = 24
+		firstFile   = 25
+		pathTabSize = 10
+	)
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lba := uint32(firstFile)
+	extents := map[string]uint32{}
+	for _, name := range names {
+		extents[name] = lba
+		lba += sectors(len(files[name]))
+	}
+	total := lba
+
+	now := time.Now().UTC()
+	iso := make([]byte, int(total)*isoSector)
+
+	pvdRoot := dirRecords(now, pvdRootLBA, names, extents, files, isoName)
+	joRoot := dirRecords(now, joRootLBA, names, extents, files, jolietName)
+	if len(pvdRoot) > isoSector || len(joRoot) > isoSector {
+		return fmt.Errorf("Too many files for a seed ISO")
+	}
+
+	writeVolumeDescriptor(sector(iso, pvdLBA), 1, now, total, pathLBA, pvdRootLBA, padded([]byte(label), 32, ' '), nil)
+	writeVolumeDescriptor(sector(iso, jolietLBA), 2, now, total, pathLBA+2, joRootLBA, ucs2(fmt.Sprintf("%-16s", label)), []byte("%/E"))
+	terminator := sector(iso, jolietLBA+1)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	for i, root := range []uint32{pvdRootLBA, joRootLBA} {
+		binary.LittleEndian.PutUint32(sector(iso, pathLBA+2*i)[2:], root)
+		sector(iso, pathLBA+2*i)[0] = 1
+		binary.LittleEndian.PutUint16(sector(iso, pathLBA+2*i)[6:], 1)
+		binary.BigEndian.PutUint32(sector(iso, pathLBA+2*i+1)[2:], root)
+		sector(iso, pathLBA+2*i+1)[0] = 1
+		binary.BigEndian.PutUint16(sector(iso, pathLBA+2*i+1)[6:], 1)
+	}
+
+	copy(sector(iso, pvdRootLBA), pvdRoot)
+	copy(sector(iso, joRootLBA), joRoot)
+	for _, name := range names {
+		copy(iso[int(extents[name])*isoSector:], files[name])
+	}
+	return ioutil.WriteFile(path, iso, 0644)
+}
+
+const isoSector = 2048
+
+func sector(iso []byte, lba int) []byte {
+	return iso[lba*isoSector : (lba+1)*isoSector]
+}
+
+func sectors(size int) uint32 {
+	n := (size + isoSector - 1) / isoSector
+	if n == 0 {
+		n = 1
+	}
+	return uint32(n)
+}
+
+func writeVolumeDescriptor(vd []byte, kind byte, now time.Time, total uint32, pathLBA int, rootLBA int, volumeID []byte, escapes []byte) {
+	vd[0] = kind
+	copy(vd[1:], "CD001")
+	vd[6] = 1
+	copy(vd[8:40], bytes.Repeat([]byte(" "), 32))
+	copy(vd[40:72], volumeID)
+	bothEndian32(vd[80:], total)
+	copy(vd[88:], escapes)
+	bothEndian16(vd[120:], 1)
+	bothEndian16(vd[124:], 1)
+	bothEndian16(vd[128:], isoSector)
+	bothEndian32(vd[132:], 10)
+	binary.LittleEndian.PutUint32(vd[140:], uint32(pathLBA))
+	binary.BigEndian.PutUint32(vd[148:], uint32(pathLBA+1))
+	copy(vd[156:], dirRecord(now, uint32(rootLBA), isoSector, true, []byte{0}))
+	copy(vd[190:813], bytes.Repeat([]byte(" "), 813-190))
+	stamp := []byte(now.Format("20060102150405") + "00\x00")
+	copy(vd[813:], stamp)
+	copy(vd[830:], stamp)
+	copy(vd[847:], "0000000000000000\x00")
+	copy(vd[864:], stamp)
+	vd[881] = 1
+}
+
+// dirRecords builds a root directory holding ".", ".." and the files.
+func dirRecords(now time.Time, self uint32, names []string, extents map[string]uint32, files map[string][]byte, ident func(string) []byte) []byte {
+	var dir []byte
+	dir = append(dir, dirRecord(now, self, isoSector, true, []byte{0})...)
+	dir = append(dir, dirRecord(now, self, isoSector, true, []byte{1})...)
+	for _, name := range names {
+		dir = append(dir, dirRecord(now, extents[name], uint32(len(files[name])), false, ident(name))...)
+	}
+	return dir
+}
+
+func dirRecord(now time.Time, extent uint32, size uint32, isDir bool, ident []byte) []byte {
+	length := 33 + len(ident)
+	if length%2 != 0 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	bothEndian32(r[2:], extent)
+	bothEndian32(r[10:], size)
+	r[18] = byte(now.Year() - 1900)
+	r[19] = byte(now.Month())
+	r[20] = byte(now.Day())
+	r[21] = byte(now.Hour())
+	r[22] = byte(now.Minute())
+	r[23] = byte(now.Second())
+	if isDir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(ident))
+	copy(r[33:], ident)
+	return r
+}
+
+// isoName maps a name to an ISO9660 level 1 file identifier.
+func isoName(name string) []byte {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	if len(name) > 8 {
+		name = name[:8]
+	}
+	return []byte(name + ".;1")
+}
+
+func jolietName(name string) []byte {
+	return ucs2(name)
+}
+
+func ucs2(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+func padded(b []byte, size int, pad byte) []byte {
+	out := bytes.Repeat([]byte{pad}, size)
+	copy(out, b)
+	return out[:size]
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
@@ -0,0 +1,67 @@
+package qemu
+
+import (
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Stop presses the ACPI power button through QMP instead of running
+// poweroff over SSH, so a machine whose SSH server is gone still shuts down
+// cleanly. QEMU exits once the guest powered off. A guest that does not
+// within --qemu-shutdown-timeout is killed like by Kill: QEMU is told to
+// quit, and its process is killed when it has not within
+// --qemu-kill-timeout.
+
+// The timeouts of machines created before they were configurable.
+const (
+	defaultShutdownTimeout = time.Minute
+	defaultKillTimeout     = 10 * time.Second
+)
+
+func (d *Driver) shutdownTimeout() time.Duration {
+	if d.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return d.ShutdownTimeout
+}
+
+func (d *Driver) killTimeout() time.Duration {
+	if d.KillTimeout <= 0 {
+		return defaultKillTimeout
+	}
+	return d.KillTimeout
+}
+
+// powerDown sends the guest an ACPI power-down and waits for QEMU to exit,
+// reporting whether it did before the shutdown timeout.
+func (d *Driver) powerDown() bool {
+	if err := d.controlCommand("system_powerdown"); err != nil {
+		log.Warnf("Could not send %s the power-down request: %v", d.MachineName, err)
+		return false
+	}
+	log.Infof("Waiting up to %s for %s to power off", d.shutdownTimeout(), d.MachineName)
+	return waitUntil(d.shutdownTimeout(), d.qemuExited)
+}
+
+// qemuExited reports whether QEMU is gone, by its PID file or, for QEMU
+// started by an older driver, by its control port.
+func (d *Driver) qemuExited() bool {
+	if pid, err := d.readPid(); err == nil {
+		return !processAlive(pid)
+	}
+	return !d.qemuAnswers()
+}
+
+// waitUntil polls done until it holds or timeout passed, reporting whether
+// it held.
+func waitUntil(timeout time.Duration, done func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if done() {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return done()
+}
@@ -0,0 +1,109 @@
+package qemu
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// With --qemu-sleep-guard a helper process pauses the guest before the host
+// suspends and resumes it afterwards, setting the guest clock from the
+// host's. A guest left running across host sleep comes back with a clock
+// far behind, breaking TLS, and HAXM guests often hang.
+
+// validateSleepGuard rejects --qemu-sleep-guard where the host sleep
+// notifications cannot be followed.
+func validateSleepGuard(d *Driver) error {
+	if d.SleepGuard && runtime.GOOS == "darwin" {
+		return fmt.Errorf("--qemu-sleep-guard is not supported on macOS")
+	}
+	return nil
+}
+
+// startSleepGuard starts "docker-machine-driver-qemu sleep-guard" for the
+// machine in the background.
+func (d *Driver) startSleepGuard() error {
+	if !d.SleepGuard {
+		return nil
+	}
+	d.stopHelper("sleepguard")
+	return d.spawnHelper("sleep-guard", "sleepguard")
+}
+
+// GuardSleep follows the host sleep notifications for the machine stored in
+// machineDir until the process is killed. It is run by the plugin binary's
+// sleep-guard mode.
+func GuardSleep(machineDir string) error {
+	// The guard may start before a new machine's config is saved, so it is
+	// only read once there is something to do.
+	withDriver := func(fn func(d *Driver)) func() {
+		return func() {
+			d, err := loadDriver(machineDir)
+			if err != nil {
+				log.Errorf("Could not read the machine in %s: %v", machineDir, err)
+				return
+			}
+			fn(d)
+		}
+	}
+	//A machine the user paused is left paused on resume
+	var paused int32
+	suspend := withDriver(func(d *Driver) {
+		if d.pauseForSleep() {
+			atomic.StoreInt32(&paused, 1)
+		}
+	})
+	resume := withDriver(func(d *Driver) {
+		if atomic.SwapInt32(&paused, 0) == 1 {
+			d.resumeFromSleep()
+		}
+	})
+	return watchHostSleep(suspend, resume)
+}
+
+// pauseForSleep pauses a running guest and reports whether it did.
+func (d *Driver) pauseForSleep() bool {
+	status, err := d.vmStatus()
+	if err != nil || status != "running" {
+		log.Infof("Host is suspending, %s is not running", d.MachineName)
+		return false
+	}
+	log.Infof("Host is suspending, pausing %s", d.MachineName)
+	if err := d.qmpCommand("stop"); err != nil {
+		log.Errorf("Could not pause %s: %v", d.MachineName, err)
+		return false
+	}
+	return true
+}
+
+func (d *Driver) resumeFromSleep() {
+	log.Infof("Host resumed, resuming %s", d.MachineName)
+	if err := d.qmpCommand("cont"); err != nil {
+		log.Errorf("Could not resume %s: %v", d.MachineName, err)
+		return
+	}
+	// The network may take a moment to come back in the guest
+	for i := 0; i < 10; i++ {
+		_, err := drivers.RunSSHCommandFromDriver(d, fmt.Sprintf("sudo date -u -s @%d", time.Now().Unix()))
+		if err == nil {
+			return
+		}
+		log.Debugf("Setting the clock of %s: %v", d.MachineName, err)
+		time.Sleep(3 * time.Second)
+	}
+	log.Errorf("Could not set the clock of %s after resume", d.MachineName)
+}
+
+// qmpCommand runs a QMP command without arguments or result.
+func (d *Driver) qmpCommand(cmd string) error {
+	qmp, err := dialQMP(d.QMPPort)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+	return qmp.execute(cmd, nil, nil)
+}
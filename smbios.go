@@ -0,0 +1,63 @@
+package qemu
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// SMBIOS identity is derived from the machine name, so a machine recreated
+// under the same name looks like the same computer to guest tooling and
+// licenses keyed to the system UUID or serial number.
+
+// nameUUID returns a name based (version 5 style) UUID for the machine.
+func nameUUID(name string) string {
+	sum := sha1.Sum([]byte("docker-machine-qemu:" + name))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// setSMBIOSDefaults fills in the identity values not given as flags.
+func (d *Driver) setSMBIOSDefaults() error {
+	if d.SMBIOSUUID == "" {
+		d.SMBIOSUUID = nameUUID(d.MachineName)
+	}
+	d.SMBIOSUUID = strings.ToLower(d.SMBIOSUUID)
+	if !uuidPattern.MatchString(d.SMBIOSUUID) {
+		return fmt.Errorf("Invalid SMBIOS UUID %q", d.SMBIOSUUID)
+	}
+	if d.SMBIOSSerial == "" {
+		d.SMBIOSSerial = "DM-" + strings.ToUpper(strings.Replace(d.SMBIOSUUID, "-", "", -1)[:12])
+	}
+	if d.SMBIOSAssetTag == "" {
+		d.SMBIOSAssetTag = "docker-machine-" + d.MachineName
+	}
+	return nil
+}
+
+// smbiosArgs returns the system and chassis SMBIOS tables carrying the
+// machine identity. Machines created before it was set get none.
+func (d *Driver) smbiosArgs() ([]string, error) {
+	if d.SMBIOSUUID == "" || !d.arch().smbios {
+		return nil, nil
+	}
+	system, err := newQemuOpts("").
+		Set("type", "1").
+		Set("uuid", d.SMBIOSUUID).
+		Set("serial", d.SMBIOSSerial).
+		Set("family", "docker-machine").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	chassis, err := newQemuOpts("").
+		Set("type", "3").
+		Set("serial", d.SMBIOSSerial).
+		Set("asset", d.SMBIOSAssetTag).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-uuid", d.SMBIOSUUID, "-smbios", system, "-smbios", chassis}, nil
+}
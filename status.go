@@ -0,0 +1,165 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// docker-machine ls has no column a driver can fill, so GetState keeps a
+// summary of every QEMU machine in qemu-status.json in the store instead:
+// its state, accelerator, size and how much of its disk is used. The
+// plugin binary's status mode prints it as a table.
+
+// statusRefresh is how old a machine's entry may get before GetState
+// rewrites it although the state did not change.
+const statusRefresh = time.Minute
+
+// MachineStatus is the summary of one machine.
+type MachineStatus struct {
+	State      string    `json:"state"`
+	Accel      string    `json:"accel"`
+	Cpus       int       `json:"cpus"`
+	MemoryMB   int       `json:"memory_mb"`
+	DiskUsedMB int64     `json:"disk_used_mb"`
+	DiskSizeMB int       `json:"disk_size_mb"`
+	Updated    time.Time `json:"updated"`
+}
+
+// String renders the status the way docker-machine shows driver details.
+func (s MachineStatus) String() string {
+	return fmt.Sprintf("%s, %d vCPUs, %dMB, disk %dMB/%dMB", s.Accel, s.Cpus, s.MemoryMB, s.DiskUsedMB, s.DiskSizeMB)
+}
+
+func statusPath(storePath string) string {
+	return filepath.Join(storePath, "qemu-status.json")
+}
+
+func readStatuses(storePath string) (map[string]MachineStatus, error) {
+	statuses := map[string]MachineStatus{}
+	data, err := ioutil.ReadFile(statusPath(storePath))
+	if os.IsNotExist(err) {
+		return statuses, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil, fmt.Errorf("Invalid status file %s: %v", statusPath(storePath), err)
+	}
+	return statuses, nil
+}
+
+// updateStatuses runs fn on the statuses under a lock and saves them.
+func (d *Driver) updateStatuses(fn func(statuses map[string]MachineStatus)) error {
+	path := statusPath(d.StorePath)
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	statuses, err := readStatuses(d.StorePath)
+	if err != nil {
+		//A broken summary is rebuilt from the machines
+		log.Debugf("%v", err)
+		statuses = map[string]MachineStatus{}
+	}
+	fn(statuses)
+	data, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// status takes a snapshot of the machine in state s.
+func (d *Driver) status(s state.State) MachineStatus {
+	status := MachineStatus{
+		State:      s.String(),
+		Accel:      d.requestedAccel(),
+		Cpus:       d.Cpus,
+		MemoryMB:   d.Mem,
+		DiskSizeMB: d.DiskSize,
+		Updated:    time.Now(),
+	}
+	var report featureReport
+	if data, err := ioutil.ReadFile(d.ResolveStorePath("features.json")); err == nil && json.Unmarshal(data, &report) == nil {
+		for _, f := range report.Features {
+			if f.Feature == "accel" && f.Effective != "" {
+				status.Accel = f.Effective
+			}
+		}
+	}
+	if used, err := allocatedSize(d.Disk); err == nil {
+		status.DiskUsedMB = used / (1024 * 1024)
+	}
+	return status
+}
+
+// refreshStatus updates the machine's summary when its state changed or
+// the entry is getting old. Failing to is not worth failing GetState for.
+func (d *Driver) refreshStatus(s state.State) {
+	if d.StorePath == "" || d.MachineName == "" {
+		return
+	}
+	if statuses, err := readStatuses(d.StorePath); err == nil {
+		old, ok := statuses[d.MachineName]
+		if ok && old.State == s.String() && time.Since(old.Updated) < statusRefresh {
+			return
+		}
+	}
+	status := d.status(s)
+	err := d.updateStatuses(func(statuses map[string]MachineStatus) {
+		statuses[d.MachineName] = status
+	})
+	if err != nil {
+		log.Debugf("Could not update the status of %s: %v", d.MachineName, err)
+	}
+}
+
+// dropStatus removes the summary of a removed machine.
+func (d *Driver) dropStatus() {
+	if _, err := os.Stat(statusPath(d.StorePath)); os.IsNotExist(err) {
+		return
+	}
+	err := d.updateStatuses(func(statuses map[string]MachineStatus) {
+		delete(statuses, d.MachineName)
+	})
+	if err != nil {
+		log.Debugf("Could not drop the status of %s: %v", d.MachineName, err)
+	}
+}
+
+// StatusTable renders the summaries of all QEMU machines in the store at
+// storePath, as last seen by GetState. It is run by the plugin binary's
+// status mode.
+func StatusTable(storePath string) (string, error) {
+	statuses, err := readStatuses(storePath)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tACCEL\tCPUS\tMEMORY\tDISK\tUPDATED")
+	for _, name := range names {
+		s := statuses[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%dMB\t%dMB/%dMB\t%s ago\n", name, s.State, s.Accel, s.Cpus, s.MemoryMB,
+			s.DiskUsedMB, s.DiskSizeMB, time.Since(s.Updated).Round(time.Second))
+	}
+	w.Flush()
+	return b.String(), nil
+}
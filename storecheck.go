@@ -0,0 +1,64 @@
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isoReserve is the space in MB kept for the ISO or image and the files
+// extracted from it.
+const isoReserve = 200
+
+// checkStorePath fails early when the machine directory, or the directory
+// of an external disk, cannot hold the machine: not writable, short on
+// space for the disk and ISO, or on a FAT filesystem which cannot hold
+// files over 4GB nor sparse ones.
+func (d *Driver) checkStorePath() error {
+	needs, err := d.storeNeeds()
+	if err != nil {
+		return err
+	}
+	for dir, size := range needs {
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+		if fs, err := filesystemType(dir); err == nil && strings.Contains(strings.ToUpper(fs), "FAT") {
+			return fmt.Errorf("%s is on a %s filesystem, which cannot hold disk images, use another location", dir, fs)
+		}
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			continue
+		}
+		if free < uint64(size)<<20 {
+			return spaceError(dir, free, size)
+		}
+	}
+	return nil
+}
+
+// existingParent returns path or its closest existing parent, since the
+// machine directory may not be created yet.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
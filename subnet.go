@@ -0,0 +1,132 @@
+package qemu
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// QEMU's user mode network puts the guest in 192.168.76.0/24. When a VPN
+// claims that range the guest's traffic, DNS included, goes into the
+// tunnel, so every start checks the subnet against the host's networks and
+// moves the guest to a free RFC 1918 /24 when they overlap.
+
+const defaultGuestSubnet = "192.168.76.0/24"
+
+// guestSubnet returns the machine's user mode subnet. Machines created
+// before it was chosen use the default.
+func (d *Driver) guestSubnet() string {
+	if d.GuestSubnet == "" {
+		return defaultGuestSubnet
+	}
+	return d.GuestSubnet
+}
+
+// guestDHCPStart is the first address the user mode DHCP hands out.
+func (d *Driver) guestDHCPStart() string {
+	_, subnet, err := net.ParseCIDR(d.guestSubnet())
+	if err != nil {
+		return ""
+	}
+	ip := subnet.IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], 9).String()
+}
+
+// chooseGuestSubnet keeps the machine's subnet unless a host network
+// overlaps it, in which case the first free /24 is taken.
+func (d *Driver) chooseGuestSubnet() error {
+	taken := hostNetworks()
+	if !overlapsAny(d.guestSubnet(), taken) {
+		return nil
+	}
+	for _, candidate := range subnetCandidates() {
+		if candidate == hostOnlySubnet || overlapsAny(candidate, taken) {
+			continue
+		}
+		log.Warnf("%s of %s is in use by the host, probably a VPN, moving the guest to %s", d.guestSubnet(), d.MachineName, candidate)
+		d.GuestSubnet = candidate
+		return nil
+	}
+	return fmt.Errorf("No free private /24 left for the guest network of %s", d.MachineName)
+}
+
+// subnetCandidates lists the /24s tried, the default's neighbours first.
+func subnetCandidates() []string {
+	var candidates []string
+	for i := 76; i < 256; i++ {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d.0/24", i))
+	}
+	for i := 16; i < 32; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.76.0/24", i))
+	}
+	for i := 0; i < 256; i++ {
+		candidates = append(candidates, fmt.Sprintf("10.%d.76.0/24", i))
+	}
+	return candidates
+}
+
+func overlapsAny(cidr string, networks []*net.IPNet) bool {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(subnet.IP) || subnet.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostNetworks returns the IPv4 networks of the host's interfaces and
+// routes, leaving out loopback and default routes.
+func hostNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debugf("Could not list the host networks: %v", err)
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+			networks = append(networks, n)
+		}
+	}
+	for _, n := range hostRoutes() {
+		if ones, _ := n.Mask.Size(); ones > 0 {
+			networks = append(networks, n)
+		}
+	}
+	return networks
+}
+
+// validateGuestDNS checks the --qemu-guest-dns servers.
+func validateGuestDNS(servers []string) error {
+	for _, s := range servers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("Invalid guest DNS server %q, must be an IP address", s)
+		}
+	}
+	return nil
+}
+
+// guestDNSCommands pins the guest's DNS servers, so name resolution does
+// not follow the host's resolver through VPN changes.
+func (d *Driver) guestDNSCommands() []string {
+	if len(d.GuestDNS) == 0 {
+		return nil
+	}
+	d.progress("Setting guest DNS to %s...", strings.Join(d.GuestDNS, ", "))
+	return []string{resolvConfCommand(d.GuestDNS)}
+}
+
+// resolvConfCommand is the guest command pointing /etc/resolv.conf at the
+// servers.
+func resolvConfCommand(servers []string) string {
+	var lines []string
+	for _, server := range servers {
+		lines = append(lines, "nameserver "+server)
+	}
+	return fmt.Sprintf("printf '%s\\n' > /etc/resolv.conf", strings.Join(lines, "\\n"))
+}
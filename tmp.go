@@ -0,0 +1,63 @@
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Intermediate files of an operation, like the raw disk of create or the
+// key handed to qemu-img, live in the tmp directory of the machine. It is
+// removed when the operation ends, whether it succeeded or not, and is never
+// part of a support bundle.
+const machineTmp = "tmp"
+
+// tmpPath returns the path of name in the machine's tmp directory, creating
+// the directory if needed.
+func (d *Driver) tmpPath(name string) (string, error) {
+	dir := d.ResolveStorePath(machineTmp)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := restrictToOwner(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// writeTmp writes data readable only by the owner to name in the tmp
+// directory and returns its path with a func removing it again.
+func (d *Driver) writeTmp(name string, data []byte) (string, func(), error) {
+	path, err := d.tmpPath(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", nil, err
+	}
+	if err := restrictToOwner(path); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+	return path, func() { os.Remove(path) }, nil
+}
+
+// cleanTmp removes the tmp directory and whatever an operation left in it.
+func (d *Driver) cleanTmp() {
+	if err := os.RemoveAll(d.ResolveStorePath(machineTmp)); err != nil {
+		log.Debugf("Could not remove the tmp directory of %s: %v", d.MachineName, err)
+	}
+}
+
+// scratchFor returns where a file replacing path is written before it is
+// renamed over it. It is the tmp directory for files of the machine
+// directory, other files are written next to themselves so the rename stays
+// on one filesystem.
+func (d *Driver) scratchFor(path, suffix string) (string, error) {
+	if filepath.Dir(path) != filepath.Clean(d.ResolveStorePath(".")) {
+		return path + suffix, nil
+	}
+	return d.tmpPath(filepath.Base(path) + suffix)
+}
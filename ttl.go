@@ -0,0 +1,62 @@
+package qemu
+
+import (
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Machines created with --qemu-ttl expire. A docker-machine command
+// asking an expired machine for its state removes it, and the supervisor of
+// a lazily started machine removes its own, so ephemeral CI machines do not
+// pile up. Each driver only reaps its own machine, the store's other
+// machines may be in use by other commands.
+
+// reapInterval is how often a supervisor checks its machine's expiry.
+const reapInterval = time.Minute
+
+func (d *Driver) expired() bool {
+	return !d.Expiry.IsZero() && time.Now().After(d.Expiry)
+}
+
+// reapExpired destroys d once it expired, unless it is being removed
+// already, and reports whether it did.
+func (d *Driver) reapExpired() bool {
+	if d.removing || !d.expired() {
+		return false
+	}
+	if err := d.destroy(); err != nil {
+		log.Warnf("Could not remove the expired machine %s: %v", d.MachineName, err)
+		return false
+	}
+	return true
+}
+
+// destroy stops and removes the expired machine together with its
+// directory in the store.
+func (d *Driver) destroy() error {
+	log.Infof("%s expired at %s, removing it", d.MachineName, d.Expiry.Format(time.RFC3339))
+	if err := d.transition("removing", "removed", d.remove); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.ResolveStorePath("."))
+}
+
+// reapSelf destroys the supervised machine once it expired and ends the
+// supervisor after the cleanup, which leaves the supervisor running.
+func (d *Driver) reapSelf() {
+	if d.Expiry.IsZero() {
+		return
+	}
+	for range time.Tick(reapInterval) {
+		if !d.expired() {
+			continue
+		}
+		if err := d.destroy(); err != nil {
+			log.Errorf("Could not remove the expired machine %s: %v", d.MachineName, err)
+			continue
+		}
+		os.Exit(0)
+	}
+}